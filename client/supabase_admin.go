@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"strconv"
 
 	"github.com/carlmjohnson/requests"
 )
@@ -98,3 +99,93 @@ func (s SupabaseAdminClient) AuthorizeZoneId(ctx context.Context, userId string,
 
 	return true
 }
+
+type PullZoneIdRow struct {
+	PullZoneId int `json:"pull_zone_id"`
+}
+
+// how many sites to ask for at once, at or under PostgREST's max-rows
+const listSitesPage = 1000
+
+// ListPullZoneIds gets the pull zone of every site, which needs the service key
+// since RLS only lets normal users see their own. Returns nil if it didn't work
+func (s SupabaseAdminClient) ListPullZoneIds(ctx context.Context) []int {
+
+	rows, err := listSites[PullZoneIdRow](ctx, s, "pull_zone_id")
+	if err != nil {
+		log.Printf("[ERROR] Unable to list pull zones of SITE rows: %v", err)
+		return nil
+	}
+
+	zoneIds := []int{}
+	for _, row := range rows {
+		zoneIds = append(zoneIds, row.PullZoneId)
+	}
+
+	return zoneIds
+}
+
+// null for the default, see "ecstatic admin retention"
+type RetentionDaysRow struct {
+	PullZoneId    int  `json:"pull_zone_id"`
+	RetentionDays *int `json:"retention_days"`
+}
+
+// ListRetentionDays gets how many days of logs to keep for each pull zone whose
+// site has its own retention_days. Returns nil if it didn't work
+func (s SupabaseAdminClient) ListRetentionDays(ctx context.Context) map[int]int {
+
+	rows, err := listSites[RetentionDaysRow](ctx, s, "pull_zone_id,retention_days")
+	if err != nil {
+		log.Printf("[ERROR] Unable to list retention of SITE rows: %v", err)
+		return nil
+	}
+
+	days := map[int]int{}
+	for _, row := range rows {
+		if row.RetentionDays != nil {
+			days[row.PullZoneId] = *row.RetentionDays
+		}
+	}
+
+	return days
+}
+
+// every site row, with just the columns asked for. A page at a time, since
+// PostgREST quietly stops at max-rows, until a page comes back empty (a short
+// one might only mean max-rows is lower than our page)
+func listSites[Row any](ctx context.Context, s SupabaseAdminClient, columns string) ([]Row, error) {
+
+	all := []Row{}
+
+	for {
+
+		var rows []Row
+		var errorJson map[string]interface{}
+
+		err := requests.
+			URL(s.SupabaseUrl).
+			Path("/rest/v1/site").
+			Param("select", columns).
+			// a stable order, so no site gets skipped or seen twice between pages
+			Param("order", "id").
+			Param("limit", strconv.Itoa(listSitesPage)).
+			Param("offset", strconv.Itoa(len(all))).
+			Header("apikey", s.SupabaseAnonKey).
+			Header("Authorization", fmt.Sprintf("Bearer %v", s.SupabaseServiceKey)).
+			ContentType("application/json").
+			ToJSON(&rows).
+			ErrorJSON(&errorJson).
+			Fetch(ctx)
+
+		if err != nil {
+			return nil, fmt.Errorf("%w, response: %+v", err, errorJson)
+		}
+
+		if len(rows) == 0 {
+			return all, nil
+		}
+
+		all = append(all, rows...)
+	}
+}
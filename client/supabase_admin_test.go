@@ -0,0 +1,58 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestListPullZoneIdsPages(t *testing.T) {
+
+	sites := []PullZoneIdRow{}
+	for n := 1; n <= 7; n++ {
+		sites = append(sites, PullZoneIdRow{n * 100})
+	}
+
+	// like PostgREST with max-rows = 3, lower than the page we ask for
+	server := httptest.NewServer(http.HandlerFunc(func(out http.ResponseWriter, req *http.Request) {
+		offset, _ := strconv.Atoi(req.URL.Query().Get("offset"))
+		limit, _ := strconv.Atoi(req.URL.Query().Get("limit"))
+		end := min(offset+limit, offset+3, len(sites))
+		json.NewEncoder(out).Encode(sites[min(offset, end):end])
+	}))
+	defer server.Close()
+
+	supabase := SupabaseAdminClient{SupabaseUrl: server.URL}
+
+	assert.Equal(t, []int{100, 200, 300, 400, 500, 600, 700}, supabase.ListPullZoneIds(context.Background()))
+
+	// and nothing at all if it goes wrong
+	server.Close()
+	assert.Nil(t, supabase.ListPullZoneIds(context.Background()))
+}
+
+func TestListRetentionDays(t *testing.T) {
+
+	server := httptest.NewServer(http.HandlerFunc(func(out http.ResponseWriter, req *http.Request) {
+		assert.Equal(t, "pull_zone_id,retention_days", req.URL.Query().Get("select"))
+		if req.URL.Query().Get("offset") != "0" {
+			out.Write([]byte("[]"))
+			return
+		}
+		out.Write([]byte(`[{"pull_zone_id":100,"retention_days":30},{"pull_zone_id":200,"retention_days":null},{"pull_zone_id":300,"retention_days":0}]`))
+	}))
+	defer server.Close()
+
+	supabase := SupabaseAdminClient{SupabaseUrl: server.URL}
+
+	// null is no retention of its own, 0 is left for the caller to decide
+	assert.Equal(t, map[int]int{100: 30, 300: 0}, supabase.ListRetentionDays(context.Background()))
+
+	server.Close()
+	assert.Nil(t, supabase.ListRetentionDays(context.Background()))
+}
@@ -0,0 +1,75 @@
+package admin
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	ch "github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+)
+
+const (
+	AuditSuccess = "success"
+	AuditFailure = "failure"
+)
+
+// AuditRecord is one row of audit_log (see schema/migrations/0014), written
+// for every deletion, whether or not it worked
+type AuditRecord struct {
+	Action string
+	ZoneId int
+	Actor  string
+	Result string
+	Detail string
+}
+
+func writeAudit(ctx context.Context, conn driver.Conn, record AuditRecord) error {
+	return conn.Exec(ctx, "INSERT INTO audit_log (At, Action, ZoneId, Actor, Result, Detail) VALUES (?, ?, ?, ?, ?, ?)",
+		time.Now(), record.Action, uint32(record.ZoneId), record.Actor, record.Result, record.Detail)
+}
+
+// a set of rows to count or delete, the where clause with its ? placeholders
+type rowSet struct {
+	table string
+	where string
+	args  []any
+}
+
+// every table that can hold a zone's logs, or anything made from them.
+// accesslog_mergetree is only there when somebody kept the table from before
+// 0013 around
+func purgeTargets(ctx context.Context, conn driver.Conn, zoneId int) ([]rowSet, error) {
+
+	targets := []rowSet{
+		{"accesslog", "PullZoneId = ?", []any{uint32(zoneId)}},
+		{"accesslog_hourly", "PullZoneId = ?", []any{uint32(zoneId)}},
+		{"accesslog_daily", "PullZoneId = ?", []any{uint32(zoneId)}},
+		// bunny dead letters don't have ZoneId set, but their raw log does
+		{"accesslog_rejected", "ZoneId = ? OR JSONExtractUInt(Raw, 'PullZoneId') = ?", []any{uint32(zoneId), uint64(zoneId)}},
+	}
+
+	var exists uint8
+	err := conn.QueryRow(ctx, "EXISTS TABLE accesslog_mergetree").Scan(&exists)
+	if err != nil {
+		return nil, fmt.Errorf("Could not check for accesslog_mergetree: %w", err)
+	}
+	if exists == 1 {
+		targets = append(targets, rowSet{"accesslog_mergetree", "PullZoneId = ?", []any{uint32(zoneId)}})
+	}
+
+	return targets, nil
+}
+
+func countRows(ctx context.Context, conn driver.Conn, rows rowSet) (uint64, error) {
+	var count uint64
+	err := conn.QueryRow(ctx, fmt.Sprintf("SELECT count() FROM %s WHERE %s", rows.table, rows.where), rows.args...).Scan(&count)
+	return count, err
+}
+
+// waits for the mutation to finish, so that once this returns the rows are
+// really gone (well, once the parts get merged, which clickhouse does itself)
+func deleteRows(ctx context.Context, conn driver.Conn, rows rowSet) error {
+	ctx = ch.Context(ctx, ch.WithSettings(ch.Settings{"mutations_sync": 1}))
+	return conn.Exec(ctx, fmt.Sprintf("ALTER TABLE %s DELETE WHERE %s", rows.table, rows.where), rows.args...)
+}
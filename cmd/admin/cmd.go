@@ -0,0 +1,168 @@
+package admin
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"ecstatic/client"
+	"ecstatic/util"
+
+	ch "github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+	"github.com/spf13/cobra"
+)
+
+var AdminCmd = &cobra.Command{
+	Use:   "admin",
+	Short: "admin - one-off and scheduled maintenance of the data in ClickHouse",
+}
+
+var PurgeZoneCmd = &cobra.Command{
+	Use:   "purge-zone [zone id]",
+	Short: "purge-zone - erases every log for a pull zone, e.g. when a customer leaves, and records that it did",
+	Long:  "purge-zone - erases every log for a pull zone, e.g. when a customer leaves, and records that it did in audit_log. Without --yes, only says how much it would delete",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+
+		zoneId, err := strconv.Atoi(args[0])
+		if err != nil || zoneId < 1 {
+			log.Fatalf("[ERROR] Zone ID must be a positive int, got %v", args[0])
+		}
+
+		if purgeActor == "" {
+			log.Fatalf("[ERROR] Could not tell who's asking, set --actor")
+		}
+
+		ctx := context.Background()
+		clickhouseConn := connect()
+		defer clickhouseConn.Close()
+
+		targets, err := purgeTargets(ctx, clickhouseConn, zoneId)
+		if err != nil {
+			log.Fatalf("[ERROR] Could not work out what to purge: %v", err)
+		}
+
+		counts := []string{}
+		for _, target := range targets {
+			count, err := countRows(ctx, clickhouseConn, target)
+			if err != nil {
+				log.Fatalf("[ERROR] Could not count rows to purge: %v", err)
+			}
+			log.Printf("[INFO] %v rows for zone %v in %v", count, zoneId, target.table)
+			counts = append(counts, fmt.Sprintf("%v: %v rows", target.table, count))
+		}
+
+		if !purgeYes {
+			log.Printf("[INFO] Nothing deleted, rerun with --yes to go through with it")
+			return
+		}
+
+		for _, target := range targets {
+			log.Printf("[INFO] Purging zone %v from %v...", zoneId, target.table)
+			err = deleteRows(ctx, clickhouseConn, target)
+			if err != nil {
+				// whatever did get deleted is gone, so that gets recorded too
+				auditErr := writeAudit(ctx, clickhouseConn, AuditRecord{"purge_zone", zoneId, purgeActor, AuditFailure, fmt.Sprintf("%v (before: %v)", err, strings.Join(counts, ", "))})
+				if auditErr != nil {
+					log.Printf("[ERROR] Could not write audit record either: %v", auditErr)
+				}
+				log.Fatalf("[ERROR] Could not purge zone %v from %v, safe to rerun: %v", zoneId, target.table, err)
+			}
+		}
+
+		err = writeAudit(ctx, clickhouseConn, AuditRecord{"purge_zone", zoneId, purgeActor, AuditSuccess, strings.Join(counts, ", ")})
+		if err != nil {
+			log.Fatalf("[ERROR] Purged zone %v, but could not write the audit record: %v", zoneId, err)
+		}
+
+		// those are files on whichever box intake runs on, nothing we can get at
+		log.Printf("[WARN] Dead letter files (DEADLETTER_DIR) and the spool may still have logs for zone %v, they have to be cleared by hand", zoneId)
+
+		log.Printf("[INFO] ALL DONE, zone %v purged", zoneId)
+	},
+}
+
+var RetentionCmd = &cobra.Command{
+	Use:   "retention",
+	Short: "retention - deletes logs older than each zone's retention, meant to run daily from cron",
+	Long:  "retention - deletes logs older than each zone's retention (retention_days on its site row in supabase, or RETENTION_DAYS when that's null or 0, and 0 there keeps them forever), meant to run daily from cron",
+	Run: func(cmd *cobra.Command, args []string) {
+
+		defaultDays, err := util.GetOptionalEnvInt("RETENTION_DAYS", 0)
+		if err != nil || defaultDays < 0 {
+			log.Fatalf("[ERROR] Could not parse RETENTION_DAYS: %v", err)
+		}
+
+		config, err := util.GetEnvConfigs([]string{"SUPABASE_URL", "SUPABASE_ANON_KEY", "SUPABASE_SERVICE_KEY"})
+		if err != nil {
+			log.Fatalf("[ERROR] Could not parse configs from environment: %v", err)
+		}
+
+		supabase := client.SupabaseAdminClient{
+			SupabaseUrl:        config["SUPABASE_URL"],
+			SupabaseAnonKey:    config["SUPABASE_ANON_KEY"],
+			SupabaseServiceKey: config["SUPABASE_SERVICE_KEY"],
+		}
+
+		// better to delete nothing than everything at the default
+		siteDays := supabase.ListRetentionDays(context.Background())
+		if siteDays == nil {
+			log.Fatalf("[ERROR] Could not get each site's retention from supabase, safe to rerun")
+		}
+
+		policy, err := NewRetentionPolicy(siteDays, defaultDays)
+		if err != nil {
+			log.Fatalf("[ERROR] Could not load retention policy: %v", err)
+		}
+
+		ctx := context.Background()
+		clickhouseConn := connect()
+		defer clickhouseConn.Close()
+
+		report, err := ApplyRetention(ctx, clickhouseConn, policy, retentionDryRun)
+		if err != nil {
+			log.Fatalf("[ERROR] Could not apply retention, safe to rerun: %v", err)
+		}
+
+		log.Printf("[INFO] ALL DONE, %v", report)
+	},
+}
+
+var purgeYes bool
+var purgeActor string
+var retentionDryRun bool
+
+func init() {
+	PurgeZoneCmd.Flags().BoolVar(&purgeYes, "yes", false, "actually delete, rather than just count")
+	PurgeZoneCmd.Flags().StringVar(&purgeActor, "actor", os.Getenv("USER"), "who asked for the purge, for the audit record")
+	RetentionCmd.Flags().BoolVar(&retentionDryRun, "dry-run", false, "only count what would be deleted")
+	AdminCmd.AddCommand(PurgeZoneCmd)
+	AdminCmd.AddCommand(RetentionCmd)
+}
+
+func connect() driver.Conn {
+
+	configNames := []string{
+		"CLICKHOUSE_URL",
+		"CLICKHOUSE_DATABASE",
+	}
+
+	config, err := util.GetEnvConfigs(configNames)
+	if err != nil {
+		log.Fatalf("[ERROR] Could not parse configs from environment: %v", err)
+	}
+
+	clickhouseConn, err := ch.Open(&ch.Options{
+		Addr: []string{config["CLICKHOUSE_URL"]},
+		Auth: ch.Auth{Database: config["CLICKHOUSE_DATABASE"]},
+	})
+	if err != nil {
+		log.Fatalf("[ERROR] Could not create clickhouse connection: %v\n", err)
+	}
+
+	return clickhouseConn
+}
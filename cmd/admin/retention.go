@@ -0,0 +1,146 @@
+package admin
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+)
+
+// RetentionPolicy is how many days of logs to keep, per zone where the site
+// says so, and otherwise the default. 0 keeps them forever
+type RetentionPolicy struct {
+	DefaultDays int
+	ZoneDays    map[int]int
+}
+
+// NewRetentionPolicy takes each site's retention_days (see ListRetentionDays),
+// 0 there meaning the default, same as no value at all
+func NewRetentionPolicy(siteDays map[int]int, defaultDays int) (RetentionPolicy, error) {
+
+	policy := RetentionPolicy{DefaultDays: defaultDays, ZoneDays: map[int]int{}}
+	for zoneId, days := range siteDays {
+		if days < 0 {
+			return RetentionPolicy{}, fmt.Errorf("Zone %v has negative retention_days %v", zoneId, days)
+		}
+		if days > 0 {
+			policy.ZoneDays[zoneId] = days
+		}
+	}
+
+	return policy, nil
+}
+
+// Expired is the rows of accesslog the policy says to delete as of now, one
+// set per zone with its own retention, then one for everybody else. The
+// rollups are left alone, long range charts being what they're for
+func (p RetentionPolicy) Expired(now time.Time) []rowSet {
+
+	cutoff := func(days int) time.Time {
+		return now.AddDate(0, 0, -days)
+	}
+
+	zoneIds := []int{}
+	for zoneId := range p.ZoneDays {
+		zoneIds = append(zoneIds, zoneId)
+	}
+	sort.Ints(zoneIds)
+
+	expired := []rowSet{}
+	others := []string{}
+	for _, zoneId := range zoneIds {
+		expired = append(expired, rowSet{"accesslog", "PullZoneId = ? AND Timestamp < ?", []any{uint32(zoneId), cutoff(p.ZoneDays[zoneId])}})
+		others = append(others, fmt.Sprint(zoneId))
+	}
+
+	if p.DefaultDays > 0 {
+		where := "Timestamp < ?"
+		if len(others) > 0 {
+			// only ever ints, so fine to write out
+			where = fmt.Sprintf("PullZoneId NOT IN (%s) AND %s", strings.Join(others, ", "), where)
+		}
+		expired = append(expired, rowSet{"accesslog", where, []any{cutoff(p.DefaultDays)}})
+	}
+
+	return expired
+}
+
+// ApplyRetention deletes whatever the policy says has expired, writing an
+// audit record per zone that lost anything. Counts per zone first, so the
+// record says how much went, and so nothing runs a mutation for no rows
+func ApplyRetention(ctx context.Context, conn driver.Conn, policy RetentionPolicy, dryRun bool) (string, error) {
+
+	deleted := uint64(0)
+
+	for _, expired := range policy.Expired(time.Now()) {
+
+		counts, err := countByZone(ctx, conn, expired)
+		if err != nil {
+			return "", fmt.Errorf("Could not count expired rows: %w", err)
+		}
+
+		total := uint64(0)
+		for zoneId, count := range counts {
+			log.Printf("[INFO] %v expired rows for zone %v", count, zoneId)
+			total += count
+		}
+
+		if total == 0 || dryRun {
+			continue
+		}
+
+		err = deleteRows(ctx, conn, expired)
+
+		result := AuditSuccess
+		if err != nil {
+			result = AuditFailure
+		}
+
+		for zoneId, count := range counts {
+			detail := fmt.Sprintf("accesslog: %v rows", count)
+			if err != nil {
+				detail = fmt.Sprintf("%v (before: %v)", err, detail)
+			}
+			auditErr := writeAudit(ctx, conn, AuditRecord{"retention", zoneId, "retention", result, detail})
+			if auditErr != nil {
+				log.Printf("[ERROR] Could not write audit record for zone %v: %v", zoneId, auditErr)
+			}
+		}
+
+		if err != nil {
+			return "", fmt.Errorf("Could not delete expired rows: %w", err)
+		}
+
+		deleted += total
+	}
+
+	if dryRun {
+		return "nothing deleted (dry run)", nil
+	}
+
+	return fmt.Sprintf("%v expired rows deleted", deleted), nil
+}
+
+func countByZone(ctx context.Context, conn driver.Conn, rows rowSet) (map[int]uint64, error) {
+
+	var results []struct {
+		PullZoneId uint32
+		Count      uint64
+	}
+
+	err := conn.Select(ctx, &results, fmt.Sprintf("SELECT PullZoneId, count() AS Count FROM %s WHERE %s GROUP BY PullZoneId", rows.table, rows.where), rows.args...)
+	if err != nil {
+		return nil, err
+	}
+
+	counts := map[int]uint64{}
+	for _, result := range results {
+		counts[int(result.PullZoneId)] = result.Count
+	}
+
+	return counts, nil
+}
@@ -0,0 +1,45 @@
+package admin
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetentionExpired(t *testing.T) {
+
+	now := time.Date(2024, 3, 31, 12, 0, 0, 0, time.UTC)
+
+	// keep forever
+	assert.Empty(t, RetentionPolicy{ZoneDays: map[int]int{}}.Expired(now))
+
+	// only the default
+	expired := RetentionPolicy{DefaultDays: 30, ZoneDays: map[int]int{}}.Expired(now)
+	assert.Len(t, expired, 1)
+	assert.Equal(t, "Timestamp < ?", expired[0].where)
+	assert.Equal(t, []any{now.AddDate(0, 0, -30)}, expired[0].args)
+
+	// zones with their own, which the default then leaves alone
+	expired = RetentionPolicy{DefaultDays: 30, ZoneDays: map[int]int{42: 7, 7: 365}}.Expired(now)
+	assert.Len(t, expired, 3)
+	assert.Equal(t, "PullZoneId = ? AND Timestamp < ?", expired[0].where)
+	assert.Equal(t, []any{uint32(7), now.AddDate(0, 0, -365)}, expired[0].args)
+	assert.Equal(t, []any{uint32(42), now.AddDate(0, 0, -7)}, expired[1].args)
+	assert.Equal(t, "PullZoneId NOT IN (7, 42) AND Timestamp < ?", expired[2].where)
+
+	// zones with their own, and nothing for the rest
+	expired = RetentionPolicy{ZoneDays: map[int]int{42: 7}}.Expired(now)
+	assert.Len(t, expired, 1)
+}
+
+func TestNewRetentionPolicy(t *testing.T) {
+
+	// 0 on the site is the same as nothing there
+	policy, err := NewRetentionPolicy(map[int]int{42: 7, 7: 0}, 30)
+	assert.NoError(t, err)
+	assert.Equal(t, RetentionPolicy{DefaultDays: 30, ZoneDays: map[int]int{42: 7}}, policy)
+
+	_, err = NewRetentionPolicy(map[int]int{42: -1}, 30)
+	assert.Error(t, err)
+}
@@ -94,7 +94,7 @@ func (m Middlewarer) CreateGitHookMiddleware() func(http.Handler) http.Handler {
 				return
 			}
 
-			log.Printf("site ID found for repo %s, config %s", repoName, row)
+			log.Printf("site ID found for repo %s, config %+v", repoName, row)
 
 			hookValues := HookValues{
 				SiteId:       repoName,
@@ -0,0 +1,183 @@
+package intake
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// why a log was marked as a bot, stored as BotReason, "" for humans
+const (
+	// the user agent says so (or gives it away), from isbot
+	BotUserAgent = "user_agent"
+	// the IP is in a known datacenter or crawler range, from isbot
+	BotIpRange = "ip_range"
+	// the visitor asked for /robots.txt, which browsers never do
+	BotRobotsTxt = "robots_txt"
+	// the visitor went looking for wordpress, php, .env files and the like, on a
+	// site that's all static files
+	BotProbePath = "probe_path"
+	// the visitor made more requests than a person clicking around could
+	BotRate = "rate"
+	// the visitor loaded page after page, never with a referrer, and never once
+	// any of the css, js, images, or fonts a browser would have
+	BotNoAssets = "no_assets"
+)
+
+// visitors we haven't seen for this long are forgotten
+const botSessionTimeout = 30 * time.Minute
+
+// forgetting is done every so many logs rather than on a timer, so that replays
+// (going by log time, not wall time) behave the same as live logs
+const botSweepEvery = 10000
+
+// BotPolicy is how suspicious a visitor has to get, zero to skip that check
+type BotPolicy struct {
+	// more than this many requests within the window is a bot
+	MaxRequests int
+	Window      time.Duration
+	// this many pages without a referrer or any assets is a bot
+	AssetlessPages int
+}
+
+// BotScorer keeps track of what each visitor has been up to recently, going by
+// VisitorId, so visitors without one (too old for a salt) only get the checks
+// that don't need any history. Once a visitor is marked as a bot, the rest of
+// its session is too, but whatever was logged before that is left as it was
+type BotScorer struct {
+	policy BotPolicy
+
+	mutex    sync.Mutex
+	sessions map[uint64]*botSession
+	latest   int64 // newest log seen, epoch ms
+	scored   int
+}
+
+type botSession struct {
+	hits     []int64 // epoch ms, only those within the window
+	pages    int
+	assets   int
+	referred int
+	reason   string
+	lastSeen int64
+}
+
+func NewBotScorer(policy BotPolicy) *BotScorer {
+	return &BotScorer{policy: policy, sessions: map[uint64]*botSession{}}
+}
+
+// Score returns why the log is from a bot, "" if as far as we can tell it isn't
+func (b *BotScorer) Score(record LogRecord, visitorId uint64, fileType string) string {
+
+	reason := KnownBot(record)
+
+	if reason == "" {
+		reason = suspiciousPath(record.PathAndQuery)
+	}
+
+	if b == nil || visitorId == 0 {
+		return reason
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.sweep(record.Timestamp)
+
+	session, ok := b.sessions[visitorId]
+	if !ok {
+		session = &botSession{}
+		b.sessions[visitorId] = session
+	}
+
+	session.lastSeen = max(session.lastSeen, record.Timestamp)
+
+	if session.reason != "" {
+		return session.reason
+	}
+
+	if reason != "" {
+		session.reason = reason
+		return reason
+	}
+
+	if b.policy.MaxRequests > 0 && b.policy.Window > 0 {
+		// logs can turn up a little out of order, so filter rather than trim
+		since := record.Timestamp - b.policy.Window.Milliseconds()
+		hits := session.hits[:0]
+		for _, hit := range session.hits {
+			if hit > since {
+				hits = append(hits, hit)
+			}
+		}
+		session.hits = append(hits, record.Timestamp)
+
+		if len(session.hits) > b.policy.MaxRequests {
+			session.reason = BotRate
+			session.hits = nil
+			return BotRate
+		}
+	}
+
+	switch fileType {
+	case "Page":
+		session.pages++
+		if record.Referer != "" && record.Referer != "-" {
+			session.referred++
+		}
+	case "Stylesheet", "Javascript", "Image", "Font":
+		session.assets++
+	}
+
+	if b.policy.AssetlessPages > 0 && session.pages >= b.policy.AssetlessPages && session.assets == 0 && session.referred == 0 {
+		session.reason = BotNoAssets
+		return BotNoAssets
+	}
+
+	return ""
+}
+
+// must hold the mutex
+func (b *BotScorer) sweep(timestamp int64) {
+
+	b.latest = max(b.latest, timestamp)
+	b.scored++
+
+	if b.scored%botSweepEvery != 0 {
+		return
+	}
+
+	cutoff := b.latest - botSessionTimeout.Milliseconds()
+	for visitorId, session := range b.sessions {
+		if session.lastSeen < cutoff {
+			delete(b.sessions, visitorId)
+		}
+	}
+}
+
+// paths that scanners try everywhere, and that no real site (even a dynamic
+// one, since some origins aren't bunny) sends visitors to. Not every .php, since
+// a PHP site's pages are exactly that
+var probePathPrefixes = []string{
+	"/wp-admin", "/wp-login.php", "/xmlrpc.php", "/phpinfo.php",
+	"/.env", "/.git/", "/.aws/", "/.ssh/", "/phpmyadmin", "/pma/", "/cgi-bin/",
+	"/vendor/phpunit", "/actuator", "/boaform", "/owa/", "/admin/config",
+}
+
+func suspiciousPath(pathAndQuery string) string {
+
+	path, _, _ := strings.Cut(pathAndQuery, "?")
+	path = strings.ToLower(path)
+
+	if path == "/robots.txt" {
+		return BotRobotsTxt
+	}
+
+	for _, prefix := range probePathPrefixes {
+		if strings.HasPrefix(path, prefix) {
+			return BotProbePath
+		}
+	}
+
+	return ""
+}
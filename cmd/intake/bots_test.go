@@ -0,0 +1,72 @@
+package intake
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const chromeUa = "Mozilla/5.0 (Windows NT 10.0) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36"
+
+func botRecord(path string, timestamp int64, referer string) LogRecord {
+	return LogRecord{PullZoneId: 1234, Timestamp: timestamp, PathAndQuery: path, UserAgent: chromeUa, RemoteIp: "163.172.53.0", Referer: referer}
+}
+
+func TestBotPaths(t *testing.T) {
+
+	bots := NewBotScorer(BotPolicy{})
+
+	assert.Equal(t, "", bots.Score(botRecord("/", 0, ""), 1, "Page"))
+	assert.Equal(t, BotRobotsTxt, bots.Score(botRecord("/robots.txt", 0, ""), 1, "Document"))
+	// and everything after, for the rest of the session
+	assert.Equal(t, BotRobotsTxt, bots.Score(botRecord("/about/", 0, ""), 1, "Page"))
+
+	assert.Equal(t, BotProbePath, bots.Score(botRecord("/WP-Admin/setup-config.php", 0, ""), 2, "Page"))
+	assert.Equal(t, BotProbePath, bots.Score(botRecord("/.env", 0, ""), 0, "Unknown"))
+	assert.Equal(t, "", bots.Score(botRecord("/blog/wp-is-great/", 0, ""), 3, "Page"))
+	assert.Equal(t, BotProbePath, bots.Score(botRecord("/xmlrpc.php", 0, ""), 5, "Unknown"))
+
+	// a PHP site's pages are just pages
+	assert.Equal(t, "", bots.Score(botRecord("/index.php", 0, ""), 6, "Page"))
+	assert.Equal(t, "", bots.Score(botRecord("/shop/cart.php?item=3", 0, ""), 6, "Page"))
+	assert.Equal(t, "", bots.Score(botRecord("/wp-content/themes/site/style.css", 0, ""), 6, "Stylesheet"))
+
+	assert.Equal(t, BotUserAgent, bots.Score(LogRecord{UserAgent: "curl/8.0"}, 4, "Page"))
+}
+
+func TestBotRate(t *testing.T) {
+
+	bots := NewBotScorer(BotPolicy{MaxRequests: 3, Window: time.Second})
+
+	// spread out is fine
+	for n := int64(0); n < 10; n++ {
+		assert.Equal(t, "", bots.Score(botRecord("/", n*500, ""), 1, "Image"))
+	}
+
+	// all at once is not
+	for n := int64(0); n < 3; n++ {
+		assert.Equal(t, "", bots.Score(botRecord("/", 100000+n, ""), 2, "Image"))
+	}
+	assert.Equal(t, BotRate, bots.Score(botRecord("/", 100003, ""), 2, "Image"))
+}
+
+func TestBotNoAssets(t *testing.T) {
+
+	bots := NewBotScorer(BotPolicy{AssetlessPages: 3})
+
+	assert.Equal(t, "", bots.Score(botRecord("/", 0, ""), 1, "Page"))
+	assert.Equal(t, "", bots.Score(botRecord("/a/", 0, ""), 1, "Page"))
+	assert.Equal(t, BotNoAssets, bots.Score(botRecord("/b/", 0, ""), 1, "Page"))
+
+	// a browser would have loaded the css
+	assert.Equal(t, "", bots.Score(botRecord("/", 0, ""), 2, "Page"))
+	assert.Equal(t, "", bots.Score(botRecord("/style.css", 0, ""), 2, "Stylesheet"))
+	assert.Equal(t, "", bots.Score(botRecord("/a/", 0, ""), 2, "Page"))
+	assert.Equal(t, "", bots.Score(botRecord("/b/", 0, ""), 2, "Page"))
+
+	// no history without a visitor
+	for n := 0; n < 5; n++ {
+		assert.Equal(t, "", bots.Score(botRecord("/", 0, ""), 0, "Page"))
+	}
+}
@@ -0,0 +1,101 @@
+package intake
+
+import (
+	"fmt"
+)
+
+const (
+	OverflowBlock      = "block"
+	OverflowDropOldest = "drop-oldest"
+	OverflowSpill      = "spill"
+)
+
+// below should be const, but golang knows better
+var VALIDOVERFLOWS = []string{OverflowBlock, OverflowDropOldest, OverflowSpill}
+
+// MessageBuffer sits between the listeners and the workers, and decides what
+// happens when messages come in faster than we can deal with them: make the
+// listener wait (block), throw away the oldest queued message (drop-oldest),
+// or enrich the new message right away and write it to disk (spill)
+type MessageBuffer struct {
+	messages chan SyslogMessage
+	overflow string
+	spill    func(SyslogMessage)
+}
+
+func NewMessageBuffer(size int, overflow string, spill func(SyslogMessage)) (*MessageBuffer, error) {
+
+	if size < 1 {
+		return nil, fmt.Errorf("Buffer size must be at least 1, got %v", size)
+	}
+
+	switch overflow {
+	case OverflowBlock, OverflowDropOldest, OverflowSpill:
+	default:
+		return nil, fmt.Errorf("Invalid overflow policy %s (try one of %v)", overflow, VALIDOVERFLOWS)
+	}
+
+	return &MessageBuffer{make(chan SyslogMessage, size), overflow, spill}, nil
+}
+
+// TryPushAll is for senders that can retry, so rather than the overflow policy,
+// they get told no (false) if there isn't room for every one of the messages.
+// Other senders can take the room in the meantime, so if that happens partway
+// through, the rest go in with Push, since by then it's too late to say no
+func (b *MessageBuffer) TryPushAll(messages []SyslogMessage) bool {
+
+	if cap(b.messages)-len(b.messages) < len(messages) {
+		bufferOverflows.WithLabelValues("rejected").Inc()
+		return false
+	}
+
+	for _, message := range messages {
+		select {
+		case b.messages <- message:
+		default:
+			b.Push(message)
+		}
+	}
+
+	bufferDepth.Set(float64(len(b.messages)))
+
+	return true
+}
+
+// Push queues a message, applying the overflow policy if the buffer is full
+func (b *MessageBuffer) Push(message SyslogMessage) {
+
+	// the happy path, there's room
+	select {
+	case b.messages <- message:
+		bufferDepth.Set(float64(len(b.messages)))
+		return
+	default:
+	}
+
+	switch b.overflow {
+
+	case OverflowBlock:
+		bufferOverflows.WithLabelValues(OverflowBlock).Inc()
+		b.messages <- message
+
+	case OverflowDropOldest:
+		for {
+			select {
+			case b.messages <- message:
+				return
+			default:
+			}
+			// make room, unless a worker beat us to it
+			select {
+			case <-b.messages:
+				bufferOverflows.WithLabelValues(OverflowDropOldest).Inc()
+			default:
+			}
+		}
+
+	case OverflowSpill:
+		bufferOverflows.WithLabelValues(OverflowSpill).Inc()
+		b.spill(message)
+	}
+}
@@ -0,0 +1,110 @@
+package intake
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBufferOverflow(t *testing.T) {
+
+	cases := []struct {
+		overflow string
+		// what's left in the buffer, and what got spilled, once 1, 2, 3 went into
+		// a buffer with room for 2
+		queued  []string
+		spilled []string
+	}{
+		{OverflowDropOldest, []string{"2", "3"}, nil},
+		{OverflowSpill, []string{"1", "2"}, []string{"3"}},
+	}
+
+	for _, c := range cases {
+
+		spilled := []string{}
+		buffer, err := NewMessageBuffer(2, c.overflow, func(message SyslogMessage) {
+			spilled = append(spilled, message.MsgId)
+		})
+		assert.Nil(t, err)
+
+		for _, id := range []string{"1", "2", "3"} {
+			buffer.Push(SyslogMessage{MsgId: id})
+		}
+
+		assert.Equal(t, c.queued, drain(buffer), c.overflow)
+		if c.spilled == nil {
+			assert.Empty(t, spilled, c.overflow)
+		} else {
+			assert.Equal(t, c.spilled, spilled, c.overflow)
+		}
+	}
+}
+
+func TestBufferOverflowBlock(t *testing.T) {
+
+	buffer, err := NewMessageBuffer(2, OverflowBlock, nil)
+	assert.Nil(t, err)
+
+	buffer.Push(SyslogMessage{MsgId: "1"})
+	buffer.Push(SyslogMessage{MsgId: "2"})
+
+	pushed := make(chan struct{})
+	go func() {
+		buffer.Push(SyslogMessage{MsgId: "3"})
+		close(pushed)
+	}()
+
+	// waits for room
+	select {
+	case <-pushed:
+		t.Fatal("Push into a full buffer did not block")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	assert.Equal(t, "1", (<-buffer.messages).MsgId)
+
+	select {
+	case <-pushed:
+	case <-time.After(time.Second):
+		t.Fatal("Push did not finish once there was room")
+	}
+
+	assert.Equal(t, []string{"2", "3"}, drain(buffer))
+}
+
+func TestBufferTryPushAll(t *testing.T) {
+
+	// every policy, since TryPushAll never applies one
+	for _, overflow := range VALIDOVERFLOWS {
+
+		buffer, err := NewMessageBuffer(3, overflow, func(message SyslogMessage) {
+			t.Errorf("%v: spilled %v", overflow, message.MsgId)
+		})
+		assert.Nil(t, err)
+
+		buffer.Push(SyslogMessage{MsgId: "1"})
+
+		// two more fit, three don't, and then none of them go in
+		assert.False(t, buffer.TryPushAll([]SyslogMessage{{MsgId: "2"}, {MsgId: "3"}, {MsgId: "4"}}), overflow)
+		assert.Equal(t, 1, len(buffer.messages), overflow)
+
+		assert.True(t, buffer.TryPushAll([]SyslogMessage{{MsgId: "2"}, {MsgId: "3"}}), overflow)
+
+		// full, so not even one
+		assert.False(t, buffer.TryPushAll([]SyslogMessage{{MsgId: "4"}}), overflow)
+
+		// and nothing is no trouble
+		assert.True(t, buffer.TryPushAll(nil), overflow)
+
+		assert.Equal(t, []string{"1", "2", "3"}, drain(buffer), overflow)
+	}
+}
+
+func drain(buffer *MessageBuffer) []string {
+	ids := []string{}
+	for len(buffer.messages) > 0 {
+		ids = append(ids, (<-buffer.messages).MsgId)
+	}
+	return ids
+}
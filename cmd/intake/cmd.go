@@ -2,22 +2,36 @@ package intake
 
 import (
 	"context"
+	"crypto/tls"
+	"fmt"
 	"log"
 	"math/rand"
+	"net/http"
 	"os"
 	"os/signal"
+	"runtime"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
+	"ecstatic/client"
+	"ecstatic/schema"
 	"ecstatic/util"
 
 	ch "github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/go-chi/cors"
+	"github.com/go-chi/jwtauth/v5"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/spf13/cobra"
 )
 
 var IntakeCmd = &cobra.Command{
 	Use:   "intake",
-	Short: "intake - starts listenting for TCP syslog messages on a port",
+	Short: "intake - starts listenting for syslog messages over TCP, TLS, and/or UDP, and/or for batches pushed over HTTP",
 	Run: func(cmd *cobra.Command, args []string) {
 
 		log.Printf("[INFO] Starting up...")
@@ -47,7 +61,6 @@ var IntakeCmd = &cobra.Command{
 
 		configNames := []string{
 			"METRICS_LISTENER_PORT",
-			"SYSLOG_LISTENER_PORT",
 			"CLICKHOUSE_URL",
 			"CLICKHOUSE_DATABASE",
 		}
@@ -57,20 +70,15 @@ var IntakeCmd = &cobra.Command{
 			log.Fatalf("[ERROR] Could not parse configs from environment: %v", err)
 		}
 
-		// ------------------------------------------------------------------------
-
-		log.Printf("[INFO] Starting TCP on %v...", config["SYSLOG_LISTENER_PORT"])
-
-		// buffer for the messages from intake port, no max size I think
-		msgChan := make(chan []byte)
-
-		listen := Listener{port: config["SYSLOG_LISTENER_PORT"], msgChan: msgChan}
-
-		go listen.Listen()
+		// how long we get, from the signal, to drain and flush everything in flight
+		shutdownTimeout, err := util.GetOptionalEnvDuration("SHUTDOWN_TIMEOUT", 30*time.Second)
+		if err != nil {
+			log.Fatalf("[ERROR] Could not parse SHUTDOWN_TIMEOUT: %v", err)
+		}
 
 		// ------------------------------------------------------------------------
 
-		log.Printf("[INFO] Creating ClickHouse DB connection and consumer...")
+		log.Printf("[INFO] Creating ClickHouse DB connection...")
 
 		clickhouseConn, err := ch.Open(&ch.Options{
 			Addr: []string{config["CLICKHOUSE_URL"]},
@@ -80,9 +88,256 @@ var IntakeCmd = &cobra.Command{
 			log.Fatalf("[ERROR] Could not create clickhouse connection: %v\n", err)
 		}
 
-		intaker := Intaker{msgChan, clickhouseConn}
+		// ------------------------------------------------------------------------
+
+		log.Printf("[INFO] Checking ClickHouse schema is up to date...")
+
+		pending, err := schema.Pending(ctx, clickhouseConn)
+		if err != nil {
+			// clickhouse being down is what the spool is for, so don't let it stop us
+			log.Printf("[WARN] Could not check schema, carrying on and hoping for the best: %v", err)
+		} else if len(pending) > 0 {
+			log.Fatalf("[ERROR] Schema is %v migrations behind (next up is %v), run 'ecstatic migrate up' first", len(pending), pending[0].Name)
+		}
+
+		// ------------------------------------------------------------------------
+
+		log.Printf("[INFO] Opening spool for rows that haven't made it to ClickHouse...")
+
+		spoolDir := util.GetOptionalEnvConfig("SPOOL_DIR", "/var/spool/ecstatic")
+
+		// default of 1GiB, which at a few hundred bytes a row is millions of rows
+		spoolMaxBytes, err := strconv.ParseInt(util.GetOptionalEnvConfig("SPOOL_MAX_BYTES", "1073741824"), 10, 64)
+		if err != nil {
+			log.Fatalf("[ERROR] Could not parse SPOOL_MAX_BYTES: %v", err)
+		}
+
+		spool, err := OpenSpool(spoolDir, spoolMaxBytes)
+		if err != nil {
+			log.Fatalf("[ERROR] Could not open spool: %v", err)
+		}
+
+		// ------------------------------------------------------------------------
+
+		log.Printf("[INFO] Opening dead letter sink for logs we can't use...")
+
+		deadLetters, err := deadLetterSinkFromEnv(clickhouseConn)
+		if err != nil {
+			log.Fatalf("[ERROR] Could not open dead letter sink: %v", err)
+		}
+
+		// ------------------------------------------------------------------------
+
+		log.Printf("[INFO] Creating buffer and consumer...")
+
+		maxRows, err := util.GetOptionalEnvInt("BATCH_MAX_ROWS", 10000)
+		if err != nil {
+			log.Fatalf("[ERROR] Could not parse batch policy: %v", err)
+		}
+
+		maxBytes, err := util.GetOptionalEnvInt("BATCH_MAX_BYTES", 8*1024*1024)
+		if err != nil {
+			log.Fatalf("[ERROR] Could not parse batch policy: %v", err)
+		}
+
+		maxAge, err := util.GetOptionalEnvDuration("BATCH_MAX_AGE", 2*time.Second)
+		if err != nil {
+			log.Fatalf("[ERROR] Could not parse batch policy: %v", err)
+		}
+
+		workers, err := util.GetOptionalEnvInt("INTAKE_WORKERS", runtime.NumCPU())
+		if err != nil {
+			log.Fatalf("[ERROR] Could not parse INTAKE_WORKERS: %v", err)
+		}
+
+		bufferSize, err := util.GetOptionalEnvInt("BUFFER_SIZE", 10000)
+		if err != nil {
+			log.Fatalf("[ERROR] Could not parse BUFFER_SIZE: %v", err)
+		}
+
+		if maxRows < 1 || maxBytes < 1 || maxAge <= 0 || workers < 1 {
+			log.Fatalf("[ERROR] Batch policy and worker count must all be positive")
+		}
+
+		enricher, err := enricherFromEnv(ctx, clickhouseConn)
+		if err != nil {
+			log.Fatalf("[ERROR] Could not set up enrichment: %v", err)
+		}
+
+		senders, err := senderValidatorFromEnv(ctx)
+		if err != nil {
+			log.Fatalf("[ERROR] Could not set up sender validation: %v", err)
+		}
 
-		go intaker.Consume(ctx)
+		// pageviews for the live view, straight from here rather than clickhouse
+		live := NewLiveHub()
+		go live.Watch(ctx)
+
+		// how many recent request IDs to remember, 0 for none
+		dedupeWindow, err := util.GetOptionalEnvInt("DEDUPE_WINDOW", 100000)
+		if err != nil || dedupeWindow < 0 {
+			log.Fatalf("[ERROR] Could not parse DEDUPE_WINDOW: %v", err)
+		}
+
+		intaker := Intaker{
+			clickConn: clickhouseConn,
+			spool:     spool,
+			policy:    BatchPolicy{maxRows, maxBytes, maxAge},
+			workers:   workers,
+			enricher:  enricher,
+			senders:   senders,
+			live:      live,
+
+			requestIds: NewRequestIdWindow(dedupeWindow),
+
+			deadLetters: deadLetters,
+		}
+
+		// what to do when messages come in faster than the workers can keep up
+		overflow := util.GetOptionalEnvConfig("BUFFER_OVERFLOW", OverflowBlock)
+
+		// buffer for the messages from all intake ports
+		buffer, err := NewMessageBuffer(bufferSize, overflow, intaker.Spill)
+		if err != nil {
+			log.Fatalf("[ERROR] Could not create message buffer: %v", err)
+		}
+
+		stop := make(chan struct{})
+		drained := make(chan DrainReport, 1)
+
+		go func() {
+			drained <- intaker.Consume(ctx, buffer, stop)
+		}()
+
+		replayCtx, stopReplay := context.WithCancel(ctx)
+		defer stopReplay()
+
+		go intaker.Replay(replayCtx)
+
+		// ------------------------------------------------------------------------
+
+		log.Printf("[INFO] Starting syslog listeners...")
+
+		// any combination of these can run at once, so zones can be moved from one
+		// transport to another without downtime, but we need at least one
+		tcpPort := util.GetOptionalEnvConfig("SYSLOG_LISTENER_PORT", "")
+		tlsPort := util.GetOptionalEnvConfig("SYSLOG_TLS_LISTENER_PORT", "")
+		udpPort := util.GetOptionalEnvConfig("SYSLOG_UDP_LISTENER_PORT", "")
+		pushPort := util.GetOptionalEnvConfig("PUSH_LISTENER_PORT", "")
+
+		if tcpPort == "" && tlsPort == "" && udpPort == "" && pushPort == "" {
+			log.Fatalf("[ERROR] No listeners configured, set at least one of SYSLOG_LISTENER_PORT, SYSLOG_TLS_LISTENER_PORT, SYSLOG_UDP_LISTENER_PORT, PUSH_LISTENER_PORT")
+		}
+
+		listeners := []Shutdowner{}
+
+		if tcpPort != "" {
+			log.Printf("[INFO] Starting TCP on %v...", tcpPort)
+			listen := &Listener{port: tcpPort, buffer: buffer, decoder: decoderFromEnv("SYSLOG"), allowlist: allowlistFromEnv(ctx, "SYSLOG")}
+			listeners = append(listeners, listen)
+			go listen.Listen()
+		}
+
+		if tlsPort != "" {
+			log.Printf("[INFO] Starting TLS on %v...", tlsPort)
+
+			tlsConfigNames := []string{
+				"SYSLOG_TLS_CERT_PATH",
+				"SYSLOG_TLS_KEY_PATH",
+			}
+
+			tlsPaths, err := util.GetEnvConfigs(tlsConfigNames)
+			if err != nil {
+				log.Fatalf("[ERROR] Could not parse TLS configs from environment: %v", err)
+			}
+
+			// optional, if set then senders need a client cert signed by this CA
+			clientCaPath := util.GetOptionalEnvConfig("SYSLOG_TLS_CLIENT_CA_PATH", "")
+
+			tlsConfig, err := LoadTlsConfig(tlsPaths["SYSLOG_TLS_CERT_PATH"], tlsPaths["SYSLOG_TLS_KEY_PATH"], clientCaPath)
+			if err != nil {
+				log.Fatalf("[ERROR] Could not set up TLS: %v", err)
+			}
+
+			listen := &Listener{port: tlsPort, buffer: buffer, tlsConfig: tlsConfig, decoder: decoderFromEnv("SYSLOG_TLS"), allowlist: allowlistFromEnv(ctx, "SYSLOG_TLS")}
+			listeners = append(listeners, listen)
+			go listen.Listen()
+		}
+
+		if udpPort != "" {
+			log.Printf("[INFO] Starting UDP on %v...", udpPort)
+			listen := &UdpListener{port: udpPort, buffer: buffer, decoder: decoderFromEnv("SYSLOG_UDP"), allowlist: allowlistFromEnv(ctx, "SYSLOG_UDP")}
+			listeners = append(listeners, listen)
+			go listen.Listen()
+		}
+
+		if pushPort != "" {
+			log.Printf("[INFO] Starting HTTP push on %v...", pushPort)
+
+			tokensPath, err := util.GetEnvConfigs([]string{"PUSH_TOKENS_PATH"})
+			if err != nil {
+				log.Fatalf("[ERROR] Could not parse push configs from environment: %v", err)
+			}
+
+			decoders, err := LoadPushTokens(tokensPath["PUSH_TOKENS_PATH"])
+			if err != nil {
+				log.Fatalf("[ERROR] Could not load push tokens: %v", err)
+			}
+
+			// optional, but bearer tokens in the clear are only fine behind a proxy
+			var tlsConfig *tls.Config
+			certPath := util.GetOptionalEnvConfig("PUSH_TLS_CERT_PATH", "")
+			keyPath := util.GetOptionalEnvConfig("PUSH_TLS_KEY_PATH", "")
+			if certPath != "" || keyPath != "" {
+				tlsConfig, err = LoadTlsConfig(certPath, keyPath, "")
+				if err != nil {
+					log.Fatalf("[ERROR] Could not set up push TLS: %v", err)
+				}
+			}
+
+			push := NewPushServer(pushPort, buffer, decoders, tlsConfig)
+			listeners = append(listeners, push)
+			go push.Listen()
+		}
+
+		// ------------------------------------------------------------------------
+
+		log.Printf("[INFO] Starting metrics server on %v...", config["METRICS_LISTENER_PORT"])
+
+		metrics := http.Server{
+			Addr:    fmt.Sprintf(":%v", config["METRICS_LISTENER_PORT"]),
+			Handler: promhttp.Handler(),
+		}
+
+		go func() {
+			err := metrics.ListenAndServe()
+			if err != nil && err != http.ErrServerClosed {
+				log.Fatalf("[ERROR] Metrics server could not start: %v", err)
+			}
+		}()
+
+		// ------------------------------------------------------------------------
+
+		// optional, the live view needs the hub, so it can only be served from here
+		var liveServer *http.Server
+
+		livePort := util.GetOptionalEnvConfig("LIVE_LISTENER_PORT", "")
+		if livePort != "" {
+			log.Printf("[INFO] Starting live stream server on %v...", livePort)
+
+			liveServer = liveServerFromEnv(livePort, live)
+
+			// the streams never end on their own, so end them, or shutdown would
+			// have to wait for every last viewer to close their tab
+			liveServer.RegisterOnShutdown(live.Close)
+
+			go func() {
+				err := liveServer.ListenAndServe()
+				if err != nil && err != http.ErrServerClosed {
+					log.Fatalf("[ERROR] Live stream server could not start: %v", err)
+				}
+			}()
+		}
 
 		// ------------------------------------------------------------------------
 
@@ -92,24 +347,294 @@ var IntakeCmd = &cobra.Command{
 
 		log.Printf("[INFO] Got signal to die, cleaning up...")
 
-		// todo, proper cleanup, set deadline for TCP listener, close CH conn
+		deadline := time.Now().Add(shutdownTimeout)
 
-		// err = server.Kill()
-		// if err != nil {
-		// 	log.Fatalf("Could not kill running intak listener: %v", err)
-		// }
+		// stop taking in anything new, and let the readers hand off what they've got
+		for _, listener := range listeners {
+			err = listener.Shutdown(deadline)
+			if err != nil {
+				log.Printf("[ERROR] Could not cleanly shut down listener: %v", err)
+			}
+		}
 
-		log.Printf("[INFO] INTAKE LISTENER KILLED, SLEEPING FOR 1 SECOND")
+		if liveServer != nil {
+			liveCtx, cancelLive := context.WithDeadline(ctx, deadline)
+			err = liveServer.Shutdown(liveCtx)
+			cancelLive()
+			if err != nil {
+				log.Printf("[ERROR] Could not cleanly shut down live stream server: %v", err)
+			}
+		}
 
-		// terrible? Yes, but I can figure out how to actually make sure the parser
-		// channel is empty later, here 1s is more than enough
-		// time.Sleep(1 * time.Second)
+		log.Printf("[INFO] Listeners stopped, draining and flushing final batch...")
+
+		// replay can pick back up from the spool next time
+		stopReplay()
+
+		close(stop)
+
+		select {
+		case report := <-drained:
+			log.Printf("[INFO] Flushed %v rows to ClickHouse, left %v in spool, lost %v", report.Flushed, report.Spooled, report.Lost)
+		case <-time.After(time.Until(deadline)):
+			// most likely stuck talking to clickhouse, so get what we can onto disk
+			segment, err := spool.Seal()
+			if err != nil {
+				log.Printf("[ERROR] Could not seal spool segment: %v", err)
+			}
+			spooled := 0
+			if segment != nil {
+				spooled = segment.rows
+			}
+			spool.Defer(segment)
+			log.Printf("[ERROR] Could not drain before deadline, left %v rows in spool, anything else in flight is lost", spooled)
+		}
 
-		// // Force all unwritten data to be sent
-		// influxWriter.Flush()
-		// // Ensures background processes finishes
-		// influxClient.Close()
+		err = deadLetters.Close()
+		if err != nil {
+			log.Printf("[ERROR] Could not close dead letter sink: %v", err)
+		}
 
-		log.Printf("[INFO] INFLUX WRITER FLUSHED AND CLOSED")
+		err = clickhouseConn.Close()
+		if err != nil {
+			log.Printf("[ERROR] Could not close clickhouse connection: %v", err)
+		}
+
+		// last, so the final numbers from draining are still there to be scraped
+		ctxTimeout, cancel := context.WithTimeout(ctx, time.Until(deadline))
+		defer cancel()
+
+		err = metrics.Shutdown(ctxTimeout)
+		if err != nil {
+			log.Printf("[ERROR] Could not cleanly shut down metrics server: %v", err)
+		}
+
+		log.Printf("[INFO] ALL DONE, GOODBYE")
 	},
 }
+
+// both intake and replay-dlq need to agree on where dead letters live
+func deadLetterSinkFromEnv(clickConn driver.Conn) (DeadLetterSink, error) {
+
+	switch kind := util.GetOptionalEnvConfig("DEADLETTER_SINK", DeadLetterFile); kind {
+
+	case DeadLetterFile:
+		dir := util.GetOptionalEnvConfig("DEADLETTER_DIR", "/var/spool/ecstatic-deadletter")
+
+		// default of 64MiB per file and 20 files, plenty to figure out what went wrong
+		maxFileBytes, err := util.GetOptionalEnvInt("DEADLETTER_MAX_FILE_BYTES", 64*1024*1024)
+		if err != nil {
+			return nil, fmt.Errorf("Could not parse DEADLETTER_MAX_FILE_BYTES: %w", err)
+		}
+
+		maxFiles, err := util.GetOptionalEnvInt("DEADLETTER_MAX_FILES", 20)
+		if err != nil {
+			return nil, fmt.Errorf("Could not parse DEADLETTER_MAX_FILES: %w", err)
+		}
+
+		return OpenFileDeadLetters(dir, int64(maxFileBytes), maxFiles)
+
+	case DeadLetterClickhouse:
+		return ClickhouseDeadLetters{clickConn}, nil
+
+	case DeadLetterNone:
+		return NoDeadLetters{}, nil
+
+	default:
+		return nil, fmt.Errorf("Invalid dead letter sink %s (try one of %v)", kind, VALIDDEADLETTERSINKS)
+	}
+}
+
+// same goes for enriching, replays should come out the same as the originals.
+// Any geo databases are watched for changes until the context is cancelled
+func enricherFromEnv(ctx context.Context, clickConn driver.Conn) (Enricher, error) {
+
+	// optional, the embedded list is used if not set
+	referrers, err := LoadReferrerClassifier(util.GetOptionalEnvConfig("REFERRER_SOURCES_PATH", ""))
+	if err != nil {
+		return Enricher{}, err
+	}
+
+	// optional, JSON of pull zone ID to SiteOptions
+	sites, err := util.LoadSiteOptions(util.GetOptionalEnvConfig("SITE_OPTIONS_PATH", ""))
+	if err != nil {
+		return Enricher{}, err
+	}
+
+	// optional, comma separated, e.g. a city database and an ASN database
+	geoPaths := util.GetOptionalEnvConfig("GEOIP_DB_PATHS", "")
+
+	reloadInterval, err := util.GetOptionalEnvDuration("GEOIP_RELOAD_INTERVAL", 1*time.Minute)
+	if err != nil {
+		return Enricher{}, fmt.Errorf("Could not parse GEOIP_RELOAD_INTERVAL: %w", err)
+	}
+
+	var geo GeoLookup
+	if geoPaths != "" {
+		databases := GeoDatabases{}
+		for _, path := range strings.Split(geoPaths, ",") {
+			database := OpenGeoDatabase(strings.TrimSpace(path))
+			go database.Watch(ctx, reloadInterval)
+			databases = append(databases, database)
+		}
+		geo = databases
+	}
+
+	// a person clicking around doesn't come anywhere near 2 requests a second for
+	// a whole minute, even counting every asset on every page
+	maxRequests, err := util.GetOptionalEnvInt("BOT_MAX_REQUESTS", 120)
+	if err != nil {
+		return Enricher{}, fmt.Errorf("Could not parse BOT_MAX_REQUESTS: %w", err)
+	}
+
+	window, err := util.GetOptionalEnvDuration("BOT_RATE_WINDOW", 1*time.Minute)
+	if err != nil {
+		return Enricher{}, fmt.Errorf("Could not parse BOT_RATE_WINDOW: %w", err)
+	}
+
+	assetlessPages, err := util.GetOptionalEnvInt("BOT_ASSETLESS_PAGES", 5)
+	if err != nil {
+		return Enricher{}, fmt.Errorf("Could not parse BOT_ASSETLESS_PAGES: %w", err)
+	}
+
+	bots := BotPolicy{MaxRequests: maxRequests, Window: window, AssetlessPages: assetlessPages}
+
+	// shared through clickhouse, so a restart (or another intake) doesn't make
+	// everyone a new visitor halfway through the day
+	salts := NewVisitorSalts(ClickhouseSalts{clickConn})
+
+	return NewEnricher(salts, referrers, sites, geo, bots), nil
+}
+
+// each listener can take logs in its own format, e.g. SYSLOG_UDP_FORMAT=combined
+// and SYSLOG_UDP_ZONE_ID=1234 for nginx on a box of our own, see NewDecoder
+func decoderFromEnv(prefix string) Decoder {
+
+	format := util.GetOptionalEnvConfig(prefix+"_FORMAT", FormatBunny)
+
+	zoneId, err := util.GetOptionalEnvInt(prefix+"_ZONE_ID", 0)
+	if err != nil {
+		log.Fatalf("[ERROR] Could not parse %v_ZONE_ID: %v", prefix, err)
+	}
+
+	decoder, err := NewDecoder(format, zoneId)
+	if err != nil {
+		log.Fatalf("[ERROR] Could not set up decoder for %v: %v", prefix, err)
+	}
+
+	log.Printf("[INFO] Expecting %v logs", decoder.Format())
+
+	return decoder
+}
+
+// optional, <prefix>_ALLOWLIST_PATH, if set only IPs in it can send to that
+// listener. Shared reload interval, since they're all likely the same cron job
+func allowlistFromEnv(ctx context.Context, prefix string) *IpAllowlist {
+
+	path := util.GetOptionalEnvConfig(prefix+"_ALLOWLIST_PATH", "")
+	if path == "" {
+		log.Printf("[WARN] No %v_ALLOWLIST_PATH, taking logs from anyone", prefix)
+		return nil
+	}
+
+	reloadInterval, err := util.GetOptionalEnvDuration("ALLOWLIST_RELOAD_INTERVAL", 1*time.Minute)
+	if err != nil {
+		log.Fatalf("[ERROR] Could not parse ALLOWLIST_RELOAD_INTERVAL: %v", err)
+	}
+
+	allowlist, err := OpenIpAllowlist(path)
+	if err != nil {
+		log.Fatalf("[ERROR] Could not set up allowlist for %v: %v", prefix, err)
+	}
+
+	go allowlist.Watch(ctx, reloadInterval)
+
+	return allowlist
+}
+
+func senderValidatorFromEnv(ctx context.Context) (*SenderValidator, error) {
+
+	// optional, JSON list of ZoneToken, zones in it need a token on every message
+	tokens, err := LoadZoneTokens(util.GetOptionalEnvConfig("SYSLOG_TOKENS_PATH", ""))
+	if err != nil {
+		return nil, err
+	}
+
+	// optional, without it any zone at all is let through
+	supabaseUrl := util.GetOptionalEnvConfig("SUPABASE_URL", "")
+	if supabaseUrl == "" {
+		log.Printf("[WARN] No SUPABASE_URL, not checking that logs are for zones we know")
+		return NewSenderValidator(nil, tokens), nil
+	}
+
+	keys, err := util.GetEnvConfigs([]string{"SUPABASE_ANON_KEY", "SUPABASE_SERVICE_KEY"})
+	if err != nil {
+		return nil, err
+	}
+
+	supabase := client.SupabaseAdminClient{
+		SupabaseUrl:        supabaseUrl,
+		SupabaseAnonKey:    keys["SUPABASE_ANON_KEY"],
+		SupabaseServiceKey: keys["SUPABASE_SERVICE_KEY"],
+	}
+
+	refreshInterval, err := util.GetOptionalEnvDuration("KNOWN_ZONES_REFRESH_INTERVAL", 5*time.Minute)
+	if err != nil {
+		return nil, fmt.Errorf("Could not parse KNOWN_ZONES_REFRESH_INTERVAL: %w", err)
+	}
+
+	// how soon an unknown zone can make us go and check again
+	minRefresh, err := util.GetOptionalEnvDuration("KNOWN_ZONES_MIN_REFRESH", 30*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("Could not parse KNOWN_ZONES_MIN_REFRESH: %w", err)
+	}
+
+	zones := NewKnownZones(supabase.ListPullZoneIds, minRefresh)
+	go zones.Watch(ctx, refreshInterval)
+
+	return NewSenderValidator(zones, tokens), nil
+}
+
+// the live view is for the same people as the query API, with the same JWTs,
+// checked the same way. EventSource can't set headers, so browsers have to send
+// the JWT as the "jwt" cookie or query param instead
+func liveServerFromEnv(port string, live *LiveHub) *http.Server {
+
+	configNames := []string{
+		"CORS_ALLOWED_ORIGIN",
+		"PERMISSIVE_MODE",
+		"JWT_SECRET",
+	}
+
+	config, err := util.GetEnvConfigs(configNames)
+	if err != nil {
+		log.Fatalf("[ERROR] Could not parse live stream configs from environment: %v", err)
+	}
+
+	corsOptions := cors.Options{
+		AllowedOrigins:   []string{config["CORS_ALLOWED_ORIGIN"]},
+		AllowedMethods:   []string{"GET", "OPTIONS"},
+		AllowedHeaders:   []string{"Accept", "Authorization", "Cache-Control", "Last-Event-ID"},
+		AllowCredentials: true,
+	}
+
+	jwtSecret := jwtauth.New("HS256", []byte(config["JWT_SECRET"]), nil)
+
+	r := chi.NewRouter()
+
+	// no middleware.Logger, the JWT can be in the URL, and no middleware.Timeout,
+	// since the whole point is that the response goes on and on
+	r.Use(middleware.Recoverer)
+	r.Use(cors.Handler(corsOptions))
+	r.Use(jwtauth.Verify(jwtSecret, jwtauth.TokenFromHeader, jwtauth.TokenFromCookie, jwtauth.TokenFromQuery))
+	r.Use(util.CheckJwtMiddleware((config["PERMISSIVE_MODE"] == "true"), false))
+	r.Use(util.CheckZoneIdMiddleware(config["PERMISSIVE_MODE"] == "true"))
+
+	r.Get("/live", live.HandleLive)
+
+	return &http.Server{
+		Addr:              fmt.Sprintf(":%v", port),
+		Handler:           r,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+}
@@ -0,0 +1,265 @@
+package intake
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	ch "github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+)
+
+const (
+	DeadLetterFile       = "file"
+	DeadLetterClickhouse = "clickhouse"
+	DeadLetterNone       = "none"
+)
+
+// below should be const, but golang knows better
+var VALIDDEADLETTERSINKS = []string{DeadLetterFile, DeadLetterClickhouse, DeadLetterNone}
+
+const (
+	// the body couldn't be decoded, whatever format it was meant to be
+	StageParse = "parse"
+	// the body parsed, but clickhouse wouldn't take the row
+	StageBatch = "batch"
+	// a row replayed from the spool wouldn't go into a batch, the raw body is long
+	// gone by then, so Raw is the enriched row as JSON instead
+	StageSpool = "spool"
+)
+
+// DeadLetter is a log we gave up on, with everything needed to figure out why
+// and to have another go at it once whatever was wrong has been fixed
+type DeadLetter struct {
+	ReceivedAt time.Time
+	Source     string
+	Stage      string
+	Error      string
+	Raw        []byte
+
+	// how to decode Raw, see NewDecoder
+	Format string
+	ZoneId int
+}
+
+type DeadLetterSink interface {
+	Write(letter DeadLetter) error
+	Close() error
+}
+
+// NoDeadLetters is for when we really do want rejects to just go away
+type NoDeadLetters struct{}
+
+func (n NoDeadLetters) Write(letter DeadLetter) error {
+	return nil
+}
+
+func (n NoDeadLetters) Close() error {
+	return nil
+}
+
+// ClickhouseDeadLetters puts rejects into the accesslog_rejected table, with
+// async inserts since there are (hopefully) too few of them to bother batching
+type ClickhouseDeadLetters struct {
+	clickConn ch.Conn
+}
+
+func (c ClickhouseDeadLetters) Write(letter DeadLetter) error {
+	return c.clickConn.AsyncInsert(
+		context.Background(),
+		"INSERT INTO accesslog_rejected (ReceivedAt, Source, Stage, Error, Raw, Format, ZoneId) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		false,
+		letter.ReceivedAt,
+		letter.Source,
+		letter.Stage,
+		letter.Error,
+		string(letter.Raw),
+		letter.Format,
+		uint32(letter.ZoneId),
+	)
+}
+
+// the connection belongs to whoever made it
+func (c ClickhouseDeadLetters) Close() error {
+	return nil
+}
+
+// FileDeadLetters writes rejects to NDJSON files in a directory, same naming as
+// the spool (.open while being written, .ndjson once sealed), starting a new
+// file whenever the current one gets too big and deleting the oldest sealed
+// ones once there are too many
+type FileDeadLetters struct {
+	dir          string
+	maxFileBytes int64
+	maxFiles     int
+
+	mutex   sync.Mutex
+	file    *os.File
+	writer  *bufio.Writer
+	path    string
+	written int64
+}
+
+func OpenFileDeadLetters(dir string, maxFileBytes int64, maxFiles int) (*FileDeadLetters, error) {
+
+	if maxFileBytes < 1 || maxFiles < 1 {
+		return nil, fmt.Errorf("Dead letter file size and count must be positive")
+	}
+
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("Could not create dead letter dir %v: %w", dir, err)
+	}
+
+	// anything left open by a crash is as good as sealed now
+	paths, err := filepath.Glob(filepath.Join(dir, "*"+openSegmentSuffix))
+	if err != nil {
+		return nil, fmt.Errorf("Could not list dead letter dir %v: %w", dir, err)
+	}
+
+	for _, path := range paths {
+		err = os.Rename(path, strings.TrimSuffix(path, openSegmentSuffix)+sealedSegmentSuffix)
+		if err != nil {
+			return nil, fmt.Errorf("Could not seal leftover dead letter file %v: %w", path, err)
+		}
+	}
+
+	return &FileDeadLetters{dir: dir, maxFileBytes: maxFileBytes, maxFiles: maxFiles}, nil
+}
+
+func (f *FileDeadLetters) Write(letter DeadLetter) error {
+
+	line, err := json.Marshal(letter)
+	if err != nil {
+		return fmt.Errorf("Could not serialize dead letter: %w", err)
+	}
+	line = append(line, '\n')
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.file == nil {
+		// zero-padded so that sorting by name is sorting by age
+		f.path = filepath.Join(f.dir, fmt.Sprintf("%020d%s", time.Now().UnixNano(), openSegmentSuffix))
+
+		f.file, err = os.OpenFile(f.path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err != nil {
+			f.file = nil
+			return fmt.Errorf("Could not create dead letter file %v: %w", f.path, err)
+		}
+
+		f.writer = bufio.NewWriter(f.file)
+		f.written = 0
+	}
+
+	n, err := f.writer.Write(line)
+	if err != nil {
+		return fmt.Errorf("Could not write to dead letter file %v: %w", f.path, err)
+	}
+
+	// rejects tend to come in bursts (a bad deploy, a sender gone weird), and we'd
+	// rather not lose the start of one to a crash, so flush every time
+	err = f.writer.Flush()
+	if err != nil {
+		return fmt.Errorf("Could not flush dead letter file %v: %w", f.path, err)
+	}
+
+	f.written += int64(n)
+
+	if f.written >= f.maxFileBytes {
+		return f.rotate()
+	}
+
+	return nil
+}
+
+// Close seals the current file, if any, so it can be replayed
+func (f *FileDeadLetters) Close() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.rotate()
+}
+
+// must hold the mutex
+func (f *FileDeadLetters) rotate() error {
+
+	if f.file == nil {
+		return nil
+	}
+
+	file, path := f.file, f.path
+	f.file = nil
+
+	err := file.Close()
+	if err != nil {
+		return fmt.Errorf("Could not close dead letter file %v: %w", path, err)
+	}
+
+	err = os.Rename(path, strings.TrimSuffix(path, openSegmentSuffix)+sealedSegmentSuffix)
+	if err != nil {
+		return fmt.Errorf("Could not seal dead letter file %v: %w", path, err)
+	}
+
+	sealed, err := sealedDeadLetterFiles(f.dir)
+	if err != nil {
+		return err
+	}
+
+	for len(sealed) > f.maxFiles {
+		log.Printf("[WARN] Over %v dead letter files, deleting %v", f.maxFiles, sealed[0])
+		err = os.Remove(sealed[0])
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("Could not delete dead letter file %v: %w", sealed[0], err)
+		}
+		sealed = sealed[1:]
+	}
+
+	return nil
+}
+
+// oldest first
+func sealedDeadLetterFiles(dir string) ([]string, error) {
+
+	paths, err := filepath.Glob(filepath.Join(dir, "*"+sealedSegmentSuffix))
+	if err != nil {
+		return nil, fmt.Errorf("Could not list dead letter dir %v: %w", dir, err)
+	}
+
+	sort.Strings(paths)
+
+	return paths, nil
+}
+
+func readDeadLetters(path string) ([]DeadLetter, error) {
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	defer file.Close()
+
+	letters := []DeadLetter{}
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 4*maxFrameSize)
+	for scanner.Scan() {
+		var letter DeadLetter
+		err = json.Unmarshal(scanner.Bytes(), &letter)
+		if err != nil {
+			log.Printf("[WARN] Skipping unreadable line in dead letter file %v: %v", path, err)
+			continue
+		}
+		letters = append(letters, letter)
+	}
+
+	return letters, scanner.Err()
+}
@@ -0,0 +1,74 @@
+package intake
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeadLettersRotateAndPrune(t *testing.T) {
+
+	dir := t.TempDir()
+
+	// every letter is bigger than this, so each one gets a file of its own
+	sink, err := OpenFileDeadLetters(dir, 1, 2)
+	assert.Nil(t, err)
+
+	for n := 0; n < 3; n++ {
+		err = sink.Write(DeadLetter{time.Now(), "tcp://127.0.0.1:1234", StageParse, "bad", []byte("not json"), FormatBunny, 0})
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, sink.Close())
+
+	paths, err := sealedDeadLetterFiles(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(paths))
+
+	letters, err := readDeadLetters(paths[0])
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(letters))
+	assert.Equal(t, []byte("not json"), letters[0].Raw)
+	assert.Equal(t, StageParse, letters[0].Stage)
+}
+
+func TestRewriteDeadLetters(t *testing.T) {
+
+	dir := t.TempDir()
+
+	sink, err := OpenFileDeadLetters(dir, 1024*1024, 2)
+	assert.Nil(t, err)
+
+	for n := 0; n < 3; n++ {
+		assert.Nil(t, sink.Write(DeadLetter{time.Now(), "udp://127.0.0.1:1234", StageParse, "bad", []byte(bunnyBody), FormatBunny, 0}))
+	}
+	assert.Nil(t, sink.Close())
+
+	paths, _ := sealedDeadLetterFiles(dir)
+	assert.Equal(t, 1, len(paths))
+
+	letters, _ := readDeadLetters(paths[0])
+	assert.Nil(t, rewriteDeadLetters(paths[0], letters[:1]))
+
+	letters, _ = readDeadLetters(paths[0])
+	assert.Equal(t, 1, len(letters))
+
+	// nothing left, nothing to keep
+	assert.Nil(t, rewriteDeadLetters(paths[0], nil))
+	paths, _ = sealedDeadLetterFiles(dir)
+	assert.Equal(t, 0, len(paths))
+}
+
+func TestReprocess(t *testing.T) {
+
+	enriched, err := reprocess(testEnricher(), DeadLetter{Stage: StageParse, Raw: []byte(bunnyBody)})
+	assert.Nil(t, err)
+	assert.Equal(t, 1234, enriched.PullZoneId)
+
+	_, err = reprocess(testEnricher(), DeadLetter{Stage: StageParse, Raw: []byte("still not json")})
+	assert.NotNil(t, err)
+
+	enriched, err = reprocess(testEnricher(), DeadLetter{Stage: StageSpool, Raw: []byte(`{"PullZoneId":99,"Host":"example.com"}`)})
+	assert.Nil(t, err)
+	assert.Equal(t, "example.com", enriched.Host)
+}
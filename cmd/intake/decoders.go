@@ -0,0 +1,402 @@
+package intake
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	FormatBunny      = "bunny"
+	FormatCombined   = "combined"
+	FormatCaddy      = "caddy"
+	FormatCloudflare = "cloudflare"
+)
+
+// below should be const, but golang knows better
+var VALIDFORMATS = []string{FormatBunny, FormatCombined, FormatCaddy, FormatCloudflare}
+
+// LogRecord is one request, from whichever CDN or server, before enrichment.
+// Field names follow bunny's, since that's where they came from first
+type LogRecord struct {
+	PullZoneId   int
+	Timestamp    int64 // epoch ms
+	Host         string
+	PathAndQuery string
+	UserAgent    string
+	Referer      string
+	RemoteIp     string // anonymized, see anonymizeIp
+	Country      string // two letters, upper case
+	Status       int
+	BytesSent    int
+	RequestId    string
+
+	// how the CDN served it, left empty by whatever doesn't say
+	Cached        bool   // from the edge's cache, without going to the origin
+	ServerZone    string // the edge PoP, e.g. DE or NY
+	GzipRatio     float64
+	BodyBytesSent int    // BytesSent is the body plus the headers
+	Protocol      string // e.g. HTTP/2.0
+	IsSSL         bool
+	HeaderRange   string // the Range header, for partial (e.g. video) requests
+}
+
+// Decoder turns a log body in some format into a LogRecord
+type Decoder interface {
+	Format() string
+	// the zone every log is for, 0 if the logs say so themselves (bunny only)
+	ZoneId() int
+	Decode(body []byte) (LogRecord, error)
+}
+
+// NewDecoder picks the decoder for the format. Anything other than bunny logs
+// come from a server that knows nothing about zones, so they need to be told.
+// Bunny logs say which zone they're for, so the zone is optional, and if given
+// then logs for any other zone are rejected
+func NewDecoder(format string, zoneId int) (Decoder, error) {
+
+	switch format {
+	case FormatBunny, "":
+		return BunnyDecoder{zoneId}, nil
+	case FormatCombined, FormatCaddy, FormatCloudflare:
+	default:
+		return nil, fmt.Errorf("Invalid log format %s (try one of %v)", format, VALIDFORMATS)
+	}
+
+	if zoneId < 1 {
+		return nil, fmt.Errorf("Log format %s needs a zone ID to go with it", format)
+	}
+
+	switch format {
+	case FormatCombined:
+		return CombinedDecoder{zoneId}, nil
+	case FormatCaddy:
+		return CaddyDecoder{zoneId}, nil
+	default:
+		return CloudflareDecoder{zoneId}, nil
+	}
+}
+
+// ----------------------------------------------------------------------------
+
+type BunnyDecoder struct {
+	zoneId int // 0 for any zone
+}
+
+func (d BunnyDecoder) Format() string {
+	return FormatBunny
+}
+
+func (d BunnyDecoder) ZoneId() int {
+	return d.zoneId
+}
+
+func (d BunnyDecoder) Decode(body []byte) (LogRecord, error) {
+
+	bunny, err := stringToBunnyLog(body)
+	if err != nil {
+		return LogRecord{}, err
+	}
+
+	if d.zoneId != 0 && bunny.PullZoneId != d.zoneId {
+		return LogRecord{}, fmt.Errorf("Log is for zone %v, but only zone %v is allowed here", bunny.PullZoneId, d.zoneId)
+	}
+
+	return LogRecord{
+		PullZoneId:   bunny.PullZoneId,
+		Timestamp:    bunny.Timestamp,
+		Host:         bunny.Host,
+		PathAndQuery: bunny.PathAndQuery,
+		UserAgent:    bunny.UserAgent,
+		Referer:      bunny.Referer,
+		// already anonymized by bunny
+		RemoteIp:  bunny.RemoteIp,
+		Country:   bunny.Country,
+		Status:    bunny.Status,
+		BytesSent: bunny.BytesSent,
+		RequestId: bunny.RequestId,
+
+		Cached:        bunny.Cached,
+		ServerZone:    bunny.ServerZone,
+		GzipRatio:     bunny.GzipRatio,
+		BodyBytesSent: bunny.BodyBytesSent,
+		Protocol:      bunny.Protocol,
+		IsSSL:         bunny.IsSSL,
+		HeaderRange:   bunny.HeaderRange,
+	}, nil
+}
+
+// ----------------------------------------------------------------------------
+
+// CombinedDecoder is for the "combined" log format that nginx and apache both
+// default to, anything extra on the end (like nginx's $request_time) is ignored.
+// Quotes inside the quoted fields come escaped as \" (apache) or \x22 (nginx)
+type CombinedDecoder struct {
+	zoneId int
+}
+
+var combinedPattern = regexp.MustCompile(`^(\S+) \S+ \S+ \[([^\]]+)\] "((?:[^"\\]|\\.)*)" (\d{3}) (\d+|-) "((?:[^"\\]|\\.)*)" "((?:[^"\\]|\\.)*)"`)
+
+func (d CombinedDecoder) Format() string {
+	return FormatCombined
+}
+
+func (d CombinedDecoder) ZoneId() int {
+	return d.zoneId
+}
+
+func (d CombinedDecoder) Decode(body []byte) (LogRecord, error) {
+
+	match := combinedPattern.FindSubmatch(body)
+	if match == nil {
+		return LogRecord{}, errors.New("Could not parse line as combined log format")
+	}
+
+	timestamp, err := time.Parse("02/Jan/2006:15:04:05 -0700", string(match[2]))
+	if err != nil {
+		return LogRecord{}, fmt.Errorf("Could not parse combined log time: %w", err)
+	}
+
+	// "GET /path?query HTTP/1.1", but garbage requests get logged too
+	path := "/"
+	protocol := ""
+	request := strings.Fields(string(match[3]))
+	if len(request) >= 2 {
+		path = request[1]
+	}
+	if len(request) >= 3 {
+		protocol = request[2]
+	}
+
+	status, _ := strconv.Atoi(string(match[4]))
+	// "-" for no body at all
+	bytesSent, _ := strconv.Atoi(string(match[5]))
+
+	referer := unescapeCombined(match[6])
+	if referer == "-" {
+		referer = ""
+	}
+
+	return LogRecord{
+		PullZoneId:   d.zoneId,
+		Timestamp:    timestamp.UnixMilli(),
+		PathAndQuery: path,
+		UserAgent:    unescapeCombined(match[7]),
+		Referer:      referer,
+		RemoteIp:     anonymizeIp(string(match[1])),
+		Status:       status,
+		BytesSent:    bytesSent,
+		// combined logs only have the body size
+		BodyBytesSent: bytesSent,
+		Protocol:      protocol,
+	}, nil
+}
+
+func unescapeCombined(field []byte) string {
+	s := string(field)
+	s = strings.ReplaceAll(s, `\x22`, `"`)
+	s = strings.ReplaceAll(s, `\"`, `"`)
+	return strings.ReplaceAll(s, `\\`, `\`)
+}
+
+// ----------------------------------------------------------------------------
+
+// CaddyDecoder is for caddy's JSON access logs (the http.log.access logger)
+type CaddyDecoder struct {
+	zoneId int
+}
+
+type caddyLog struct {
+	Ts      float64 `json:"ts"`
+	Request struct {
+		RemoteIp string              `json:"remote_ip"`
+		ClientIp string              `json:"client_ip"`
+		Proto    string              `json:"proto"`
+		Host     string              `json:"host"`
+		Uri      string              `json:"uri"`
+		Headers  map[string][]string `json:"headers"`
+		// only there at all for HTTPS
+		Tls *struct{} `json:"tls"`
+	} `json:"request"`
+	Size   int `json:"size"`
+	Status int `json:"status"`
+}
+
+func (d CaddyDecoder) Format() string {
+	return FormatCaddy
+}
+
+func (d CaddyDecoder) ZoneId() int {
+	return d.zoneId
+}
+
+func (d CaddyDecoder) Decode(body []byte) (LogRecord, error) {
+
+	caddy := caddyLog{}
+
+	err := json.Unmarshal(body, &caddy)
+	if err != nil {
+		return LogRecord{}, fmt.Errorf("Could not parse caddy log: %v", err)
+	}
+
+	if caddy.Request.Uri == "" {
+		return LogRecord{}, errors.New("Caddy log has no request in it, is it an access log?")
+	}
+
+	// client_ip is remote_ip, unless caddy is behind a trusted proxy
+	ip := caddy.Request.ClientIp
+	if ip == "" {
+		ip = caddy.Request.RemoteIp
+	}
+
+	header := func(name string) string {
+		if values := caddy.Request.Headers[name]; len(values) > 0 {
+			return values[0]
+		}
+		return ""
+	}
+
+	return LogRecord{
+		PullZoneId:   d.zoneId,
+		Timestamp:    int64(caddy.Ts * 1000),
+		Host:         caddy.Request.Host,
+		PathAndQuery: caddy.Request.Uri,
+		UserAgent:    header("User-Agent"),
+		Referer:      header("Referer"),
+		RemoteIp:     anonymizeIp(ip),
+		Status:       caddy.Status,
+		// caddy only logs the body size
+		BytesSent:     caddy.Size,
+		BodyBytesSent: caddy.Size,
+		Protocol:      caddy.Request.Proto,
+		IsSSL:         caddy.Request.Tls != nil,
+		HeaderRange:   header("Range"),
+	}, nil
+}
+
+// ----------------------------------------------------------------------------
+
+// CloudflareDecoder is for Logpush's http_requests dataset, in JSON
+type CloudflareDecoder struct {
+	zoneId int
+}
+
+type cloudflareLog struct {
+	ClientIP               string          `json:"ClientIP"`
+	ClientCountry          string          `json:"ClientCountry"`
+	ClientRequestHost      string          `json:"ClientRequestHost"`
+	ClientRequestURI       string          `json:"ClientRequestURI"`
+	ClientRequestUserAgent string          `json:"ClientRequestUserAgent"`
+	ClientRequestReferer   string          `json:"ClientRequestReferer"`
+	EdgeResponseStatus     int             `json:"EdgeResponseStatus"`
+	EdgeResponseBytes      int             `json:"EdgeResponseBytes"`
+	EdgeStartTimestamp     json.RawMessage `json:"EdgeStartTimestamp"`
+	RayID                  string          `json:"RayID"`
+
+	CacheCacheStatus             string  `json:"CacheCacheStatus"`
+	EdgeColoCode                 string  `json:"EdgeColoCode"`
+	EdgeResponseBodyBytes        int     `json:"EdgeResponseBodyBytes"`
+	EdgeResponseCompressionRatio float64 `json:"EdgeResponseCompressionRatio"`
+	ClientRequestProtocol        string  `json:"ClientRequestProtocol"`
+	ClientRequestScheme          string  `json:"ClientRequestScheme"`
+}
+
+func (d CloudflareDecoder) Format() string {
+	return FormatCloudflare
+}
+
+func (d CloudflareDecoder) ZoneId() int {
+	return d.zoneId
+}
+
+func (d CloudflareDecoder) Decode(body []byte) (LogRecord, error) {
+
+	cf := cloudflareLog{}
+
+	err := json.Unmarshal(body, &cf)
+	if err != nil {
+		return LogRecord{}, fmt.Errorf("Could not parse cloudflare log: %v", err)
+	}
+
+	timestamp, err := cloudflareTimestamp(cf.EdgeStartTimestamp)
+	if err != nil {
+		return LogRecord{}, err
+	}
+
+	return LogRecord{
+		PullZoneId:   d.zoneId,
+		Timestamp:    timestamp.UnixMilli(),
+		Host:         cf.ClientRequestHost,
+		PathAndQuery: cf.ClientRequestURI,
+		UserAgent:    cf.ClientRequestUserAgent,
+		Referer:      cf.ClientRequestReferer,
+		RemoteIp:     anonymizeIp(cf.ClientIP),
+		Country:      strings.ToUpper(cf.ClientCountry),
+		Status:       cf.EdgeResponseStatus,
+		BytesSent:    cf.EdgeResponseBytes,
+		RequestId:    cf.RayID,
+
+		Cached:        cloudflareCached(cf.CacheCacheStatus),
+		ServerZone:    cf.EdgeColoCode,
+		GzipRatio:     cf.EdgeResponseCompressionRatio,
+		BodyBytesSent: cf.EdgeResponseBodyBytes,
+		Protocol:      cf.ClientRequestProtocol,
+		IsSSL:         cf.ClientRequestScheme == "https",
+	}, nil
+}
+
+// anything served without a trip to the origin, even if the cached copy was
+// stale or had to be checked first
+func cloudflareCached(status string) bool {
+	switch status {
+	case "hit", "stale", "updating", "revalidated":
+		return true
+	default:
+		return false
+	}
+}
+
+// depending on the job's timestamp_format, it's RFC 3339, unix seconds, or unix
+// nanoseconds, and the numbers are far enough apart to tell which
+func cloudflareTimestamp(raw json.RawMessage) (time.Time, error) {
+
+	var text string
+	if json.Unmarshal(raw, &text) == nil {
+		return time.Parse(time.RFC3339, text)
+	}
+
+	var number int64
+	err := json.Unmarshal(raw, &number)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Could not parse cloudflare EdgeStartTimestamp %s", raw)
+	}
+
+	if number > 1e15 {
+		return time.Unix(0, number), nil
+	}
+
+	return time.Unix(number, 0), nil
+}
+
+// ----------------------------------------------------------------------------
+
+// bunny zeroes out the end of the IP before we ever see it, so we do the same
+// for everyone else: the last octet for v4, everything past the /48 for v6
+func anonymizeIp(raw string) string {
+
+	ip := net.ParseIP(raw)
+	if ip == nil {
+		return ""
+	}
+
+	if v4 := ip.To4(); v4 != nil {
+		return v4.Mask(net.CIDRMask(24, 32)).String()
+	}
+
+	return ip.Mask(net.CIDRMask(48, 128)).String()
+}
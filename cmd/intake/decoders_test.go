@@ -0,0 +1,119 @@
+package intake
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewDecoder(t *testing.T) {
+
+	decoder, err := NewDecoder("", 0)
+	assert.NoError(t, err)
+	assert.Equal(t, FormatBunny, decoder.Format())
+
+	_, err = NewDecoder(FormatCombined, 0)
+	assert.Error(t, err)
+
+	_, err = NewDecoder("syslog-ng", 1234)
+	assert.Error(t, err)
+}
+
+func TestCombinedDecoder(t *testing.T) {
+
+	line := `203.0.113.57 - frank [10/Oct/2023:13:55:36 -0700] "GET /about/?x=1 HTTP/1.1" 200 2326 "https://www.google.com/" "Mozilla/5.0 \"quoted\"" 0.002`
+
+	record, err := CombinedDecoder{1234}.Decode([]byte(line))
+	assert.NoError(t, err)
+
+	assert.Equal(t, 1234, record.PullZoneId)
+	assert.Equal(t, int64(1696971336000), record.Timestamp)
+	assert.Equal(t, "/about/?x=1", record.PathAndQuery)
+	assert.Equal(t, 200, record.Status)
+	assert.Equal(t, 2326, record.BytesSent)
+	assert.Equal(t, "https://www.google.com/", record.Referer)
+	assert.Equal(t, `Mozilla/5.0 "quoted"`, record.UserAgent)
+	assert.Equal(t, "203.0.113.0", record.RemoteIp)
+
+	// nginx style escapes, no body, no referrer
+	line = `2001:db8:1234:5678::1 - - [10/Oct/2023:20:55:36 +0000] "HEAD / HTTP/1.1" 304 - "-" "curl/8.0 \x22hi\x22"`
+
+	record, err = CombinedDecoder{1234}.Decode([]byte(line))
+	assert.NoError(t, err)
+	assert.Equal(t, 0, record.BytesSent)
+	assert.Equal(t, "", record.Referer)
+	assert.Equal(t, `curl/8.0 "hi"`, record.UserAgent)
+	assert.Equal(t, "2001:db8:1234::", record.RemoteIp)
+
+	_, err = CombinedDecoder{1234}.Decode([]byte("not a log line"))
+	assert.Error(t, err)
+}
+
+func TestCaddyDecoder(t *testing.T) {
+
+	line := `{"level":"info","ts":1646861401.524,"logger":"http.log.access","msg":"handled request","request":{"remote_ip":"198.51.100.7","remote_port":"41342","proto":"HTTP/2.0","method":"GET","host":"example.com","uri":"/blog?page=2","headers":{"User-Agent":["Mozilla/5.0"],"Referer":["https://news.ycombinator.com/"]}},"duration":0.0005,"size":5120,"status":200}`
+
+	record, err := CaddyDecoder{1234}.Decode([]byte(line))
+	assert.NoError(t, err)
+
+	assert.Equal(t, 1234, record.PullZoneId)
+	assert.Equal(t, int64(1646861401524), record.Timestamp)
+	assert.Equal(t, "example.com", record.Host)
+	assert.Equal(t, "/blog?page=2", record.PathAndQuery)
+	assert.Equal(t, "Mozilla/5.0", record.UserAgent)
+	assert.Equal(t, "https://news.ycombinator.com/", record.Referer)
+	assert.Equal(t, "198.51.100.0", record.RemoteIp)
+	assert.Equal(t, 5120, record.BytesSent)
+	assert.Equal(t, "HTTP/2.0", record.Protocol)
+	assert.Equal(t, false, record.IsSSL)
+
+	// some other caddy logger, not an access log
+	_, err = CaddyDecoder{1234}.Decode([]byte(`{"level":"info","ts":1646861401.5,"msg":"serving initial configuration"}`))
+	assert.Error(t, err)
+}
+
+func TestCloudflareDecoder(t *testing.T) {
+
+	line := `{"ClientIP":"192.0.2.44","ClientCountry":"gb","ClientRequestHost":"example.com","ClientRequestURI":"/","ClientRequestUserAgent":"Mozilla/5.0","ClientRequestReferer":"","EdgeResponseStatus":404,"EdgeResponseBytes":512,"EdgeStartTimestamp":"2023-10-10T20:55:36.5Z","RayID":"81b2f7a4e9c1d2e3","CacheCacheStatus":"stale","EdgeColoCode":"LHR","ClientRequestScheme":"https"}`
+
+	record, err := CloudflareDecoder{1234}.Decode([]byte(line))
+	assert.NoError(t, err)
+
+	assert.Equal(t, int64(1696971336500), record.Timestamp)
+	assert.Equal(t, "GB", record.Country)
+	assert.Equal(t, 404, record.Status)
+	assert.Equal(t, "81b2f7a4e9c1d2e3", record.RequestId)
+	assert.Equal(t, "192.0.2.0", record.RemoteIp)
+	assert.Equal(t, true, record.Cached)
+	assert.Equal(t, "LHR", record.ServerZone)
+	assert.Equal(t, true, record.IsSSL)
+
+	// the other timestamp formats
+	record, err = CloudflareDecoder{1234}.Decode([]byte(`{"EdgeStartTimestamp":1696971336}`))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1696971336000), record.Timestamp)
+
+	record, err = CloudflareDecoder{1234}.Decode([]byte(`{"EdgeStartTimestamp":1696971336500000000}`))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1696971336500), record.Timestamp)
+}
+
+func TestBunnyDecoderCdnFields(t *testing.T) {
+
+	line := `{"PullZoneId":1234,"Status":206,"Timestamp":1507167062421,"BytesSent":1412,"BodyBytesSent":1000,"GzipRatio":3.5,"Cached":true,"ServerZone":"DE","Protocol":"HTTP/2.0","IsSSL":true,"HeaderRange":"bytes=0-999","PathAndQuery":"/video.mp4"}`
+
+	record, err := BunnyDecoder{}.Decode([]byte(line))
+	assert.NoError(t, err)
+
+	assert.Equal(t, true, record.Cached)
+	assert.Equal(t, "DE", record.ServerZone)
+	assert.Equal(t, 3.5, record.GzipRatio)
+	assert.Equal(t, 1000, record.BodyBytesSent)
+	assert.Equal(t, "HTTP/2.0", record.Protocol)
+	assert.Equal(t, true, record.IsSSL)
+	assert.Equal(t, "bytes=0-999", record.HeaderRange)
+
+	// anything but the zone it's meant for
+	_, err = BunnyDecoder{5678}.Decode([]byte(line))
+	assert.Error(t, err)
+}
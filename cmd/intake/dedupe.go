@@ -0,0 +1,94 @@
+package intake
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"sync"
+)
+
+// RequestIdWindow remembers the last so many request IDs, to catch the
+// duplicates that show up soon after the original, mostly bunny resending
+// whatever it wasn't sure we got after a reconnect. Anything older than that
+// is left to clickhouse, which collapses rows with the same RequestId (see
+// schema/migrations/0011)
+type RequestIdWindow struct {
+	mutex sync.Mutex
+	ids   map[string]struct{}
+	// a ring, oldest at next, so the oldest ID is the one forgotten
+	order []string
+	next  int
+}
+
+func NewRequestIdWindow(size int) *RequestIdWindow {
+	return &RequestIdWindow{ids: make(map[string]struct{}, size), order: make([]string, size)}
+}
+
+// Seen says whether the ID is already in the window, adding it if not. A nil
+// window (or a zero sized one) has never seen anything
+func (w *RequestIdWindow) Seen(id string) bool {
+
+	if w == nil || len(w.order) == 0 {
+		return false
+	}
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if _, ok := w.ids[id]; ok {
+		return true
+	}
+
+	w.add(id)
+	return false
+}
+
+// Has is Seen without adding it, for a row that isn't anywhere safe yet. If it
+// never gets there, a resend is what we want, not a duplicate
+func (w *RequestIdWindow) Has(id string) bool {
+
+	if w == nil || len(w.order) == 0 {
+		return false
+	}
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	_, ok := w.ids[id]
+	return ok
+}
+
+// Add puts the ID in the window, once its row is in a batch or the spool
+func (w *RequestIdWindow) Add(id string) {
+	w.Seen(id)
+}
+
+// must hold the mutex
+func (w *RequestIdWindow) add(id string) {
+	delete(w.ids, w.order[w.next])
+	w.order[w.next] = id
+	w.ids[id] = struct{}{}
+	w.next = (w.next + 1) % len(w.order)
+}
+
+// for logs that don't come with an ID (anything but bunny and cloudflare). An
+// imported line gets one from where it is in the file, so importing the same
+// file again makes the same IDs and clickhouse collapses the second lot. Any
+// other gets a random one: nothing in a combined or caddy line tells two
+// identical requests in the same second apart from one sent twice, and
+// losing real requests is worse than keeping the odd resend
+func lineRequestId(message SyslogMessage, zoneId int) string {
+	if message.Line == 0 {
+		id := make([]byte, 16)
+		rand.Read(id)
+		return hex.EncodeToString(id)
+	}
+	hash := sha256.New()
+	hash.Write([]byte(strconv.Itoa(zoneId)))
+	hash.Write([]byte{0})
+	hash.Write([]byte(message.Source))
+	hash.Write([]byte{0})
+	hash.Write([]byte(strconv.Itoa(message.Line)))
+	return hex.EncodeToString(hash.Sum(nil)[:16])
+}
@@ -0,0 +1,68 @@
+package intake
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequestIdWindow(t *testing.T) {
+
+	window := NewRequestIdWindow(2)
+
+	assert.False(t, window.Seen("a"))
+	assert.False(t, window.Seen("b"))
+	assert.True(t, window.Seen("a"))
+
+	// pushes a out
+	assert.False(t, window.Seen("c"))
+	assert.False(t, window.Seen("a"))
+	assert.True(t, window.Seen("c"))
+
+	// only looking
+	assert.False(t, window.Has("d"))
+	assert.False(t, window.Has("d"))
+	window.Add("d")
+	assert.True(t, window.Has("d"))
+
+	var none *RequestIdWindow
+	assert.False(t, none.Seen("a"))
+	assert.False(t, NewRequestIdWindow(0).Seen("a"))
+}
+
+func TestDedupeProcess(t *testing.T) {
+
+	intaker := Intaker{enricher: testEnricher(), requestIds: NewRequestIdWindow(10)}
+
+	bunny := SyslogMessage{Body: []byte(`{"PullZoneId":1234,"Status":200,"Timestamp":1507167062421,"RequestId":"abc","PathAndQuery":"/"}`)}
+
+	_, ok := intaker.process(bunny)
+	assert.True(t, ok)
+	// not stored anywhere yet, so not a duplicate
+	_, ok = intaker.process(bunny)
+	assert.True(t, ok)
+	intaker.requestIds.Add("abc")
+	_, ok = intaker.process(bunny)
+	assert.False(t, ok)
+
+	// no ID in the log, so two of the same line are two requests
+	line := []byte(`203.0.113.57 - - [10/Oct/2023:13:55:36 -0700] "GET / HTTP/1.1" 200 2326 "-" "Mozilla/5.0"`)
+	combined := SyslogMessage{Body: line, Decoder: CombinedDecoder{1234}}
+
+	row, ok := intaker.process(combined)
+	assert.True(t, ok)
+	assert.Len(t, row.enriched.RequestId, 32)
+	again, ok := intaker.process(combined)
+	assert.True(t, ok)
+	assert.NotEqual(t, row.enriched.RequestId, again.enriched.RequestId)
+
+	// unless it's the same line of the same import
+	imported := SyslogMessage{Body: line, Decoder: CombinedDecoder{1234}, Source: "import:///logs/access.log", Line: 7}
+	row, _ = intaker.process(imported)
+	again, _ = intaker.process(imported)
+	assert.Equal(t, row.enriched.RequestId, again.enriched.RequestId)
+
+	imported.Line = 8
+	other, _ := intaker.process(imported)
+	assert.NotEqual(t, row.enriched.RequestId, other.enriched.RequestId)
+}
@@ -6,6 +6,8 @@ import (
 	"net/url"
 	"strings"
 
+	"ecstatic/util"
+
 	"github.com/mileusna/useragent"
 	"zgo.at/isbot"
 )
@@ -14,8 +16,9 @@ import (
 // right now it's KINDA "Unknown"
 // maybe empty str?
 
-// EnrichedLog is responsible for turning a BunnyLog into a point for influx
-// with all the necessary tags, timestamps, etc
+// EnrichedLog is a decoded LogRecord with everything we work out from it
+// (geo, device, referrer, bots, etc), ready to become an accesslog row in
+// clickhouse by way of accesslogRow
 type EnrichedLog struct {
 	PullZoneId     int
 	Timestamp      int64
@@ -31,26 +34,113 @@ type EnrichedLog struct {
 	Country        string
 	FileType       string
 	IsProbablyBot  bool
+	BotReason      string
+	VisitorId      uint64
+
+	ReferrerSource  string
+	ReferrerChannel string
+	UtmSource       string
+	UtmMedium       string
+	UtmCampaign     string
+
+	QueryString string
+
+	Region string
+	City   string
+	Asn    uint32
+
+	RequestId string
+
+	Cached        bool
+	ServerZone    string
+	GzipRatio     float64
+	BodyBytesSent int
+	Protocol      string
+	IsSSL         bool
+	HeaderRange   string
 }
 
-func Enrich(bunny BunnyLog) EnrichedLog {
-	ua := useragent.Parse(bunny.UserAgent)
+// Enricher holds on to whatever state enriching needs: the salts for hashing
+// visitors, the list of known referrers, any per site options, the geo
+// databases (nil if there aren't any), and what visitors have been up to lately
+type Enricher struct {
+	salts     *VisitorSalts
+	referrers *ReferrerClassifier
+	sites     map[int]util.SiteOptions
+	geo       GeoLookup
+	bots      *BotScorer
+}
+
+func NewEnricher(salts *VisitorSalts, referrers *ReferrerClassifier, sites map[int]util.SiteOptions, geo GeoLookup, bots BotPolicy) Enricher {
+	return Enricher{salts, referrers, sites, geo, NewBotScorer(bots)}
+}
+
+func (e Enricher) Enrich(record LogRecord) EnrichedLog {
+	ua := useragent.Parse(record.UserAgent)
+
+	source, channel := e.referrers.Classify(record.Referer, record.Host)
+	utmSource, utmMedium, utmCampaign := UtmParams(record.PathAndQuery)
+	path, queryString := NormalizePath(record.PathAndQuery, e.sites[record.PullZoneId].KeepQueryParams)
+	geo := Geo(e.geo, record)
+	visitorId := e.salts.VisitorId(record)
+	fileType := FileType(record)
+	botReason := e.bots.Score(record, visitorId, fileType)
+
+	// email clients mostly don't send a referrer at all, so the campaign tags are
+	// the only way to tell a newsletter click from someone typing in the URL
+	if (channel == ChannelDirect || channel == ChannelReferral) && isEmailMedium(utmMedium) {
+		channel = ChannelEmail
+	}
+
 	return EnrichedLog{
-		PullZoneId: bunny.PullZoneId,
-		// bunny comes  in epoch ms, CH wants epoch sec
-		Timestamp:      bunny.Timestamp / 1000,
-		BytesSent:      bunny.BytesSent,
-		StatusCode:     bunny.Status,
-		StatusCategory: StatusCategory(bunny),
-		Host:           bunny.Host,
-		Path:           bunny.PathAndQuery,
-		Referrer:       Referrer(bunny),
+		PullZoneId: record.PullZoneId,
+		// records are in epoch ms, CH wants epoch sec
+		Timestamp:      record.Timestamp / 1000,
+		BytesSent:      record.BytesSent,
+		StatusCode:     record.Status,
+		StatusCategory: StatusCategory(record),
+		Host:           record.Host,
+		Path:           path,
+		Referrer:       Referrer(record),
 		Device:         Device(ua),
 		Browser:        Browser(ua),
 		Os:             Os(ua),
-		Country:        bunny.Country,
-		FileType:       FileType(bunny),
-		IsProbablyBot:  IsProbablyBot(bunny),
+		Country:        record.Country,
+		FileType:       fileType,
+		IsProbablyBot:  botReason != "",
+		BotReason:      botReason,
+		VisitorId:      visitorId,
+
+		ReferrerSource:  source,
+		ReferrerChannel: channel,
+		UtmSource:       utmSource,
+		UtmMedium:       utmMedium,
+		UtmCampaign:     utmCampaign,
+
+		QueryString: queryString,
+
+		Region: geo.Region,
+		City:   geo.City,
+		Asn:    geo.Asn,
+
+		RequestId: record.RequestId,
+
+		Cached:        record.Cached,
+		ServerZone:    record.ServerZone,
+		GzipRatio:     record.GzipRatio,
+		BodyBytesSent: record.BodyBytesSent,
+		Protocol:      record.Protocol,
+		IsSSL:         record.IsSSL,
+		HeaderRange:   record.HeaderRange,
+	}
+}
+
+func isEmailMedium(medium string) bool {
+	switch strings.ToLower(medium) {
+	case "email", "e-mail", "newsletter":
+		return true
+	default:
+		return false
 	}
 }
 
@@ -80,16 +170,16 @@ func Os(ua useragent.UserAgent) string {
 	return ua.OS
 }
 
-func StatusCategory(bunny BunnyLog) string {
-	if bunny.Status < 100 {
-		log.Printf("Can't get status category from weird code: %v", bunny.Status)
+func StatusCategory(record LogRecord) string {
+	if record.Status < 100 {
+		log.Printf("Can't get status category from weird code: %v", record.Status)
 		return "Unknown"
 	}
-	return fmt.Sprint(bunny.Status/100) + "xx"
+	return fmt.Sprint(record.Status/100) + "xx"
 }
 
-func Referrer(bunny BunnyLog) string {
-	refUrl, err := url.Parse(bunny.Referer)
+func Referrer(record LogRecord) string {
+	refUrl, err := url.Parse(record.Referer)
 	if err != nil {
 		log.Printf("[WARN] Unable to parse referrer URL: %v", err)
 		return "Unknown"
@@ -97,10 +187,13 @@ func Referrer(bunny BunnyLog) string {
 	return refUrl.Host
 }
 
-func FileType(bunny BunnyLog) string {
+func FileType(record LogRecord) string {
 
-	slashIndex := strings.LastIndex(bunny.PathAndQuery, "/")
-	filename := bunny.PathAndQuery[(slashIndex + 1):]
+	// otherwise /style.css?v=2 would be a "css?v=2" file
+	path, _, _ := strings.Cut(record.PathAndQuery, "?")
+
+	slashIndex := strings.LastIndex(path, "/")
+	filename := path[(slashIndex + 1):]
 
 	if filename == "" {
 		return "Page"
@@ -149,18 +242,19 @@ func FileType(bunny BunnyLog) string {
 	}
 }
 
-func IsProbablyBot(bunny BunnyLog) bool {
-	// similar to isbot's "Bot" implementation, but skips the "does the header
-	// indicate this is a prefetch" check since we ain't got no headers
-	BotNoHeader := func() isbot.Result {
-		i := isbot.UserAgent(bunny.UserAgent)
-		if i > 0 {
-			return i
-		}
+// KnownBot is the check that doesn't need any history, see BotScorer for the
+// rest. Returns BotUserAgent, BotIpRange, or "" if neither.
+// Similar to isbot's "Bot" implementation, but skips the "does the header
+// indicate this is a prefetch" check since we ain't got no headers
+func KnownBot(record LogRecord) string {
+
+	if isbot.Is(isbot.UserAgent(record.UserAgent)) {
+		return BotUserAgent
+	}
 
-		return isbot.IPRange(fmt.Sprintf("%s", bunny.RemoteIp))
+	if isbot.Is(isbot.IPRange(record.RemoteIp)) {
+		return BotIpRange
 	}
 
-	res := BotNoHeader()
-	return isbot.Is(res)
+	return ""
 }
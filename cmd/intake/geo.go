@@ -0,0 +1,179 @@
+package intake
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// GeoInfo is whatever we could find out about where an IP is, empty if nothing
+type GeoInfo struct {
+	Region string
+	City   string
+	Asn    uint32
+}
+
+type GeoLookup interface {
+	Lookup(ip net.IP) GeoInfo
+}
+
+// the fields we want from a MaxMind-format database. City databases fill in the
+// first two, ASN databases the last, and some third party ones do all of it
+type mmdbRecord struct {
+	Subdivisions []struct {
+		Names map[string]string `maxminddb:"names"`
+	} `maxminddb:"subdivisions"`
+	City struct {
+		Names map[string]string `maxminddb:"names"`
+	} `maxminddb:"city"`
+	AutonomousSystemNumber uint32 `maxminddb:"autonomous_system_number"`
+}
+
+// GeoDatabase is a MaxMind-format database file, swapped out for the new one
+// whenever the file changes, so geoipupdate can run on a cron without a restart.
+// If the file isn't there (or isn't any good) lookups just come back empty
+type GeoDatabase struct {
+	path string
+
+	mutex    sync.RWMutex
+	reader   *maxminddb.Reader
+	modified time.Time
+}
+
+func OpenGeoDatabase(path string) *GeoDatabase {
+	database := &GeoDatabase{path: path}
+	err := database.reload()
+	if errors.Is(err, os.ErrNotExist) {
+		log.Printf("[WARN] No geo database at %v yet, skipping region, city, and ASN until there is", path)
+	} else if err != nil {
+		log.Printf("[ERROR] Could not load geo database %v, skipping region, city, and ASN until it's fixed: %v", path, err)
+	}
+	return database
+}
+
+func (g *GeoDatabase) Lookup(ip net.IP) GeoInfo {
+
+	g.mutex.RLock()
+	defer g.mutex.RUnlock()
+
+	if g.reader == nil {
+		return GeoInfo{}
+	}
+
+	var record mmdbRecord
+	err := g.reader.Lookup(ip, &record)
+	if err != nil {
+		log.Printf("[WARN] Could not look up %v in %v: %v", ip, g.path, err)
+		return GeoInfo{}
+	}
+
+	info := GeoInfo{City: record.City.Names["en"], Asn: record.AutonomousSystemNumber}
+	if len(record.Subdivisions) > 0 {
+		info.Region = record.Subdivisions[0].Names["en"]
+	}
+
+	return info
+}
+
+// Watch checks the file every so often until the context is cancelled,
+// reloading it if it's changed (or shown up for the first time)
+func (g *GeoDatabase) Watch(ctx context.Context, interval time.Duration) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+			// still not there is no news, we already said so at startup
+			err := g.reload()
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				log.Printf("[ERROR] Could not reload geo database %v, keeping the old one if any: %v", g.path, err)
+			}
+		}
+	}
+}
+
+// if it doesn't work out, whatever was loaded before stays loaded
+func (g *GeoDatabase) reload() error {
+
+	info, err := os.Stat(g.path)
+	if err != nil {
+		return err
+	}
+
+	g.mutex.RLock()
+	unchanged := info.ModTime().Equal(g.modified)
+	g.mutex.RUnlock()
+
+	if unchanged {
+		return nil
+	}
+
+	reader, err := maxminddb.Open(g.path)
+	if err != nil {
+		geoReloads.WithLabelValues("failure").Inc()
+		return err
+	}
+
+	g.mutex.Lock()
+	old := g.reader
+	g.reader = reader
+	g.modified = info.ModTime()
+	g.mutex.Unlock()
+
+	// nobody can be mid-lookup on the old one now, we had the write lock
+	if old != nil {
+		old.Close()
+	}
+
+	log.Printf("[INFO] Loaded geo database %v (%v, built %v)", g.path, reader.Metadata.DatabaseType, time.Unix(int64(reader.Metadata.BuildEpoch), 0))
+	geoReloads.WithLabelValues("success").Inc()
+
+	return nil
+}
+
+// GeoDatabases asks each database in turn, first non-empty answer wins, so a
+// city database and an ASN database can be used together
+type GeoDatabases []GeoLookup
+
+func (g GeoDatabases) Lookup(ip net.IP) GeoInfo {
+
+	info := GeoInfo{}
+
+	for _, database := range g {
+		found := database.Lookup(ip)
+		if info.Region == "" {
+			info.Region = found.Region
+		}
+		if info.City == "" {
+			info.City = found.City
+		}
+		if info.Asn == 0 {
+			info.Asn = found.Asn
+		}
+	}
+
+	return info
+}
+
+// Geo looks up the IP from the log, which has already been anonymized by zeroing
+// the last octet (or the equivalent for v6). That still lands in the same /24,
+// which is as fine grained as city level data gets anyway
+func Geo(lookup GeoLookup, record LogRecord) GeoInfo {
+
+	if lookup == nil {
+		return GeoInfo{}
+	}
+
+	ip := net.ParseIP(record.RemoteIp)
+	if ip == nil {
+		return GeoInfo{}
+	}
+
+	return lookup.Lookup(ip)
+}
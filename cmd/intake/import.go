@@ -0,0 +1,383 @@
+package intake
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"ecstatic/util"
+
+	ch "github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/spf13/cobra"
+)
+
+const (
+	importProgressInterval = 5 * time.Second
+	importSendAttempts     = 5
+)
+
+var ImportCmd = &cobra.Command{
+	Use:   "import [files...]",
+	Short: "import - loads log files (gzipped or not), skipping any already in ClickHouse",
+	Long:  "import - loads log files (gzipped or not), skipping any already in ClickHouse. Bunny, caddy, and cloudflare logs are one JSON object per line, combined logs one request per line",
+	Args:  cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+
+		log.Printf("[INFO] Getting configs from environment...")
+
+		configNames := []string{
+			"CLICKHOUSE_URL",
+			"CLICKHOUSE_DATABASE",
+		}
+
+		config, err := util.GetEnvConfigs(configNames)
+		if err != nil {
+			log.Fatalf("[ERROR] Could not parse configs from environment: %v", err)
+		}
+
+		maxRows, err := util.GetOptionalEnvInt("BATCH_MAX_ROWS", 10000)
+		if err != nil || maxRows < 1 {
+			log.Fatalf("[ERROR] Could not parse BATCH_MAX_ROWS: %v", err)
+		}
+
+		// ------------------------------------------------------------------------
+
+		log.Printf("[INFO] Creating ClickHouse DB connection...")
+
+		clickhouseConn, err := ch.Open(&ch.Options{
+			Addr: []string{config["CLICKHOUSE_URL"]},
+			Auth: ch.Auth{Database: config["CLICKHOUSE_DATABASE"]},
+		})
+		if err != nil {
+			log.Fatalf("[ERROR] Could not create clickhouse connection: %v\n", err)
+		}
+
+		defer clickhouseConn.Close()
+
+		ctx := context.Background()
+
+		// old logs won't have a salt anymore, so they come in without a visitor
+		enricher, err := enricherFromEnv(ctx, clickhouseConn)
+		if err != nil {
+			log.Fatalf("[ERROR] Could not set up enrichment: %v", err)
+		}
+
+		deadLetters, err := deadLetterSinkFromEnv(clickhouseConn)
+		if err != nil {
+			log.Fatalf("[ERROR] Could not open dead letter sink: %v", err)
+		}
+
+		defer deadLetters.Close()
+
+		decoder, err := NewDecoder(importFormat, importZoneId)
+		if err != nil {
+			log.Fatalf("[ERROR] Could not set up decoder: %v", err)
+		}
+
+		intaker := Intaker{
+			clickConn:   clickhouseConn,
+			policy:      BatchPolicy{MaxRows: maxRows},
+			enricher:    enricher,
+			deadLetters: deadLetters,
+		}
+
+		// ------------------------------------------------------------------------
+
+		// shared between files, since archives tend to overlap at the edges. Only
+		// the most recent IDs, since logs come roughly in order, and anything older
+		// has gone to clickhouse already, where importBatch checks for it
+		dedupeWindow, err := util.GetOptionalEnvInt("DEDUPE_WINDOW", 100000)
+		if err != nil || dedupeWindow < 0 {
+			log.Fatalf("[ERROR] Could not parse DEDUPE_WINDOW: %v", err)
+		}
+		seen := NewRequestIdWindow(dedupeWindow)
+		total := ImportReport{}
+
+		for _, path := range args {
+
+			log.Printf("[INFO] Importing %v...", path)
+
+			report, err := intaker.Import(ctx, path, decoder, seen)
+			total.add(report)
+
+			if err != nil {
+				log.Fatalf("[ERROR] Could not import %v, safe to rerun since anything already in is skipped: %v", path, err)
+			}
+
+			log.Printf("[INFO] Done with %v: %v", path, report)
+		}
+
+		log.Printf("[INFO] ALL DONE: %v", total)
+	},
+}
+
+var importFormat string
+var importZoneId int
+
+func init() {
+	ImportCmd.Flags().StringVar(&importFormat, "format", FormatBunny, fmt.Sprintf("format of the logs, one of %v", VALIDFORMATS))
+	ImportCmd.Flags().IntVar(&importZoneId, "zone", 0, "pull zone ID the logs are for, needed for anything but bunny logs")
+	IntakeCmd.AddCommand(ImportCmd)
+}
+
+type ImportReport struct {
+	Lines      int
+	Imported   int
+	Duplicates int
+	Failed     int
+}
+
+func (r *ImportReport) add(other ImportReport) {
+	r.Lines += other.Lines
+	r.Imported += other.Imported
+	r.Duplicates += other.Duplicates
+	r.Failed += other.Failed
+}
+
+func (r ImportReport) String() string {
+	return fmt.Sprintf("read %v lines, imported %v, skipped %v duplicates, %v failed", r.Lines, r.Imported, r.Duplicates, r.Failed)
+}
+
+// counts how far through the (maybe compressed) file we are, for progress
+type countingReader struct {
+	reader io.Reader
+	read   int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.reader.Read(p)
+	c.read += int64(n)
+	return n, err
+}
+
+// Import runs every log in the file through enrichment and into clickhouse, a
+// batch at a time, skipping request IDs seen lately or already in clickhouse
+func (i Intaker) Import(ctx context.Context, path string, decoder Decoder, seen *RequestIdWindow) (ImportReport, error) {
+
+	report := ImportReport{}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return report, err
+	}
+
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return report, err
+	}
+
+	counter := &countingReader{reader: file}
+	buffered := bufio.NewReader(counter)
+
+	// go by the magic bytes rather than the name, archives aren't always named well
+	var reader io.Reader = buffered
+	magic, _ := buffered.Peek(2)
+	if bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		gz, err := gzip.NewReader(buffered)
+		if err != nil {
+			return report, fmt.Errorf("Could not read gzip header: %w", err)
+		}
+		defer gz.Close()
+		reader = gz
+	}
+
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxFrameSize)
+
+	pending := []enrichedRow{}
+	lastProgress := time.Now()
+	// the IDs of lines without one come from this, so it should be the same
+	// whichever directory the import is run from
+	if absolute, err := filepath.Abs(path); err == nil {
+		path = absolute
+	}
+	source := "import://" + path
+
+	for scanner.Scan() {
+
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+
+		report.Lines++
+
+		// process holds on to the body for dead letters, and the scanner reuses it
+		message := SyslogMessage{Body: append([]byte{}, line...), Source: source, ReceivedAt: time.Now(), Decoder: decoder, Line: report.Lines}
+
+		row, ok := i.process(message)
+		if !ok {
+			report.Failed++
+			continue
+		}
+
+		if id := row.enriched.RequestId; id != "" && seen.Seen(id) {
+			duplicateRows.WithLabelValues("import").Inc()
+			report.Duplicates++
+			continue
+		}
+
+		pending = append(pending, row)
+
+		if len(pending) >= i.policy.MaxRows {
+			err = i.importBatch(ctx, pending, &report)
+			if err != nil {
+				return report, err
+			}
+			pending = pending[:0]
+		}
+
+		if time.Since(lastProgress) >= importProgressInterval {
+			log.Printf("[INFO] %v: %.1f%% through, %v", path, 100*float64(counter.read)/float64(max(info.Size(), 1)), report)
+			lastProgress = time.Now()
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return report, fmt.Errorf("Could not read line %v: %w", report.Lines+1, err)
+	}
+
+	if len(pending) > 0 {
+		err = i.importBatch(ctx, pending, &report)
+	}
+
+	return report, err
+}
+
+// leaves out anything clickhouse already has, then sends the rest, retrying a
+// few times since a whole import is a lot to redo over one blip
+func (i Intaker) importBatch(ctx context.Context, rows []enrichedRow, report *ImportReport) error {
+
+	existing, err := i.existingRequestIds(ctx, rows)
+	if err != nil {
+		return err
+	}
+
+	fresh := []enrichedRow{}
+	for _, row := range rows {
+		if _, ok := existing[row.enriched.RequestId]; ok {
+			duplicateRows.WithLabelValues("clickhouse").Inc()
+			report.Duplicates++
+			continue
+		}
+		fresh = append(fresh, row)
+	}
+
+	if len(fresh) == 0 {
+		return nil
+	}
+
+	wait := minReplayBackoff
+
+	for attempt := 1; ; attempt++ {
+
+		sent, rejected, err := i.sendImportBatch(ctx, fresh)
+		if err == nil {
+			for _, row := range rejected {
+				i.deadLetter(row.message, StageBatch, row.err)
+			}
+			report.Imported += sent
+			report.Failed += len(rejected)
+			return nil
+		}
+
+		if attempt == importSendAttempts {
+			return err
+		}
+
+		log.Printf("[ERROR] Could not send import batch (attempt %v of %v), retrying in %v: %v", attempt, importSendAttempts, wait, err)
+		time.Sleep(wait)
+		wait = min(wait*2, maxReplayBackoff)
+	}
+}
+
+type rejectedRow struct {
+	enrichedRow
+	err error
+}
+
+func (i Intaker) sendImportBatch(ctx context.Context, rows []enrichedRow) (int, []rejectedRow, error) {
+
+	batch, err := i.clickConn.PrepareBatch(ctx, insertAccesslog)
+	if err != nil {
+		clickhousePrepareFailures.Inc()
+		return 0, nil, err
+	}
+
+	rejected := []rejectedRow{}
+
+	for _, row := range rows {
+		err = addToBatch(batch, row.enriched)
+		if err != nil {
+			rejected = append(rejected, rejectedRow{row, err})
+		}
+	}
+
+	sent := batch.Rows()
+
+	return sent, rejected, timedSend(batch)
+}
+
+// clickhouse only takes so big a query, so the IDs are checked a chunk at a time
+const requestIdChunk = 1000
+
+// which of the rows' request IDs are already in clickhouse, looking only between
+// the oldest and newest timestamps so it doesn't have to scan the whole table
+func (i Intaker) existingRequestIds(ctx context.Context, rows []enrichedRow) (map[string]struct{}, error) {
+
+	existing := map[string]struct{}{}
+
+	ids := []string{}
+	var oldest, newest int64
+	for _, row := range rows {
+		if row.enriched.RequestId == "" {
+			continue
+		}
+		if len(ids) == 0 || row.enriched.Timestamp < oldest {
+			oldest = row.enriched.Timestamp
+		}
+		if len(ids) == 0 || row.enriched.Timestamp > newest {
+			newest = row.enriched.Timestamp
+		}
+		ids = append(ids, row.enriched.RequestId)
+	}
+
+	for start := 0; start < len(ids); start += requestIdChunk {
+
+		chunk := ids[start:min(start+requestIdChunk, len(ids))]
+
+		found, err := i.clickConn.Query(ctx,
+			"SELECT DISTINCT RequestId FROM accesslog WHERE Timestamp >= ? AND Timestamp <= ? AND RequestId IN (?)",
+			time.Unix(oldest, 0), time.Unix(newest, 0), chunk,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("Could not check for request IDs already in clickhouse: %w", err)
+		}
+
+		for found.Next() {
+			var id string
+			err = found.Scan(&id)
+			if err != nil {
+				found.Close()
+				return nil, fmt.Errorf("Could not scan request ID: %w", err)
+			}
+			existing[id] = struct{}{}
+		}
+
+		found.Close()
+		if found.Err() != nil {
+			return nil, fmt.Errorf("Could not check for request IDs already in clickhouse: %w", found.Err())
+		}
+	}
+
+	return existing, nil
+}
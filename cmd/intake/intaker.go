@@ -2,85 +2,419 @@ package intake
 
 import (
 	"context"
+	"encoding/json"
 	"log"
+	"strconv"
+	"sync"
 	"time"
 
 	ch "github.com/ClickHouse/clickhouse-go/v2/lib/driver"
 	"github.com/DmitriyVTitov/size"
 )
 
+// BatchPolicy says when a batch is big enough (or old enough) to send
+type BatchPolicy struct {
+	MaxRows  int
+	MaxBytes int
+	MaxAge   time.Duration
+}
+
+// Intaker takes messages off the buffer with a pool of workers, which parse and
+// enrich them, then a single batcher collects the rows into clickhouse batches,
+// which get handed off to a sender so that a slow insert doesn't hold up the rest
 type Intaker struct {
-	msgChannel chan []byte
-	clickConn  ch.Conn
+	clickConn ch.Conn
+	spool     *Spool
+	policy    BatchPolicy
+	workers   int
+	enricher  Enricher
+
+	// nil to believe whatever the logs say
+	senders *SenderValidator
+
+	// nil for nobody watching, e.g. imports
+	live *LiveHub
+
+	// recent request IDs, nil to leave all the deduping to clickhouse
+	requestIds *RequestIdWindow
+
+	// where logs go when we can't do anything with them
+	deadLetters DeadLetterSink
 }
 
-func (i Intaker) Consume(ctx context.Context) {
+// DrainReport is what became of the rows still in flight when Consume stopped
+type DrainReport struct {
+	Flushed int // sent to clickhouse on the way out
+	Spooled int // left on disk for the next run to replay
+	Lost    int // made it to neither, sadly
+}
 
-	ticker := time.NewTicker(2 * time.Second)
-	defer ticker.Stop()
+type enrichedRow struct {
+	enriched EnrichedLog
+	message  SyslogMessage
+}
+
+type pendingBatch struct {
+	batch     ch.Batch
+	segment   *spoolSegment
+	unspooled int // rows in the batch that couldn't be written to the segment
+}
+
+// Consume runs the whole pipeline until the stop channel is closed, at which point
+// it takes whatever is left in the buffer, flushes the final batch, waits for the
+// sender to finish up, and reports how that went
+func (i Intaker) Consume(ctx context.Context, buffer *MessageBuffer, stop <-chan struct{}) DrainReport {
+
+	rows := make(chan enrichedRow, i.policy.MaxRows)
+	sends := make(chan pendingBatch, 1)
+
+	var workers sync.WaitGroup
+	for n := 0; n < i.workers; n++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			i.work(buffer, rows, stop)
+		}()
+	}
+
+	// only the workers write rows, so once they're all done it's safe to close
+	go func() {
+		workers.Wait()
+		close(rows)
+	}()
+
+	sent := make(chan DrainReport, 1)
+	go func() {
+		sent <- i.send(sends, stop)
+	}()
 
-	batch, err := i.clickConn.PrepareBatch(ctx, "INSERT INTO accesslog")
+	report := i.batch(ctx, rows, sends)
+
+	close(sends)
+	sendReport := <-sent
+
+	report.Flushed += sendReport.Flushed
+	report.Spooled += sendReport.Spooled
+	report.Lost += sendReport.Lost
+
+	return report
+}
+
+// Spill is the overflow for a full buffer, when the policy says so
+func (i Intaker) Spill(message SyslogMessage) {
+
+	row, ok := i.process(message)
+	if !ok {
+		return
+	}
+
+	err := i.spool.Spill(row.enriched)
 	if err != nil {
-		log.Fatalf("[ERROR] Could not prepare new clickhouse batch: %v\n", err)
+		log.Printf("[ERROR] Could not spill log to spool, it is lost: %v", err)
+		return
 	}
 
+	i.requestIds.Add(row.enriched.RequestId)
+}
+
+func (i Intaker) work(buffer *MessageBuffer, rows chan<- enrichedRow, stop <-chan struct{}) {
 	for {
 		select {
-		case <-ticker.C:
-			// send the batch to CH
-			rows := batch.Rows()
-			if rows == 0 {
-				// no rows means we'll skip this one
-				continue
+		case message := <-buffer.messages:
+			bufferDepth.Set(float64(len(buffer.messages)))
+			if row, ok := i.process(message); ok {
+				rows <- row
 			}
-			err = batch.Send()
-			if err != nil {
-				log.Printf("[ERROR] Could not send batch to clickhouse: %v", err)
-				continue
+		case <-stop:
+			// the listeners are done, so whatever is left in the buffer is all there is
+			for {
+				select {
+				case message := <-buffer.messages:
+					if row, ok := i.process(message); ok {
+						rows <- row
+					}
+				default:
+					return
+				}
 			}
-			// then reset the batch
-			batch, err = i.clickConn.PrepareBatch(ctx, "INSERT INTO accesslog")
-			if err != nil {
-				log.Fatalf("[ERROR] Could not prepare new clickhouse batch: %v", err)
-				continue
+		}
+	}
+}
+
+// parses and enriches a message, returns false if it's no good
+func (i Intaker) process(message SyslogMessage) (enrichedRow, bool) {
+	if message.Decoder == nil {
+		message.Decoder = BunnyDecoder{}
+	}
+	// parse the log from whichever format it's in
+	record, err := message.Decoder.Decode(message.Body)
+	if err != nil {
+		log.Printf("[ERROR] Could not decode %v log: %v", message.Decoder.Format(), err)
+		jsonParseFailures.Inc()
+		i.deadLetter(message, StageParse, err)
+		return enrichedRow{}, false
+	}
+	// forged logs aren't worth keeping around as dead letters, just counting
+	if reason := i.senders.Check(message, record); reason != "" {
+		senderRejections.WithLabelValues(reason).Inc()
+		return enrichedRow{}, false
+	}
+	// a resend of something we only just took, not worth a dead letter either.
+	// Only marked as taken once it's in a batch or the spool, see batch
+	if record.RequestId != "" && i.requestIds.Has(record.RequestId) {
+		duplicateRows.WithLabelValues("window").Inc()
+		return enrichedRow{}, false
+	}
+	if record.RequestId == "" {
+		record.RequestId = lineRequestId(message, record.PullZoneId)
+	}
+	// do a little transformation
+	start := time.Now()
+	enriched := i.enricher.Enrich(record)
+	enrichDuration.Observe(time.Since(start).Seconds())
+
+	i.live.Publish(enriched)
+
+	zone := strconv.Itoa(enriched.PullZoneId)
+	ingestedRows.WithLabelValues(zone).Inc()
+	ingestedBytes.WithLabelValues(zone).Add(float64(len(message.Body)))
+
+	return enrichedRow{enriched, message}, true
+}
+
+// hangs on to a log we couldn't do anything with, so it can be replayed later
+func (i Intaker) deadLetter(message SyslogMessage, stage string, cause error) {
+
+	deadLetters.WithLabelValues(stage).Inc()
+
+	format, zoneId := FormatBunny, 0
+	if message.Decoder != nil {
+		format, zoneId = message.Decoder.Format(), message.Decoder.ZoneId()
+	}
+
+	err := i.deadLetters.Write(DeadLetter{message.ReceivedAt, message.Source, stage, cause.Error(), message.Body, format, zoneId})
+	if err != nil {
+		log.Printf("[ERROR] Could not write dead letter, it is lost: %v", err)
+		deadLetterFailures.Inc()
+	}
+}
+
+// collects rows into batches (mirrored in the spool) until the rows channel is
+// closed, handing each one off to the sender once it hits the batch policy
+func (i Intaker) batch(ctx context.Context, rows <-chan enrichedRow, sends chan<- pendingBatch) DrainReport {
+
+	ticker := time.NewTicker(i.policy.MaxAge)
+	defer ticker.Stop()
+
+	// nil whenever clickhouse is unreachable, in which case rows only go to the
+	// spool, and get replayed once it's back
+	batch := i.prepareBatch(ctx)
+
+	batchBytes := 0
+	unspooled := 0
+
+	// returns how many rows were left in the spool (as opposed to handed off)
+	handoff := func(final bool) int {
+
+		// everything written since the last handoff, mirroring the batch
+		segment, err := i.spool.Seal()
+		if err != nil {
+			log.Printf("[ERROR] Could not seal spool segment: %v", err)
+		}
+
+		// and anything that overflowed the buffer in the meantime
+		spooled, err := i.spool.SealSpill()
+		if err != nil {
+			log.Printf("[ERROR] Could not seal spill segment: %v", err)
+		}
+
+		if batch == nil || batch.Rows() == 0 {
+			// nothing to send, but anything that made it to disk gets replayed
+			i.spool.Defer(segment)
+			if segment != nil {
+				spooled += segment.rows
 			}
-			log.Printf("[INFO] Sent batch of %v logs to clickhouse and reset", rows)
-		case message := <-i.msgChannel:
-			// parse the log from Bunny
-			bunny, err := stringToBunnyLog(message)
-			if err != nil {
-				log.Printf("[ERROR] Could not parse log as JSON: %v", err)
+		} else if final || unspooled > 0 {
+			// no rush on the way out, so wait for the sender rather than skip it.
+			// Same when the spool couldn't take some of the rows, since the batch
+			// is the only place they are
+			sends <- pendingBatch{batch, segment, unspooled}
+			batch = nil
+		} else {
+			select {
+			case sends <- pendingBatch{batch, segment, unspooled}:
+			default:
+				// the sender is still stuck on the last one, so rather than stall the
+				// whole pipeline, leave this one for replay once clickhouse catches up
+				log.Printf("[WARN] Sender is busy, leaving batch of %v rows in spool", batch.Rows())
+				batch.Abort()
+				i.spool.Defer(segment)
+			}
+			batch = nil
+		}
+
+		batchBytes = 0
+		unspooled = 0
+
+		if batch == nil && !final {
+			batch = i.prepareBatch(ctx)
+		}
+
+		return spooled
+	}
+
+	for {
+		select {
+		case row, ok := <-rows:
+			if !ok {
+				// workers are all done, this is the last of it
+				spooled := handoff(true)
+				if batch != nil {
+					batch.Abort()
+				}
+				return DrainReport{Spooled: spooled}
+			}
+
+			// the workers only check, so two of the same can both get this far
+			if i.requestIds.Has(row.enriched.RequestId) {
+				duplicateRows.WithLabelValues("window").Inc()
 				continue
 			}
-			// do a little transformation
-			enriched := Enrich(bunny)
+
 			// then add it to the CH batch
-			err = addToBatch(batch, enriched)
+			if batch != nil {
+				err := addToBatch(batch, row.enriched)
+				if err != nil {
+					log.Printf("[ERROR] Could not add log to CH batch: %v", err)
+					i.deadLetter(row.message, StageBatch, err)
+					continue
+				}
+			}
+
+			// and write it ahead to disk, in case the batch never makes it
+			err := i.spool.Append(row.enriched)
 			if err != nil {
-				log.Printf("[ERROR] Could not add log to CH batch: %v", err)
-				continue
+				log.Printf("[ERROR] Could not write log to spool: %v", err)
+				if batch != nil {
+					unspooled++
+				}
+			}
+
+			// somewhere safe now, so a resend is a duplicate
+			if batch != nil || err == nil {
+				i.requestIds.Add(row.enriched.RequestId)
+			}
+
+			batchBytes += len(row.message.Body)
+
+			log.Printf("[INFO] Added log (size %v, measurement %v) to batch", size.Of(row.enriched), row.enriched.Host)
+
+			if batch != nil && (batch.Rows() >= i.policy.MaxRows || batchBytes >= i.policy.MaxBytes) {
+				handoff(false)
+				ticker.Reset(i.policy.MaxAge)
+			}
+		case <-ticker.C:
+			handoff(false)
+		}
+	}
+}
+
+// sends batches handed off by the batcher until the channel is closed, only
+// the ones that finish after the stop signal count towards the report
+func (i Intaker) send(sends <-chan pendingBatch, stop <-chan struct{}) DrainReport {
+
+	report := DrainReport{}
+
+	for pending := range sends {
+
+		rows := pending.batch.Rows()
+
+		spooled := 0
+		if pending.segment != nil {
+			spooled = pending.segment.rows
+		}
+
+		err := timedSend(pending.batch)
+
+		draining := false
+		select {
+		case <-stop:
+			draining = true
+		default:
+		}
+
+		if err != nil {
+			// the batch is in an undefined state now, but the rows are safe on disk
+			log.Printf("[ERROR] Could not send batch to clickhouse, leaving %v rows in spool: %v", spooled, err)
+			i.spool.Defer(pending.segment)
+			if draining {
+				report.Spooled += spooled
+				report.Lost += pending.unspooled
 			}
-			log.Printf("[INFO] Added log (size %v, measurement %v) to batch", size.Of(enriched), bunny.Host)
+			continue
+		}
+
+		i.spool.Commit(pending.segment)
+		log.Printf("[INFO] Sent batch of %v logs to clickhouse and reset", rows)
+		if draining {
+			report.Flushed += rows
+		}
+	}
+
+	return report
+}
+
+// Replay keeps sending whatever ends up deferred in the spool, until the
+// context is cancelled
+func (i Intaker) Replay(ctx context.Context) {
+	i.spool.Replay(ctx, func(rows []EnrichedLog) error {
+		return i.sendRows(ctx, rows)
+	})
+}
+
+func (i Intaker) prepareBatch(ctx context.Context) ch.Batch {
+	batch, err := i.clickConn.PrepareBatch(ctx, insertAccesslog)
+	if err != nil {
+		log.Printf("[ERROR] Could not prepare new clickhouse batch, spooling to disk only: %v", err)
+		clickhousePrepareFailures.Inc()
+		return nil
+	}
+	return batch
+}
+
+func (i Intaker) sendRows(ctx context.Context, rows []EnrichedLog) error {
+
+	batch, err := i.clickConn.PrepareBatch(ctx, insertAccesslog)
+	if err != nil {
+		clickhousePrepareFailures.Inc()
+		return err
+	}
+
+	for _, enriched := range rows {
+		err = addToBatch(batch, enriched)
+		if err != nil {
+			// this row will never fit, so don't let it hold up all the others
+			log.Printf("[ERROR] Could not add spooled log to CH batch, skipping it: %v", err)
+			raw, _ := json.Marshal(enriched)
+			i.deadLetter(SyslogMessage{Body: raw, Source: "spool", ReceivedAt: time.Now()}, StageSpool, err)
 		}
 	}
+
+	return timedSend(batch)
 }
 
-func addToBatch(batch ch.Batch, enriched EnrichedLog) error {
-	// must match the order in the schema exactly
-	return batch.Append(
-		enriched.PullZoneId,
-		enriched.Timestamp,
-		enriched.BytesSent,
-		enriched.StatusCode,
-		enriched.StatusCategory,
-		enriched.Host,
-		enriched.Path,
-		enriched.Referrer,
-		enriched.Device,
-		enriched.Browser,
-		enriched.Os,
-		enriched.Country,
-		enriched.FileType,
-		enriched.IsProbablyBot,
-	)
+// sends the batch, keeping track of how long it took and whether it worked
+func timedSend(batch ch.Batch) error {
+
+	batchSize.Observe(float64(batch.Rows()))
+
+	start := time.Now()
+	err := batch.Send()
+	clickhouseSendDuration.Observe(time.Since(start).Seconds())
+
+	if err != nil {
+		clickhouseSendFailures.Inc()
+	}
+
+	return err
 }
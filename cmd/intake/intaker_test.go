@@ -0,0 +1,130 @@
+package intake
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	ch "github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+	"github.com/stretchr/testify/assert"
+)
+
+// just enough of a clickhouse connection to hand out batches
+type mockConn struct {
+	ch.Conn
+	failAppends bool
+}
+
+func (c mockConn) PrepareBatch(ctx context.Context, query string, opts ...ch.PrepareBatchOption) (ch.Batch, error) {
+	return &mockBatch{failAppends: c.failAppends}, nil
+}
+
+type mockBatch struct {
+	ch.Batch
+	failAppends bool
+	rows        int
+	aborted     bool
+}
+
+func (b *mockBatch) AppendStruct(v any) error {
+	if b.failAppends {
+		return assert.AnError
+	}
+	b.rows++
+	return nil
+}
+
+func (b *mockBatch) Rows() int {
+	return b.rows
+}
+
+func (b *mockBatch) Abort() error {
+	b.aborted = true
+	return nil
+}
+
+func TestBatchWaitsForBusySenderWhenSpoolFails(t *testing.T) {
+
+	dir := t.TempDir()
+	spool, err := OpenSpool(dir, 1024*1024)
+	assert.Nil(t, err)
+
+	// nowhere to write segments to
+	assert.Nil(t, os.RemoveAll(dir))
+
+	intaker := Intaker{
+		clickConn: mockConn{},
+		spool:     spool,
+		policy:    BatchPolicy{MaxRows: 2, MaxBytes: 1024 * 1024, MaxAge: time.Hour},
+	}
+
+	rows := make(chan enrichedRow)
+	// nobody receiving yet, so the sender looks busy
+	sends := make(chan pendingBatch)
+	done := make(chan struct{})
+
+	go func() {
+		intaker.batch(context.Background(), rows, sends)
+		close(done)
+	}()
+
+	rows <- enrichedRow{enriched: EnrichedLog{PullZoneId: 1234}}
+	rows <- enrichedRow{enriched: EnrichedLog{PullZoneId: 1234}}
+
+	time.Sleep(50 * time.Millisecond)
+
+	// the batch is all there is of those rows, so it has to wait for the sender
+	select {
+	case pending := <-sends:
+		assert.Equal(t, 2, pending.batch.Rows())
+		assert.Equal(t, 2, pending.unspooled)
+		assert.False(t, pending.batch.(*mockBatch).aborted)
+	case <-time.After(time.Second):
+		t.Fatal("batch of unspooled rows was never handed off")
+	}
+
+	close(rows)
+	<-done
+}
+
+func TestBatchMarksRequestIdsOnceStored(t *testing.T) {
+
+	bunny := SyslogMessage{Body: []byte(`{"PullZoneId":1234,"Status":200,"Timestamp":1507167062421,"RequestId":"abc","PathAndQuery":"/"}`)}
+
+	for _, failAppends := range []bool{false, true} {
+
+		spool, err := OpenSpool(t.TempDir(), 1024*1024)
+		assert.Nil(t, err)
+
+		intaker := Intaker{
+			clickConn:   mockConn{failAppends: failAppends},
+			spool:       spool,
+			policy:      BatchPolicy{MaxRows: 100, MaxBytes: 1024 * 1024, MaxAge: time.Hour},
+			enricher:    testEnricher(),
+			requestIds:  NewRequestIdWindow(10),
+			deadLetters: NoDeadLetters{},
+		}
+
+		row, ok := intaker.process(bunny)
+		assert.True(t, ok)
+
+		rows := make(chan enrichedRow, 2)
+		rows <- row
+		// a second copy that got past the workers at the same time
+		rows <- row
+		close(rows)
+
+		sends := make(chan pendingBatch, 1)
+		intaker.batch(context.Background(), rows, sends)
+
+		// only the first copy made it into the batch
+		if !failAppends {
+			assert.Equal(t, 1, (<-sends).batch.Rows())
+		}
+
+		// a dead letter is no reason to turn away a resend
+		_, ok = intaker.process(bunny)
+		assert.Equal(t, failAppends, ok, "failAppends %v", failAppends)
+	}
+}
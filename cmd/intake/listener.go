@@ -1,70 +1,213 @@
 package intake
 
 import (
-	"bufio"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"log"
 	"net"
+	"os"
+	"sync"
+	"time"
 )
 
+// Shutdowner is anything feeding the message buffer, which needs to be told to
+// stop before the buffer can be drained
+type Shutdowner interface {
+	Shutdown(deadline time.Time) error
+}
+
+// Listener takes syslog over a stream, either plain TCP or, if it has a TLS
+// config, over TLS per RFC 5425 (which uses the same octet-counted framing)
 type Listener struct {
-	port    string
-	msgChan chan []byte
+	port      string
+	buffer    *MessageBuffer
+	tlsConfig *tls.Config
+	decoder   Decoder
+	allowlist *IpAllowlist // nil to let anyone in
+
+	mutex    sync.Mutex
+	listener net.Listener
+	conns    map[net.Conn]struct{}
+	closed   bool
+	readers  sync.WaitGroup
 }
 
-func (l Listener) Listen() {
+func (l *Listener) Listen() {
+
+	var listen net.Listener
+	var err error
+
+	if l.tlsConfig != nil {
+		listen, err = tls.Listen("tcp", fmt.Sprintf(":%v", l.port), l.tlsConfig)
+	} else {
+		listen, err = net.Listen("tcp", fmt.Sprintf(":%v", l.port))
+	}
 
-	listen, err := net.Listen("tcp", fmt.Sprintf(":%v", l.port))
 	if err != nil {
 		log.Printf("[ERROR] Could not listen on port %v: %v", l.port, err)
+		return
 	}
 
-	defer listen.Close()
+	l.mutex.Lock()
+	if l.closed {
+		// shut down before we even got going
+		l.mutex.Unlock()
+		listen.Close()
+		return
+	}
+	l.listener = listen
+	l.conns = map[net.Conn]struct{}{}
+	l.mutex.Unlock()
 
 	for {
 
 		conn, err := listen.Accept()
-		if err != nil {
+		if errors.Is(err, net.ErrClosed) {
+			return
+		} else if err != nil {
 			log.Printf("[ERROR] Could not accept incoming connection: %v", err)
+			continue
+		}
+
+		if !l.allowlist.Allows(conn.RemoteAddr()) {
+			log.Printf("[WARN] Refusing connection from %v, not on the allowlist", conn.RemoteAddr())
+			senderRejections.WithLabelValues(RejectIp).Inc()
+			conn.Close()
+			continue
 		}
 
 		log.Printf("[INFO] Got new connection from %v", conn.RemoteAddr())
+		connectionsAccepted.WithLabelValues(l.transport()).Inc()
+
+		l.mutex.Lock()
+		if l.closed {
+			l.mutex.Unlock()
+			conn.Close()
+			return
+		}
+		l.conns[conn] = struct{}{}
+		l.readers.Add(1)
+		l.mutex.Unlock()
 
 		// Handle the connection in a new goroutine.
 		// The loop then returns to accepting, so that
 		// multiple connections may be served concurrently.
-		go readFromConnection(conn, l.msgChan)
+		go l.readFromConnection(conn)
 	}
 }
 
-func readFromConnection(conn net.Conn, msgChan chan []byte) {
+// Shutdown stops accepting connections, gives the open ones a second to finish
+// whatever frame they're in the middle of, then waits (until the deadline) for
+// every reader to hand off its last message
+func (l *Listener) Shutdown(deadline time.Time) error {
 
-	reader := bufio.NewReader(conn)
+	readDeadline := time.Now().Add(1 * time.Second)
+	if readDeadline.After(deadline) {
+		readDeadline = deadline
+	}
 
-	// note -- we don't call conn.Read() below!
-	// that blocks until it gets an EOF, which bunny CDN never sends
-	// (it leaves the conn open to use for more access logs)
-	// that's why we deliberately scan for braces here
-	for {
+	l.mutex.Lock()
+	l.closed = true
+	if l.listener != nil {
+		l.listener.Close()
+	}
+	for conn := range l.conns {
+		conn.SetReadDeadline(readDeadline)
+	}
+	l.mutex.Unlock()
 
-		// throw away the "headers" of the syslog entry, which we don't care about
-		_, err := reader.ReadSlice(byte('{'))
+	return waitUntil(&l.readers, deadline)
+}
+
+func (l *Listener) readFromConnection(conn net.Conn) {
+
+	defer func() {
+		conn.Close()
+		connectionsClosed.WithLabelValues(l.transport()).Inc()
+		l.mutex.Lock()
+		delete(l.conns, conn)
+		l.mutex.Unlock()
+		l.readers.Done()
+	}()
+
+	// handshake up front rather than on the first read, so a sender without a valid
+	// client cert (or one that just connects and sits there) gets dropped quickly
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		tlsConn.SetDeadline(time.Now().Add(10 * time.Second))
+		err := tlsConn.Handshake()
 		if err != nil {
-			log.Printf("[ERROR] Could not read bytes from TCP connection: %v", err)
-			break
+			log.Printf("[ERROR] TLS handshake with %v failed: %v", conn.RemoteAddr(), err)
+			return
+		}
+		tlsConn.SetDeadline(time.Time{})
+	}
+
+	reader := NewSyslogReader(conn)
+
+	// bunny never closes the connection, it leaves it open to use for more access
+	// logs, so we just keep pulling frames off of it until something breaks
+	for {
+
+		message, err := reader.Next()
+
+		var frameErr *FrameError
+		if errors.As(err, &frameErr) {
+			// the reader has already skipped past the bad frame, so carry on
+			log.Printf("[WARN] Skipping syslog frame from %v: %v", conn.RemoteAddr(), err)
+			framesParsed.WithLabelValues(l.transport(), "malformed").Inc()
+			continue
+		}
+
+		if errors.Is(err, os.ErrDeadlineExceeded) && l.isClosed() {
+			log.Printf("[INFO] Stopped reading from %v for shutdown", conn.RemoteAddr())
+			return
 		}
 
-		// parse out the JSON blob in the body of the entry, SUPER niavely
-		jsonString, err := reader.ReadSlice(byte('}'))
 		if err != nil {
 			log.Printf("[ERROR] Could not read bytes from TCP connection: %v", err)
 			break
 		}
 
-		jsonString = append([]byte{'{'}, jsonString...)
-		msgChan <- jsonString
+		framesParsed.WithLabelValues(l.transport(), "ok").Inc()
+		lastMessageTime.SetToCurrentTime()
+
+		message.Source = fmt.Sprintf("%v://%v", l.transport(), conn.RemoteAddr())
+		message.ReceivedAt = time.Now()
+		message.Decoder = l.decoder
+
+		l.buffer.Push(message)
 	}
 
-	conn.Close()
 	log.Printf("[INFO] Closed the TCP connection due to the above")
 }
+
+func (l *Listener) transport() string {
+	if l.tlsConfig != nil {
+		return "tls"
+	}
+	return "tcp"
+}
+
+func (l *Listener) isClosed() bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.closed
+}
+
+// waits for the group, but gives up at the deadline
+func waitUntil(group *sync.WaitGroup, deadline time.Time) error {
+
+	done := make(chan struct{})
+	go func() {
+		group.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-time.After(time.Until(deadline)):
+		return fmt.Errorf("Timed out waiting for readers to finish")
+	}
+}
@@ -0,0 +1,277 @@
+package intake
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// how recently a visitor has to have done something to count as active
+	liveActiveWindow = 5 * time.Minute
+	// how often the active visitor count goes out to subscribers
+	liveCountInterval = 5 * time.Second
+	// pageviews a subscriber can fall behind by before it starts missing some
+	liveSubscriberBuffer = 256
+)
+
+// LivePageview is what subscribers get for each pageview, just enough for a
+// "right now" view, nothing that could pick a visitor out
+type LivePageview struct {
+	Timestamp      int64
+	Path           string
+	ReferrerSource string
+	Country        string
+	Region         string
+	City           string
+	Device         string
+	Browser        string
+	Os             string
+}
+
+// LiveHub fans logs out to whoever is watching their zone, entirely in memory,
+// so live views cost nothing in clickhouse. It also keeps track of who's been
+// active lately in every zone, whether anyone's watching or not, so a new
+// subscriber gets the right count from the start
+type LiveHub struct {
+	mutex       sync.Mutex
+	subscribers map[int]map[chan LivePageview]struct{}
+	active      map[int]map[uint64]time.Time
+	closed      bool
+	now         func() time.Time
+}
+
+func NewLiveHub() *LiveHub {
+	return &LiveHub{
+		subscribers: map[int]map[chan LivePageview]struct{}{},
+		active:      map[int]map[uint64]time.Time{},
+		now:         time.Now,
+	}
+}
+
+// Publish is safe to call on a nil hub, which does nothing (say, for imports)
+func (h *LiveHub) Publish(enriched EnrichedLog) {
+
+	// bots aren't visitors, and nobody wants to watch them
+	if h == nil || enriched.IsProbablyBot {
+		return
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	// going by when we got it rather than the log's own time, since "right now"
+	// is about now, and logs only ever show up a few seconds late anyway
+	if enriched.VisitorId != 0 {
+		if h.active[enriched.PullZoneId] == nil {
+			h.active[enriched.PullZoneId] = map[uint64]time.Time{}
+		}
+		h.active[enriched.PullZoneId][enriched.VisitorId] = h.now()
+	}
+
+	if enriched.FileType != "Page" || len(h.subscribers[enriched.PullZoneId]) == 0 {
+		return
+	}
+
+	pageview := LivePageview{
+		Timestamp:      enriched.Timestamp,
+		Path:           enriched.Path,
+		ReferrerSource: enriched.ReferrerSource,
+		Country:        enriched.Country,
+		Region:         enriched.Region,
+		City:           enriched.City,
+		Device:         enriched.Device,
+		Browser:        enriched.Browser,
+		Os:             enriched.Os,
+	}
+
+	for subscriber := range h.subscribers[enriched.PullZoneId] {
+		// never hold up intake for a slow subscriber, they just miss out
+		select {
+		case subscriber <- pageview:
+		default:
+			liveDropped.Inc()
+		}
+	}
+}
+
+// Subscribe returns the channel the zone's pageviews go to, which gets closed
+// when the hub does. Unsubscribe once done with it
+func (h *LiveHub) Subscribe(zoneId int) chan LivePageview {
+
+	subscriber := make(chan LivePageview, liveSubscriberBuffer)
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if h.closed {
+		close(subscriber)
+		return subscriber
+	}
+
+	if h.subscribers[zoneId] == nil {
+		h.subscribers[zoneId] = map[chan LivePageview]struct{}{}
+	}
+	h.subscribers[zoneId][subscriber] = struct{}{}
+
+	liveSubscribers.Inc()
+
+	return subscriber
+}
+
+func (h *LiveHub) Unsubscribe(zoneId int, subscriber chan LivePageview) {
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if _, ok := h.subscribers[zoneId][subscriber]; !ok {
+		// already gone, because the hub closed
+		return
+	}
+
+	delete(h.subscribers[zoneId], subscriber)
+	if len(h.subscribers[zoneId]) == 0 {
+		delete(h.subscribers, zoneId)
+	}
+
+	close(subscriber)
+	liveSubscribers.Dec()
+}
+
+// ActiveVisitors is how many visitors did anything in the zone lately
+func (h *LiveHub) ActiveVisitors(zoneId int) int {
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.prune(zoneId)
+
+	return len(h.active[zoneId])
+}
+
+// Watch forgets visitors every so often until the context is cancelled, since
+// zones without anyone watching would otherwise never be pruned
+func (h *LiveHub) Watch(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Minute):
+			h.mutex.Lock()
+			for zoneId := range h.active {
+				h.prune(zoneId)
+			}
+			h.mutex.Unlock()
+		}
+	}
+}
+
+// must hold the mutex
+func (h *LiveHub) prune(zoneId int) {
+
+	cutoff := h.now().Add(-liveActiveWindow)
+
+	for visitorId, seen := range h.active[zoneId] {
+		if seen.Before(cutoff) {
+			delete(h.active[zoneId], visitorId)
+		}
+	}
+
+	if len(h.active[zoneId]) == 0 {
+		delete(h.active, zoneId)
+	}
+}
+
+// Close ends every subscription, so the streams can finish and the server
+// can shut down, streams otherwise being open for as long as anyone likes
+func (h *LiveHub) Close() {
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.closed = true
+
+	for zoneId, subscribers := range h.subscribers {
+		for subscriber := range subscribers {
+			close(subscriber)
+			liveSubscribers.Dec()
+		}
+		delete(h.subscribers, zoneId)
+	}
+}
+
+// HandleLive streams the zone's pageviews and active visitor count as
+// server-sent events, "pageview" with a LivePageview, and "visitors" with
+// {"Active": n}, the latter straight away and then every few seconds. The zone
+// has already been checked against the JWT by CheckZoneIdMiddleware
+func (h *LiveHub) HandleLive(out http.ResponseWriter, req *http.Request) {
+
+	zoneId, err := strconv.Atoi(req.URL.Query().Get("zoneid"))
+	if err != nil {
+		http.Error(out, "Query param 'zoneid' could not be parsed as int, quitting", http.StatusBadRequest)
+		return
+	}
+
+	flusher, ok := out.(http.Flusher)
+	if !ok {
+		http.Error(out, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	subscriber := h.Subscribe(zoneId)
+	defer h.Unsubscribe(zoneId, subscriber)
+
+	out.Header().Set("Content-Type", "text/event-stream")
+	out.Header().Set("Cache-Control", "no-cache")
+	// otherwise nginx and friends hold on to events until they have a bunch
+	out.Header().Set("X-Accel-Buffering", "no")
+	out.WriteHeader(http.StatusOK)
+
+	send := func(event string, data any) bool {
+		encoded, err := json.Marshal(data)
+		if err != nil {
+			log.Printf("[ERROR] Could not serialize live %v event: %v", event, err)
+			return true
+		}
+		_, err = fmt.Fprintf(out, "event: %s\ndata: %s\n\n", event, encoded)
+		if err != nil {
+			return false
+		}
+		flusher.Flush()
+		return true
+	}
+
+	if !send("visitors", map[string]int{"Active": h.ActiveVisitors(zoneId)}) {
+		return
+	}
+
+	ticker := time.NewTicker(liveCountInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+
+		case <-req.Context().Done():
+			return
+
+		case pageview, ok := <-subscriber:
+			if !ok {
+				// shutting down
+				return
+			}
+			if !send("pageview", pageview) {
+				return
+			}
+
+		case <-ticker.C:
+			if !send("visitors", map[string]int{"Active": h.ActiveVisitors(zoneId)}) {
+				return
+			}
+		}
+	}
+}
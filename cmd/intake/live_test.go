@@ -0,0 +1,82 @@
+package intake
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLiveHub(t *testing.T) {
+
+	now := time.Unix(1700000000, 0)
+	hub := NewLiveHub()
+	hub.now = func() time.Time { return now }
+
+	subscriber := hub.Subscribe(1234)
+
+	hub.Publish(EnrichedLog{PullZoneId: 1234, VisitorId: 1, FileType: "Page", Path: "/"})
+	hub.Publish(EnrichedLog{PullZoneId: 1234, VisitorId: 1, FileType: "Image", Path: "/a.png"})
+	hub.Publish(EnrichedLog{PullZoneId: 1234, VisitorId: 2, FileType: "Page", Path: "/bot", IsProbablyBot: true})
+	hub.Publish(EnrichedLog{PullZoneId: 5678, VisitorId: 3, FileType: "Page", Path: "/other"})
+
+	// only the one pageview, from a person, for this zone
+	assert.Equal(t, "/", (<-subscriber).Path)
+	assert.Empty(t, subscriber)
+
+	assert.Equal(t, 1, hub.ActiveVisitors(1234))
+	assert.Equal(t, 1, hub.ActiveVisitors(5678))
+
+	now = now.Add(liveActiveWindow + time.Second)
+	assert.Equal(t, 0, hub.ActiveVisitors(1234))
+
+	hub.Unsubscribe(1234, subscriber)
+	_, open := <-subscriber
+	assert.False(t, open)
+
+	// nobody watching, nothing to do
+	var none *LiveHub
+	none.Publish(EnrichedLog{PullZoneId: 1234, FileType: "Page"})
+}
+
+func TestHandleLive(t *testing.T) {
+
+	hub := NewLiveHub()
+	server := httptest.NewServer(http.HandlerFunc(hub.HandleLive))
+	defer server.Close()
+
+	hub.Publish(EnrichedLog{PullZoneId: 1234, VisitorId: 1, FileType: "Image"})
+
+	resp, err := http.Get(server.URL + "?zoneid=1234")
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	reader := bufio.NewReader(resp.Body)
+	readEvent := func() string {
+		event := []string{}
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil || line == "\n" {
+				return strings.Join(event, "")
+			}
+			event = append(event, line)
+		}
+	}
+
+	assert.Equal(t, "event: visitors\ndata: {\"Active\":1}\n", readEvent())
+
+	hub.Publish(EnrichedLog{PullZoneId: 1234, VisitorId: 2, FileType: "Page", Path: "/about", Country: "DE"})
+	event := readEvent()
+	assert.True(t, strings.HasPrefix(event, "event: pageview\n"), event)
+	assert.Contains(t, event, `"Path":"/about"`)
+
+	// and the stream ends when the hub closes
+	hub.Close()
+	assert.Equal(t, "", readEvent())
+}
@@ -0,0 +1,144 @@
+package intake
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var spoolSegments = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "ecstatic_intake_spool_segments",
+	Help: "Number of spool segments on disk that have not made it to clickhouse yet",
+})
+
+var spoolBytes = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "ecstatic_intake_spool_bytes",
+	Help: "Total size of all spool segments on disk",
+})
+
+var spoolRows = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "ecstatic_intake_spool_rows",
+	Help: "Number of rows in spool segments waiting to be replayed to clickhouse",
+})
+
+var spoolReplayedRows = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "ecstatic_intake_spool_replayed_rows_total",
+	Help: "Rows replayed from the spool to clickhouse after a failed send",
+})
+
+var spoolDroppedRows = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "ecstatic_intake_spool_dropped_rows_total",
+	Help: "Rows thrown away because the spool hit its size limit",
+})
+
+var connectionsAccepted = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "ecstatic_intake_connections_accepted_total",
+	Help: "Syslog stream connections accepted, by transport",
+}, []string{"transport"})
+
+var connectionsClosed = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "ecstatic_intake_connections_closed_total",
+	Help: "Syslog stream connections closed, by transport",
+}, []string{"transport"})
+
+var framesParsed = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "ecstatic_intake_frames_total",
+	Help: "Syslog frames read, by transport and whether they parsed (ok) or not (malformed)",
+}, []string{"transport", "result"})
+
+var lastMessageTime = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "ecstatic_intake_last_message_timestamp_seconds",
+	Help: "Unix time of the last syslog message we received, for alerting when logs stop flowing",
+})
+
+var jsonParseFailures = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "ecstatic_intake_json_parse_failures_total",
+	Help: "Log bodies that could not be decoded, in whatever format their listener expects",
+})
+
+var enrichDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+	Name:    "ecstatic_intake_enrich_duration_seconds",
+	Help:    "Time taken to enrich a single log",
+	Buckets: prometheus.ExponentialBuckets(0.00001, 4, 8),
+})
+
+var ingestedRows = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "ecstatic_intake_ingested_rows_total",
+	Help: "Logs enriched and queued for clickhouse, by pull zone",
+}, []string{"zone"})
+
+var ingestedBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "ecstatic_intake_ingested_bytes_total",
+	Help: "Size of the raw log bodies enriched and queued for clickhouse, by pull zone",
+}, []string{"zone"})
+
+var batchSize = promauto.NewHistogram(prometheus.HistogramOpts{
+	Name:    "ecstatic_intake_batch_rows",
+	Help:    "Number of rows in each batch sent to clickhouse",
+	Buckets: prometheus.ExponentialBuckets(1, 4, 9),
+})
+
+var clickhouseSendDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+	Name:    "ecstatic_intake_clickhouse_send_duration_seconds",
+	Help:    "Time taken to send a batch to clickhouse, successful or not",
+	Buckets: prometheus.DefBuckets,
+})
+
+var clickhouseSendFailures = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "ecstatic_intake_clickhouse_send_failures_total",
+	Help: "Batches (live or replayed from the spool) that clickhouse did not accept",
+})
+
+var clickhousePrepareFailures = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "ecstatic_intake_clickhouse_prepare_failures_total",
+	Help: "Times we could not even start a batch, usually meaning clickhouse is down",
+})
+
+var bufferDepth = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "ecstatic_intake_buffer_depth",
+	Help: "Messages waiting in the buffer between the listeners and the workers",
+})
+
+var bufferOverflows = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "ecstatic_intake_buffer_overflows_total",
+	Help: "Messages that arrived to a full buffer, by what the overflow policy did about it",
+}, []string{"policy"})
+
+var deadLetters = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "ecstatic_intake_dead_letters_total",
+	Help: "Logs given up on and sent to the dead letter sink, by the stage they failed at",
+}, []string{"stage"})
+
+var deadLetterFailures = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "ecstatic_intake_dead_letter_failures_total",
+	Help: "Dead letters that could not be written to the sink either, and are gone for good",
+})
+
+var geoReloads = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "ecstatic_intake_geo_reloads_total",
+	Help: "Times a changed geo database file was loaded, by whether it worked",
+}, []string{"result"})
+
+var pushRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "ecstatic_intake_push_requests_total",
+	Help: "Batches POSTed to the push endpoint, by whether they were accepted or why not",
+}, []string{"result"})
+
+var senderRejections = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "ecstatic_intake_sender_rejections_total",
+	Help: "Connections (for ip) or logs (for the rest) from senders we don't believe, by reason",
+}, []string{"reason"})
+
+var liveSubscribers = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "ecstatic_intake_live_subscribers",
+	Help: "Live streams currently open, across all zones",
+})
+
+var liveDropped = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "ecstatic_intake_live_dropped_total",
+	Help: "Pageviews a live stream missed because it wasn't keeping up",
+})
+
+var duplicateRows = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "ecstatic_intake_duplicate_rows_total",
+	Help: "Logs dropped as duplicates, by where the original was found: the recent request ID window, earlier in the same import, or already in clickhouse",
+}, []string{"where"})
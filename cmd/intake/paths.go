@@ -0,0 +1,54 @@
+package intake
+
+import (
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// NormalizePath splits the query string off, and collapses the different ways
+// of asking for the same page, so /about, /about/, /about/index.html, and
+// /about?x=1 all come out as /about. Any of the kept params that are there get
+// tacked back on, sorted so their order doesn't matter either
+func NormalizePath(pathAndQuery string, keep []string) (string, string) {
+
+	path, rawQuery, _ := strings.Cut(pathAndQuery, "?")
+
+	// never sent to the server by browsers, but some clients aren't browsers
+	path, _, _ = strings.Cut(path, "#")
+	rawQuery, _, _ = strings.Cut(rawQuery, "#")
+
+	slash := strings.LastIndex(path, "/")
+	switch path[slash+1:] {
+	case "index.html", "index.htm", "index.php":
+		path = path[:slash+1]
+	}
+
+	path = strings.TrimRight(path, "/")
+	if path == "" {
+		path = "/"
+	}
+
+	if len(keep) == 0 || rawQuery == "" {
+		return path, rawQuery
+	}
+
+	// even on error, ParseQuery keeps whatever it could parse, good enough here
+	params, _ := url.ParseQuery(rawQuery)
+
+	kept := url.Values{}
+	for _, name := range keep {
+		if values, ok := params[name]; ok {
+			sorted := append([]string{}, values...)
+			sort.Strings(sorted)
+			kept[name] = sorted
+		}
+	}
+
+	if len(kept) == 0 {
+		return path, rawQuery
+	}
+
+	// Encode sorts by key
+	return path + "?" + kept.Encode(), rawQuery
+}
@@ -0,0 +1,224 @@
+package intake
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// even gzipped, anything bigger than this isn't a batch of access logs
+const maxPushBytes = 32 * 1024 * 1024
+
+// PushToken is one entry in the PUSH_TOKENS_PATH file, a JSON list of these.
+// Only the hash of the token is kept, so the file is no use to anyone who reads it
+type PushToken struct {
+	TokenSha256 string `json:"TokenSha256"`
+	ZoneId      int    `json:"ZoneId"`
+	Format      string `json:"Format"`
+}
+
+// LoadPushTokens reads the tokens file, returning the decoder for each token's
+// logs, by hex-encoded SHA-256 of the token
+func LoadPushTokens(path string) (map[string]Decoder, error) {
+
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read push tokens %v: %w", path, err)
+	}
+
+	tokens := []PushToken{}
+
+	err = json.Unmarshal(raw, &tokens)
+	if err != nil {
+		return nil, fmt.Errorf("Could not parse push tokens %v: %w", path, err)
+	}
+
+	decoders := map[string]Decoder{}
+
+	for _, token := range tokens {
+
+		// every token is for exactly one zone, even for bunny logs, which would
+		// otherwise take whatever zone the sender says
+		if token.ZoneId < 1 {
+			return nil, fmt.Errorf("Push token for format %s has no zone", token.Format)
+		}
+
+		decoder, err := NewDecoder(token.Format, token.ZoneId)
+		if err != nil {
+			return nil, fmt.Errorf("Push token for zone %v: %w", token.ZoneId, err)
+		}
+
+		decoders[strings.ToLower(token.TokenSha256)] = decoder
+	}
+
+	return decoders, nil
+}
+
+// tokens are only ever stored hashed, hex-encoded SHA-256
+func hashToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+// PushServer takes batches of logs, one per line, gzipped or not, POSTed by
+// anything that can't do syslog, with "Authorization: Bearer <token>"
+type PushServer struct {
+	buffer   *MessageBuffer
+	decoders map[string]Decoder
+	server   *http.Server
+}
+
+func NewPushServer(port string, buffer *MessageBuffer, decoders map[string]Decoder, tlsConfig *tls.Config) *PushServer {
+
+	push := &PushServer{buffer: buffer, decoders: decoders}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/push", push.HandlePush)
+
+	push.server = &http.Server{
+		Addr:              fmt.Sprintf(":%v", port),
+		Handler:           mux,
+		TLSConfig:         tlsConfig,
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       time.Minute,
+	}
+
+	return push
+}
+
+func (p *PushServer) Listen() {
+
+	var err error
+	if p.server.TLSConfig != nil {
+		// the cert is already in the config
+		err = p.server.ListenAndServeTLS("", "")
+	} else {
+		err = p.server.ListenAndServe()
+	}
+
+	if err != nil && err != http.ErrServerClosed {
+		log.Fatalf("[ERROR] Push server could not start: %v", err)
+	}
+}
+
+// Shutdown stops taking new requests, and waits (until the deadline) for the
+// ones in flight to finish handing their logs to the buffer
+func (p *PushServer) Shutdown(deadline time.Time) error {
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	return p.server.Shutdown(ctx)
+}
+
+func (p *PushServer) HandlePush(out http.ResponseWriter, req *http.Request) {
+
+	if req.Method != http.MethodPost {
+		out.Header().Set("Allow", http.MethodPost)
+		p.fail(out, http.StatusMethodNotAllowed, "method", "Only POST is allowed")
+		return
+	}
+
+	token, found := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if !found || token == "" {
+		p.fail(out, http.StatusUnauthorized, "unauthorized", "Missing bearer token")
+		return
+	}
+
+	decoder, ok := p.decoders[hashToken(token)]
+	if !ok {
+		p.fail(out, http.StatusUnauthorized, "unauthorized", "Unknown token")
+		return
+	}
+
+	messages, err := p.readBatch(req, decoder)
+	if err != nil {
+		var tooBig *http.MaxBytesError
+		if errors.As(err, &tooBig) {
+			p.fail(out, http.StatusRequestEntityTooLarge, "too_large", fmt.Sprintf("Batch is over %v bytes", maxPushBytes))
+			return
+		}
+		p.fail(out, http.StatusBadRequest, "bad_request", fmt.Sprintf("Could not read batch: %v", err))
+		return
+	}
+
+	// it would never fit, so no point having them retry
+	if len(messages) > cap(p.buffer.messages) {
+		p.fail(out, http.StatusRequestEntityTooLarge, "too_large", fmt.Sprintf("Batch is over %v lines", cap(p.buffer.messages)))
+		return
+	}
+
+	if !p.buffer.TryPushAll(messages) {
+		out.Header().Set("Retry-After", "1")
+		p.fail(out, http.StatusTooManyRequests, "throttled", "Buffer is full, try again shortly")
+		return
+	}
+
+	framesParsed.WithLabelValues("http", "ok").Add(float64(len(messages)))
+	pushRequests.WithLabelValues("accepted").Inc()
+	lastMessageTime.SetToCurrentTime()
+
+	// these are only queued, so any that don't decode end up as dead letters
+	out.Header().Set("Content-Type", "application/json")
+	out.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(out).Encode(map[string]int{"Accepted": len(messages)})
+}
+
+func (p *PushServer) fail(out http.ResponseWriter, status int, reason string, message string) {
+	pushRequests.WithLabelValues(reason).Inc()
+	http.Error(out, message, status)
+}
+
+// reads the whole batch before queueing any of it, so it's all or nothing
+func (p *PushServer) readBatch(req *http.Request, decoder Decoder) ([]SyslogMessage, error) {
+
+	body := bufio.NewReader(http.MaxBytesReader(nil, req.Body, maxPushBytes))
+
+	// go by the magic bytes too, not every shipper sets Content-Encoding
+	var reader io.Reader = body
+	magic, _ := body.Peek(2)
+	if req.Header.Get("Content-Encoding") == "gzip" || bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		// and the same limit again, so a zip bomb can't eat all our memory
+		reader = http.MaxBytesReader(nil, io.NopCloser(gz), maxPushBytes)
+	}
+
+	// like the listeners, how it came in and from where
+	scheme := "http"
+	if req.TLS != nil {
+		scheme = "https"
+	}
+	source := scheme + "://" + req.RemoteAddr
+	receivedAt := time.Now()
+
+	messages := []SyslogMessage{}
+
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxFrameSize)
+
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		body := append([]byte{}, line...)
+		messages = append(messages, SyslogMessage{Body: body, Source: source, ReceivedAt: receivedAt, Decoder: decoder, Authenticated: true})
+	}
+
+	return messages, scanner.Err()
+}
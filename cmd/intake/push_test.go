@@ -0,0 +1,85 @@
+package intake
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testPushServer(size int) (*PushServer, *MessageBuffer) {
+	buffer, _ := NewMessageBuffer(size, OverflowBlock, nil)
+	hash := sha256.Sum256([]byte("s3cret"))
+	decoders := map[string]Decoder{hex.EncodeToString(hash[:]): CaddyDecoder{1234}}
+	return NewPushServer("0", buffer, decoders, nil), buffer
+}
+
+func push(server *PushServer, token string, body []byte, gzipped bool) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/push", bytes.NewReader(body))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	if gzipped {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	out := httptest.NewRecorder()
+	server.HandlePush(out, req)
+	return out
+}
+
+func TestPushAuth(t *testing.T) {
+
+	server, buffer := testPushServer(10)
+
+	assert.Equal(t, http.StatusUnauthorized, push(server, "", []byte("{}\n"), false).Code)
+	assert.Equal(t, http.StatusUnauthorized, push(server, "wrong", []byte("{}\n"), false).Code)
+	assert.Equal(t, 0, len(buffer.messages))
+
+	out := push(server, "s3cret", []byte("{\"a\":1}\n\n{\"b\":2}\n"), false)
+	assert.Equal(t, http.StatusAccepted, out.Code)
+	assert.JSONEq(t, `{"Accepted":2}`, out.Body.String())
+
+	message := <-buffer.messages
+	assert.Equal(t, `{"a":1}`, string(message.Body))
+	assert.Equal(t, 1234, message.Decoder.ZoneId())
+	// httptest's requests are plain http
+	assert.Equal(t, "http://192.0.2.1:1234", message.Source)
+}
+
+func TestPushGzip(t *testing.T) {
+
+	server, buffer := testPushServer(10)
+
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	gz.Write([]byte("{\"a\":1}\n{\"b\":2}\n{\"c\":3}"))
+	gz.Close()
+
+	// with the header and without, going by the magic bytes
+	assert.Equal(t, http.StatusAccepted, push(server, "s3cret", compressed.Bytes(), true).Code)
+	assert.Equal(t, http.StatusAccepted, push(server, "s3cret", compressed.Bytes(), false).Code)
+	assert.Equal(t, 6, len(buffer.messages))
+
+	assert.Equal(t, http.StatusBadRequest, push(server, "s3cret", []byte("not gzip"), true).Code)
+}
+
+func TestPushFull(t *testing.T) {
+
+	server, buffer := testPushServer(3)
+
+	assert.Equal(t, http.StatusAccepted, push(server, "s3cret", []byte("1\n2\n"), false).Code)
+
+	// all or nothing, so none of these go in
+	out := push(server, "s3cret", []byte("3\n4\n"), false)
+	assert.Equal(t, http.StatusTooManyRequests, out.Code)
+	assert.Equal(t, "1", out.Header().Get("Retry-After"))
+	assert.Equal(t, 2, len(buffer.messages))
+
+	// and this would never fit at all
+	assert.Equal(t, http.StatusRequestEntityTooLarge, push(server, "s3cret", []byte("1\n2\n3\n4\n"), false).Code)
+}
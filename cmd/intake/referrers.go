@@ -0,0 +1,131 @@
+package intake
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+)
+
+const (
+	ChannelDirect   = "direct"
+	ChannelInternal = "internal"
+	ChannelSearch   = "search"
+	ChannelSocial   = "social"
+	ChannelEmail    = "email"
+	// anywhere else that linked to us
+	ChannelReferral = "referral"
+)
+
+// the list of known sources, by channel, then by canonical name. It's just a
+// file, so adding a source is a one line PR, or REFERRER_SOURCES_PATH can point
+// at a replacement without waiting on a release
+//
+//go:embed referrers.json
+var defaultReferrerSources []byte
+
+// ReferrerClassifier works out where a visit came from, given the referrer
+type ReferrerClassifier struct {
+	// host to canonical source and channel
+	sources map[string]referrerSource
+}
+
+type referrerSource struct {
+	name    string
+	channel string
+}
+
+// LoadReferrerClassifier reads the source list from the given path, or uses
+// the embedded one if the path is empty
+func LoadReferrerClassifier(path string) (*ReferrerClassifier, error) {
+
+	raw := defaultReferrerSources
+
+	if path != "" {
+		var err error
+		raw, err = os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("Could not read referrer sources %v: %w", path, err)
+		}
+	}
+
+	channels := map[string]map[string][]string{}
+
+	err := json.Unmarshal(raw, &channels)
+	if err != nil {
+		return nil, fmt.Errorf("Could not parse referrer sources: %w", err)
+	}
+
+	classifier := &ReferrerClassifier{map[string]referrerSource{}}
+
+	for channel, names := range channels {
+		switch channel {
+		case ChannelSearch, ChannelSocial, ChannelEmail:
+		default:
+			return nil, fmt.Errorf("Unknown referrer channel %s in source list", channel)
+		}
+		for name, hosts := range names {
+			for _, host := range hosts {
+				classifier.sources[normalizeHost(host)] = referrerSource{name, channel}
+			}
+		}
+	}
+
+	return classifier, nil
+}
+
+// Classify returns the canonical source and channel for a referrer, where host
+// is the site's own host, so links from one page to another count as internal
+func (r *ReferrerClassifier) Classify(referrer string, host string) (string, string) {
+
+	if referrer == "" || referrer == "-" {
+		return "Direct", ChannelDirect
+	}
+
+	refUrl, err := url.Parse(referrer)
+	if err != nil || refUrl.Host == "" {
+		return "Unknown", ChannelReferral
+	}
+
+	refHost := normalizeHost(refUrl.Host)
+
+	if refHost == normalizeHost(host) {
+		return refHost, ChannelInternal
+	}
+
+	// most specific first, so mail.google.com is email but google.com is search,
+	// and anything.substack.com is still substack
+	for candidate := refHost; strings.Contains(candidate, "."); {
+		if source, ok := r.sources[candidate]; ok {
+			return source.name, source.channel
+		}
+		_, candidate, _ = strings.Cut(candidate, ".")
+	}
+
+	return refHost, ChannelReferral
+}
+
+// lowercase, no port, no www., so the same site always looks the same
+func normalizeHost(host string) string {
+	host = strings.ToLower(host)
+	if h, _, found := strings.Cut(host, ":"); found {
+		host = h
+	}
+	return strings.TrimPrefix(host, "www.")
+}
+
+// UtmParams pulls the campaign tags out of the query string, empty if not there
+func UtmParams(pathAndQuery string) (string, string, string) {
+
+	_, rawQuery, found := strings.Cut(pathAndQuery, "?")
+	if !found {
+		return "", "", ""
+	}
+
+	// even on error, ParseQuery keeps whatever it could parse, good enough here
+	params, _ := url.ParseQuery(rawQuery)
+
+	return params.Get("utm_source"), params.Get("utm_medium"), params.Get("utm_campaign")
+}
@@ -0,0 +1,358 @@
+package intake
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"ecstatic/util"
+
+	ch "github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/spf13/cobra"
+)
+
+var replaySource string
+var replayFrom string
+var replayTo string
+
+var ReplayDlqCmd = &cobra.Command{
+	Use:   "replay-dlq",
+	Short: "replay-dlq - re-ingests dead letters, e.g. after a parser fix",
+	Run: func(cmd *cobra.Command, args []string) {
+
+		log.Printf("[INFO] Getting configs from environment...")
+
+		configNames := []string{
+			"CLICKHOUSE_URL",
+			"CLICKHOUSE_DATABASE",
+		}
+
+		config, err := util.GetEnvConfigs(configNames)
+		if err != nil {
+			log.Fatalf("[ERROR] Could not parse configs from environment: %v", err)
+		}
+
+		if replaySource == "" {
+			replaySource = util.GetOptionalEnvConfig("DEADLETTER_SINK", DeadLetterFile)
+		}
+
+		// ------------------------------------------------------------------------
+
+		log.Printf("[INFO] Creating ClickHouse DB connection...")
+
+		clickhouseConn, err := ch.Open(&ch.Options{
+			Addr: []string{config["CLICKHOUSE_URL"]},
+			Auth: ch.Auth{Database: config["CLICKHOUSE_DATABASE"]},
+		})
+		if err != nil {
+			log.Fatalf("[ERROR] Could not create clickhouse connection: %v\n", err)
+		}
+
+		defer clickhouseConn.Close()
+
+		ctx := context.Background()
+
+		// the same salts intake uses, so today's and yesterday's come back as the
+		// visitors they were, and anything older as unknown, which is the point
+		// of them
+		enricher, err := enricherFromEnv(ctx, clickhouseConn)
+		if err != nil {
+			log.Fatalf("[ERROR] Could not set up enrichment: %v", err)
+		}
+
+		intaker := Intaker{clickConn: clickhouseConn, enricher: enricher}
+
+		// ------------------------------------------------------------------------
+
+		var sent, failed int
+
+		switch replaySource {
+		case DeadLetterFile:
+			dir := util.GetOptionalEnvConfig("DEADLETTER_DIR", "/var/spool/ecstatic-deadletter")
+			log.Printf("[INFO] Replaying dead letter files in %v...", dir)
+			sent, failed, err = intaker.replayDeadLetterFiles(ctx, dir)
+		case DeadLetterClickhouse:
+			from, to, rangeErr := replayRange()
+			if rangeErr != nil {
+				log.Fatalf("[ERROR] Could not parse time range: %v", rangeErr)
+			}
+			log.Printf("[INFO] Replaying dead letters received from %v to %v...", from, to)
+			sent, failed, err = intaker.replayDeadLetterTable(ctx, from, to)
+		default:
+			log.Fatalf("[ERROR] Invalid source %s (try one of %v)", replaySource, []string{DeadLetterFile, DeadLetterClickhouse})
+		}
+
+		if err != nil {
+			log.Fatalf("[ERROR] Could not replay dead letters (replayed %v before that): %v", sent, err)
+		}
+
+		log.Printf("[INFO] Replayed %v dead letters, %v are still no good and were kept", sent, failed)
+	},
+}
+
+func init() {
+	IntakeCmd.AddCommand(ReplayDlqCmd)
+	ReplayDlqCmd.Flags().StringVar(&replaySource, "source", "", "where to read dead letters from, file or clickhouse (defaults to DEADLETTER_SINK)")
+	ReplayDlqCmd.Flags().StringVar(&replayFrom, "from", "", "for the clickhouse source, RFC 3339 time to start from (required)")
+	ReplayDlqCmd.Flags().StringVar(&replayTo, "to", "", "for the clickhouse source, RFC 3339 time to stop at (defaults to a minute ago)")
+}
+
+func replayRange() (time.Time, time.Time, error) {
+
+	if replayFrom == "" {
+		return time.Time{}, time.Time{}, errors.New("--from is required for the clickhouse source")
+	}
+
+	from, err := time.Parse(time.RFC3339, replayFrom)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+
+	// a running intake may still have inserts in flight for the last few seconds,
+	// and those would get deleted without ever being replayed
+	to := time.Now().Add(-1 * time.Minute)
+	if replayTo != "" {
+		to, err = time.Parse(time.RFC3339, replayTo)
+		if err != nil {
+			return time.Time{}, time.Time{}, err
+		}
+	}
+
+	if !from.Before(to) {
+		return time.Time{}, time.Time{}, fmt.Errorf("--from %v is not before --to %v", from, to)
+	}
+
+	return from, to, nil
+}
+
+// goes through the sealed files (the one a running intake is writing to is left
+// alone), sending what can be sent, and rewriting each file with only the ones
+// that still fail
+func (i Intaker) replayDeadLetterFiles(ctx context.Context, dir string) (int, int, error) {
+
+	paths, err := sealedDeadLetterFiles(dir)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	sent, failed := 0, 0
+
+	for _, path := range paths {
+
+		letters, err := readDeadLetters(path)
+		if err != nil {
+			return sent, failed, fmt.Errorf("Could not read dead letter file %v: %w", path, err)
+		}
+
+		stillFailing, n, err := i.redeliver(ctx, letters)
+		if err != nil {
+			return sent, failed, err
+		}
+
+		sent += n
+		failed += len(stillFailing)
+
+		err = rewriteDeadLetters(path, stillFailing)
+		if err != nil {
+			return sent, failed, err
+		}
+
+		log.Printf("[INFO] Replayed %v of %v dead letters from %v", n, len(letters), path)
+	}
+
+	return sent, failed, nil
+}
+
+// the rows in clickhouse can't be edited in place, so the whole range is deleted
+// once the good ones are in, and the ones that still fail are put back
+func (i Intaker) replayDeadLetterTable(ctx context.Context, from time.Time, to time.Time) (int, int, error) {
+
+	rows, err := i.clickConn.Query(ctx, "SELECT ReceivedAt, Source, Stage, Error, Raw, Format, ZoneId FROM accesslog_rejected WHERE ReceivedAt >= ? AND ReceivedAt < ?", from, to)
+	if err != nil {
+		return 0, 0, fmt.Errorf("Could not query dead letters: %w", err)
+	}
+
+	letters := []DeadLetter{}
+	for rows.Next() {
+		var letter DeadLetter
+		var raw string
+		var zoneId uint32
+		err = rows.Scan(&letter.ReceivedAt, &letter.Source, &letter.Stage, &letter.Error, &raw, &letter.Format, &zoneId)
+		if err != nil {
+			rows.Close()
+			return 0, 0, fmt.Errorf("Could not scan dead letter: %w", err)
+		}
+		letter.Raw = []byte(raw)
+		letter.ZoneId = int(zoneId)
+		letters = append(letters, letter)
+	}
+
+	rows.Close()
+	if rows.Err() != nil {
+		return 0, 0, fmt.Errorf("Could not read dead letters: %w", rows.Err())
+	}
+
+	if len(letters) == 0 {
+		return 0, 0, nil
+	}
+
+	stillFailing, sent, err := i.redeliver(ctx, letters)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// wait for the delete to actually happen, otherwise it could take the
+	// re-inserted rows out along with the rest
+	syncCtx := ch.Context(ctx, ch.WithSettings(ch.Settings{"mutations_sync": 1}))
+
+	err = i.clickConn.Exec(syncCtx, "ALTER TABLE accesslog_rejected DELETE WHERE ReceivedAt >= ? AND ReceivedAt < ?", from, to)
+	if err != nil {
+		return sent, 0, fmt.Errorf("Could not delete replayed dead letters, they will be replayed again next time: %w", err)
+	}
+
+	if len(stillFailing) == 0 {
+		return sent, 0, nil
+	}
+
+	batch, err := i.clickConn.PrepareBatch(ctx, "INSERT INTO accesslog_rejected (ReceivedAt, Source, Stage, Error, Raw, Format, ZoneId)")
+	if err != nil {
+		return sent, 0, fmt.Errorf("Could not put back %v dead letters that still fail: %w", len(stillFailing), err)
+	}
+
+	for _, letter := range stillFailing {
+		err = batch.Append(letter.ReceivedAt, letter.Source, letter.Stage, letter.Error, string(letter.Raw), letter.Format, uint32(letter.ZoneId))
+		if err != nil {
+			log.Printf("[ERROR] Could not put back dead letter from %v, it is lost: %v", letter.Source, err)
+		}
+	}
+
+	err = batch.Send()
+	if err != nil {
+		return sent, 0, fmt.Errorf("Could not put back %v dead letters that still fail: %w", len(stillFailing), err)
+	}
+
+	return sent, len(stillFailing), nil
+}
+
+// has another go at each dead letter, returning the ones that still fail (with
+// the new error) and how many made it in. An error means nothing was sent
+func (i Intaker) redeliver(ctx context.Context, letters []DeadLetter) ([]DeadLetter, int, error) {
+
+	batch, err := i.clickConn.PrepareBatch(ctx, insertAccesslog)
+	if err != nil {
+		return nil, 0, fmt.Errorf("Could not prepare clickhouse batch: %w", err)
+	}
+
+	stillFailing := []DeadLetter{}
+
+	for _, letter := range letters {
+
+		enriched, err := reprocess(i.enricher, letter)
+		if err == nil {
+			err = addToBatch(batch, enriched)
+		}
+
+		if err != nil {
+			letter.Error = err.Error()
+			stillFailing = append(stillFailing, letter)
+		}
+	}
+
+	if batch.Rows() == 0 {
+		batch.Abort()
+		return stillFailing, 0, nil
+	}
+
+	sent := batch.Rows()
+
+	err = batch.Send()
+	if err != nil {
+		return nil, 0, fmt.Errorf("Could not send replayed dead letters to clickhouse: %w", err)
+	}
+
+	return stillFailing, sent, nil
+}
+
+func reprocess(enricher Enricher, letter DeadLetter) (EnrichedLog, error) {
+
+	// already enriched back when it went into the spool
+	if letter.Stage == StageSpool {
+		var enriched EnrichedLog
+		err := json.Unmarshal(letter.Raw, &enriched)
+		return enriched, err
+	}
+
+	// from before there was more than one format, Format is empty, meaning bunny
+	decoder, err := NewDecoder(letter.Format, letter.ZoneId)
+	if err != nil {
+		return EnrichedLog{}, err
+	}
+
+	record, err := decoder.Decode(letter.Raw)
+	if err != nil {
+		return EnrichedLog{}, err
+	}
+
+	return enricher.Enrich(record), nil
+}
+
+// replaces the file with one holding only the given letters, or deletes it if
+// there aren't any
+func rewriteDeadLetters(path string, letters []DeadLetter) error {
+
+	if len(letters) == 0 {
+		err := os.Remove(path)
+		if err != nil {
+			return fmt.Errorf("Could not delete replayed dead letter file %v: %w", path, err)
+		}
+		return nil
+	}
+
+	// neither .open nor .ndjson, so a crash halfway through can't leave a file
+	// that gets picked up as if it were complete
+	tmpPath := path + ".replay"
+
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return fmt.Errorf("Could not create %v: %w", tmpPath, err)
+	}
+
+	writer := bufio.NewWriter(file)
+	encoder := json.NewEncoder(writer)
+
+	for _, letter := range letters {
+		err = encoder.Encode(letter)
+		if err != nil {
+			break
+		}
+	}
+
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("Could not write %v: %w", tmpPath, err)
+	}
+
+	err = os.Rename(tmpPath, path)
+	if err != nil {
+		return fmt.Errorf("Could not replace dead letter file %v: %w", path, err)
+	}
+
+	return nil
+}
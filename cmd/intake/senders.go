@@ -0,0 +1,427 @@
+package intake
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// the sender's IP isn't on the listener's allowlist
+	RejectIp = "ip"
+	// the log is for a zone that no site has
+	RejectUnknownZone = "unknown_zone"
+	// the zone has syslog tokens, but the message didn't come with one
+	RejectMissingToken = "missing_token"
+	// the message came with a token, but not one for its zone
+	RejectBadToken = "bad_token"
+)
+
+// senders put their token in the structured data, as [ecstatic@32473 token="..."].
+// 32473 is the enterprise number set aside for examples (RFC 5612), since we
+// don't have one of our own, and nobody else will be using it for real
+const (
+	tokenSdId    = "ecstatic@32473"
+	tokenSdParam = "token"
+)
+
+// ----------------------------------------------------------------------------
+
+// IpAllowlist is a file of IPs and CIDR ranges, one per line, # for comments,
+// reloaded whenever it changes, so a cron can keep it in sync with bunny's
+// published edge IPs (https://bunnycdn.com/api/system/edgeserverlist)
+type IpAllowlist struct {
+	path string
+
+	mutex    sync.RWMutex
+	networks []*net.IPNet
+	modified time.Time
+}
+
+// unlike the geo databases, a missing or broken allowlist at startup is fatal,
+// since carrying on without it means letting everyone in
+func OpenIpAllowlist(path string) (*IpAllowlist, error) {
+	allowlist := &IpAllowlist{path: path}
+	err := allowlist.reload()
+	if err != nil {
+		return nil, fmt.Errorf("Could not load IP allowlist %v: %w", path, err)
+	}
+	return allowlist, nil
+}
+
+// Allows says whether the address is on the list, a nil list allows everyone
+func (a *IpAllowlist) Allows(addr net.Addr) bool {
+
+	if a == nil {
+		return true
+	}
+
+	var ip net.IP
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		ip = addr.IP
+	case *net.UDPAddr:
+		ip = addr.IP
+	default:
+		host, _, err := net.SplitHostPort(addr.String())
+		if err != nil {
+			return false
+		}
+		ip = net.ParseIP(host)
+	}
+
+	if ip == nil {
+		return false
+	}
+
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+
+	for _, network := range a.networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Watch checks the file every so often until the context is cancelled,
+// reloading it if it's changed
+func (a *IpAllowlist) Watch(ctx context.Context, interval time.Duration) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+			err := a.reload()
+			if err != nil {
+				log.Printf("[ERROR] Could not reload IP allowlist %v, keeping the old one: %v", a.path, err)
+			}
+		}
+	}
+}
+
+// if it doesn't work out, whatever was loaded before stays loaded
+func (a *IpAllowlist) reload() error {
+
+	info, err := os.Stat(a.path)
+	if err != nil {
+		return err
+	}
+
+	a.mutex.RLock()
+	unchanged := info.ModTime().Equal(a.modified)
+	a.mutex.RUnlock()
+
+	if unchanged {
+		return nil
+	}
+
+	file, err := os.Open(a.path)
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	networks, err := parseIpAllowlist(file)
+	if err != nil {
+		return err
+	}
+
+	a.mutex.Lock()
+	a.networks = networks
+	a.modified = info.ModTime()
+	a.mutex.Unlock()
+
+	log.Printf("[INFO] Loaded %v entries from IP allowlist %v", len(networks), a.path)
+
+	return nil
+}
+
+func parseIpAllowlist(file *os.File) ([]*net.IPNet, error) {
+
+	networks := []*net.IPNet{}
+
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+
+		entry, _, _ := strings.Cut(scanner.Text(), "#")
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		// a bare IP is a range of one
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("Line %v: invalid IP %q", line, entry)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("Line %v: %w", line, err)
+		}
+		networks = append(networks, network)
+	}
+
+	return networks, scanner.Err()
+}
+
+// ----------------------------------------------------------------------------
+
+// ZoneToken is one entry in the SYSLOG_TOKENS_PATH file, a JSON list of these,
+// hashed the same way as push tokens
+type ZoneToken struct {
+	TokenSha256 string `json:"TokenSha256"`
+	ZoneId      int    `json:"ZoneId"`
+}
+
+// LoadZoneTokens reads the tokens file, returning the hashes of each zone's
+// tokens (there can be more than one, to rotate without downtime)
+func LoadZoneTokens(path string) (map[int]map[string]struct{}, error) {
+
+	tokens := map[int]map[string]struct{}{}
+
+	if path == "" {
+		return tokens, nil
+	}
+
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read syslog tokens %v: %w", path, err)
+	}
+
+	entries := []ZoneToken{}
+
+	err = json.Unmarshal(raw, &entries)
+	if err != nil {
+		return nil, fmt.Errorf("Could not parse syslog tokens %v: %w", path, err)
+	}
+
+	for _, entry := range entries {
+		if tokens[entry.ZoneId] == nil {
+			tokens[entry.ZoneId] = map[string]struct{}{}
+		}
+		tokens[entry.ZoneId][strings.ToLower(entry.TokenSha256)] = struct{}{}
+	}
+
+	return tokens, nil
+}
+
+// ----------------------------------------------------------------------------
+
+// KnownZones is the pull zone of every site, from supabase, refreshed every so
+// often, and also (but not too often) whenever a zone we don't know turns up,
+// so a brand new site only loses its first few seconds of logs. The fetching
+// is all done by Watch, so checking a zone never waits on supabase
+type KnownZones struct {
+	fetch      func(ctx context.Context) []int
+	minRefresh time.Duration
+
+	// nil until the first fetch works
+	zones atomic.Pointer[map[int]struct{}]
+	// unix nanos of the last refresh, worked or not
+	refreshed atomic.Int64
+	// asks Watch for a refresh, never more than one waiting
+	wake chan struct{}
+}
+
+func NewKnownZones(fetch func(ctx context.Context) []int, minRefresh time.Duration) *KnownZones {
+	return &KnownZones{fetch: fetch, minRefresh: minRefresh, wake: make(chan struct{}, 1)}
+}
+
+// Known says whether a site has the zone. Until the first fetch works, every
+// zone is known, so a supabase blip at startup doesn't throw away real logs.
+// A zone we don't know asks Watch to go and check, but doesn't wait for it
+func (k *KnownZones) Known(zoneId int) bool {
+
+	zones := k.zones.Load()
+	if zones == nil {
+		return true
+	}
+
+	if _, ok := (*zones)[zoneId]; ok {
+		return true
+	}
+
+	if time.Since(time.Unix(0, k.refreshed.Load())) >= k.minRefresh {
+		select {
+		case k.wake <- struct{}{}:
+		default:
+		}
+	}
+
+	return false
+}
+
+// Watch fetches the zones right away, then every so often, and whenever Known
+// asks, until the context is cancelled
+func (k *KnownZones) Watch(ctx context.Context, interval time.Duration) {
+
+	k.refresh(ctx)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		case <-k.wake:
+			// asked for again while the last one was going, no need to go twice
+			if time.Since(time.Unix(0, k.refreshed.Load())) < k.minRefresh {
+				continue
+			}
+		}
+		k.refresh(ctx)
+	}
+}
+
+// only ever called from Watch. If the fetch fails the old zones stay, but it
+// still counts as a refresh, so we don't hammer supabase while it's down
+func (k *KnownZones) refresh(ctx context.Context) {
+
+	k.refreshed.Store(time.Now().UnixNano())
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	zoneIds := k.fetch(ctx)
+	if zoneIds == nil {
+		if old := k.zones.Load(); old != nil {
+			log.Printf("[WARN] Could not refresh known zones, keeping the %v we had", len(*old))
+		} else {
+			log.Printf("[WARN] Could not fetch known zones, allowing every zone until we can")
+		}
+		return
+	}
+
+	zones := make(map[int]struct{}, len(zoneIds))
+	for _, zoneId := range zoneIds {
+		zones[zoneId] = struct{}{}
+	}
+
+	k.zones.Store(&zones)
+}
+
+// ----------------------------------------------------------------------------
+
+// SenderValidator decides whether a decoded log is one we should believe. The
+// IP allowlist is checked by the listeners themselves, as soon as a sender
+// shows up, since that doesn't need the log decoded first
+type SenderValidator struct {
+	// nil to skip the check
+	zones *KnownZones
+	// by zone, zones without any don't need one
+	tokens map[int]map[string]struct{}
+}
+
+func NewSenderValidator(zones *KnownZones, tokens map[int]map[string]struct{}) *SenderValidator {
+	return &SenderValidator{zones: zones, tokens: tokens}
+}
+
+// Check returns why the log should be rejected (one of the Reject consts), or
+// "" if it's fine. A nil validator is fine with everything
+func (v *SenderValidator) Check(message SyslogMessage, record LogRecord) string {
+
+	if v == nil {
+		return ""
+	}
+
+	// pushed logs already had to show a token for the zone to get this far
+	if !message.Authenticated {
+		if zoneTokens, ok := v.tokens[record.PullZoneId]; ok {
+
+			token, found := structuredDataParam(message.StructuredData, tokenSdId, tokenSdParam)
+			if !found {
+				return RejectMissingToken
+			}
+
+			if _, ok := zoneTokens[hashToken(token)]; !ok {
+				return RejectBadToken
+			}
+		}
+	}
+
+	if v.zones != nil && !v.zones.Known(record.PullZoneId) {
+		return RejectUnknownZone
+	}
+
+	return ""
+}
+
+// finds the value of the param in the first SD element with the given ID, the
+// structured data having already been checked as well formed by the parser
+func structuredDataParam(structuredData, sdId, name string) (string, bool) {
+
+	rest := structuredData
+
+	// [id name="value" name="value"][id ...]
+	for strings.HasPrefix(rest, "[") {
+
+		idEnd := strings.IndexAny(rest, " ]")
+		if idEnd == -1 {
+			return "", false
+		}
+
+		id := rest[1:idEnd]
+		rest = rest[idEnd:]
+
+		for {
+			rest = strings.TrimLeft(rest, " ")
+
+			if rest == "" {
+				return "", false
+			}
+
+			if rest[0] == ']' {
+				rest = rest[1:]
+				break
+			}
+
+			key, after, ok := strings.Cut(rest, `="`)
+			if !ok {
+				return "", false
+			}
+
+			// the value runs until the first quote that isn't escaped, and only ",
+			// \, and ] can be escaped, any other backslash is just a backslash
+			value := strings.Builder{}
+			i := 0
+			for ; i < len(after) && after[i] != '"'; i++ {
+				if after[i] == '\\' && i+1 < len(after) && strings.IndexByte(`"\]`, after[i+1]) != -1 {
+					i++
+				}
+				value.WriteByte(after[i])
+			}
+
+			if i >= len(after) {
+				return "", false
+			}
+
+			rest = after[i+1:]
+
+			if id == sdId && key == name {
+				return value.String(), true
+			}
+		}
+	}
+
+	return "", false
+}
@@ -0,0 +1,114 @@
+package intake
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStructuredDataParam(t *testing.T) {
+
+	sd := `[origin ip="1.2.3.4"][ecstatic@32473 zone="1" token="a\"b\]c\d"]`
+
+	token, ok := structuredDataParam(sd, tokenSdId, tokenSdParam)
+	assert.True(t, ok)
+	assert.Equal(t, `a"b]c\d`, token)
+
+	_, ok = structuredDataParam(sd, "origin", tokenSdParam)
+	assert.False(t, ok)
+
+	_, ok = structuredDataParam(`[ecstatic@32473]`, tokenSdId, tokenSdParam)
+	assert.False(t, ok)
+
+	_, ok = structuredDataParam("", tokenSdId, tokenSdParam)
+	assert.False(t, ok)
+}
+
+func TestIpAllowlist(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "allowlist")
+	os.WriteFile(path, []byte("# bunny edges\n203.0.113.0/24\n198.51.100.7 # just one\n2001:db8::/32\n"), 0644)
+
+	allowlist, err := OpenIpAllowlist(path)
+	assert.NoError(t, err)
+
+	assert.True(t, allowlist.Allows(&net.TCPAddr{IP: net.ParseIP("203.0.113.99")}))
+	assert.True(t, allowlist.Allows(&net.UDPAddr{IP: net.ParseIP("198.51.100.7")}))
+	assert.True(t, allowlist.Allows(&net.TCPAddr{IP: net.ParseIP("2001:db8::1")}))
+	assert.False(t, allowlist.Allows(&net.TCPAddr{IP: net.ParseIP("198.51.100.8")}))
+
+	// a broken file keeps the old list
+	os.WriteFile(path, []byte("not an ip\n"), 0644)
+	os.Chtimes(path, time.Now(), time.Now().Add(time.Hour))
+	assert.Error(t, allowlist.reload())
+	assert.True(t, allowlist.Allows(&net.TCPAddr{IP: net.ParseIP("203.0.113.99")}))
+
+	var none *IpAllowlist
+	assert.True(t, none.Allows(&net.TCPAddr{IP: net.ParseIP("198.51.100.8")}))
+}
+
+func TestSenderValidator(t *testing.T) {
+
+	zones := NewKnownZones(func(ctx context.Context) []int {
+		return []int{1234, 5678}
+	}, time.Hour)
+	zones.refresh(context.Background())
+
+	tokens := map[int]map[string]struct{}{5678: {hashToken("s3cret"): {}}}
+
+	validator := NewSenderValidator(zones, tokens)
+
+	assert.Equal(t, "", validator.Check(SyslogMessage{}, LogRecord{PullZoneId: 1234}))
+	assert.Equal(t, RejectUnknownZone, validator.Check(SyslogMessage{}, LogRecord{PullZoneId: 9999}))
+	// unknown zones only go back to supabase every so often
+	assert.Equal(t, 0, len(zones.wake))
+
+	assert.Equal(t, RejectMissingToken, validator.Check(SyslogMessage{}, LogRecord{PullZoneId: 5678}))
+	assert.Equal(t, RejectBadToken, validator.Check(SyslogMessage{StructuredData: `[ecstatic@32473 token="nope"]`}, LogRecord{PullZoneId: 5678}))
+	assert.Equal(t, "", validator.Check(SyslogMessage{StructuredData: `[ecstatic@32473 token="s3cret"]`}, LogRecord{PullZoneId: 5678}))
+	assert.Equal(t, "", validator.Check(SyslogMessage{Authenticated: true}, LogRecord{PullZoneId: 5678}))
+
+	// can't reach supabase yet, so everyone gets the benefit of the doubt
+	down := NewSenderValidator(NewKnownZones(func(ctx context.Context) []int { return nil }, time.Hour), nil)
+	assert.Equal(t, "", down.Check(SyslogMessage{}, LogRecord{PullZoneId: 9999}))
+
+	var none *SenderValidator
+	assert.Equal(t, "", none.Check(SyslogMessage{}, LogRecord{PullZoneId: 9999}))
+}
+
+func TestKnownZonesRefreshInBackground(t *testing.T) {
+
+	var fetches atomic.Int32
+	release := make(chan struct{})
+
+	zones := NewKnownZones(func(ctx context.Context) []int {
+		// the first one's slow, and only knows 1234
+		if fetches.Add(1) == 1 {
+			<-release
+			return []int{1234}
+		}
+		return []int{1234, 5678}
+	}, 0)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go zones.Watch(ctx, time.Hour)
+
+	// nothing yet, and nobody waits for it
+	assert.True(t, zones.Known(5678))
+
+	close(release)
+	assert.Eventually(t, func() bool { return zones.zones.Load() != nil }, time.Second, time.Millisecond)
+
+	// a new zone is turned away, but gets it looked up
+	assert.False(t, zones.Known(5678))
+	assert.Eventually(t, func() bool { return zones.Known(5678) }, time.Second, time.Millisecond)
+	assert.Equal(t, int32(2), fetches.Load())
+}
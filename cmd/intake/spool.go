@@ -0,0 +1,391 @@
+package intake
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	openSegmentSuffix   = ".open"
+	sealedSegmentSuffix = ".ndjson"
+	minReplayBackoff    = 1 * time.Second
+	maxReplayBackoff    = 1 * time.Minute
+)
+
+// Spool is a write-ahead log for enriched rows, so a clickhouse outage costs us
+// some latency instead of some data. Every row goes into the current segment as
+// well as the in-memory batch; once the batch is sent, the segment is deleted,
+// and if it couldn't be sent, the segment is kept and replayed later
+type Spool struct {
+	dir      string
+	maxBytes int64
+
+	mutex      sync.Mutex
+	current    *spoolSegment
+	spilling   *spoolSegment
+	pending    []*spoolSegment // sealed but not in clickhouse yet, oldest first
+	totalBytes int64
+}
+
+type spoolSegment struct {
+	path   string
+	file   *os.File
+	writer *bufio.Writer
+	rows   int
+	bytes  int64
+	// already gone, e.g. dropped by enforceLimit while Replay was sending it
+	removed bool
+}
+
+// OpenSpool picks up any segments left behind by a previous run (including one
+// that was still being written when we died) and queues them for replay
+func OpenSpool(dir string, maxBytes int64) (*Spool, error) {
+
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("Could not create spool dir %v: %w", dir, err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read spool dir %v: %w", dir, err)
+	}
+
+	spool := &Spool{dir: dir, maxBytes: maxBytes}
+
+	// ReadDir sorts by name, and names are timestamps, so this is oldest first
+	for _, entry := range entries {
+
+		path := filepath.Join(dir, entry.Name())
+
+		if strings.HasSuffix(path, openSegmentSuffix) {
+			// whatever made it to disk before a crash is still worth sending
+			sealedPath := strings.TrimSuffix(path, openSegmentSuffix) + sealedSegmentSuffix
+			err = os.Rename(path, sealedPath)
+			if err != nil {
+				return nil, fmt.Errorf("Could not seal leftover spool segment %v: %w", path, err)
+			}
+			path = sealedPath
+		} else if !strings.HasSuffix(path, sealedSegmentSuffix) {
+			continue
+		}
+
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, fmt.Errorf("Could not stat spool segment %v: %w", path, err)
+		}
+
+		rows, err := readSegment(path)
+		if err != nil {
+			return nil, fmt.Errorf("Could not read spool segment %v: %w", path, err)
+		}
+
+		spool.pending = append(spool.pending, &spoolSegment{path: path, rows: len(rows), bytes: info.Size()})
+		spool.totalBytes += info.Size()
+	}
+
+	sort.Slice(spool.pending, func(a, b int) bool {
+		return spool.pending[a].path < spool.pending[b].path
+	})
+
+	if len(spool.pending) > 0 {
+		log.Printf("[INFO] Found %v leftover spool segments to replay", len(spool.pending))
+	}
+
+	spool.updateGauges()
+
+	return spool, nil
+}
+
+// Append writes a row to the current segment, starting a new one if need be
+func (s *Spool) Append(enriched EnrichedLog) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.appendTo(&s.current, enriched)
+}
+
+// Spill is for rows that never went into a batch at all, they go to their own
+// segment, which only ever gets replayed
+func (s *Spool) Spill(enriched EnrichedLog) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.appendTo(&s.spilling, enriched)
+}
+
+// must hold the mutex
+func (s *Spool) appendTo(segment **spoolSegment, enriched EnrichedLog) error {
+
+	line, err := json.Marshal(enriched)
+	if err != nil {
+		return fmt.Errorf("Could not serialize row for spool: %w", err)
+	}
+	line = append(line, '\n')
+
+	if *segment == nil {
+		// zero-padded so that sorting by name is sorting by age
+		path := filepath.Join(s.dir, fmt.Sprintf("%020d%s", time.Now().UnixNano(), openSegmentSuffix))
+
+		file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err != nil {
+			return fmt.Errorf("Could not create spool segment %v: %w", path, err)
+		}
+
+		*segment = &spoolSegment{path: path, file: file, writer: bufio.NewWriter(file)}
+	}
+
+	n, err := (*segment).writer.Write(line)
+	if err != nil {
+		return fmt.Errorf("Could not write to spool segment %v: %w", (*segment).path, err)
+	}
+
+	(*segment).rows++
+	(*segment).bytes += int64(n)
+	s.totalBytes += int64(n)
+
+	s.enforceLimit()
+
+	return nil
+}
+
+// Seal closes off the current segment and hands it back, so the caller can
+// Commit or Defer it once it knows whether clickhouse took the batch. Returns
+// nil if nothing has been written since the last Seal
+func (s *Spool) Seal() (*spoolSegment, error) {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	segment := s.current
+	s.current = nil
+
+	return segment, seal(segment)
+}
+
+// SealSpill closes off the spill segment, if there is one, and queues it up for
+// replay, since there's no batch that could possibly have sent those rows.
+// Returns how many rows that was
+func (s *Spool) SealSpill() (int, error) {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	segment := s.spilling
+	if segment == nil {
+		return 0, nil
+	}
+
+	s.spilling = nil
+
+	err := seal(segment)
+
+	s.pending = append(s.pending, segment)
+	s.enforceLimit()
+	s.updateGauges()
+
+	return segment.rows, err
+}
+
+func seal(segment *spoolSegment) error {
+
+	if segment == nil {
+		return nil
+	}
+
+	err := segment.writer.Flush()
+	if err == nil {
+		err = segment.file.Sync()
+	}
+	if err == nil {
+		err = segment.file.Close()
+	}
+	if err != nil {
+		return fmt.Errorf("Could not flush spool segment %v: %w", segment.path, err)
+	}
+
+	sealedPath := strings.TrimSuffix(segment.path, openSegmentSuffix) + sealedSegmentSuffix
+
+	err = os.Rename(segment.path, sealedPath)
+	if err != nil {
+		return fmt.Errorf("Could not seal spool segment %v: %w", segment.path, err)
+	}
+
+	segment.path = sealedPath
+
+	return nil
+}
+
+// Commit is for a sealed segment whose rows made it to clickhouse
+func (s *Spool) Commit(segment *spoolSegment) {
+
+	if segment == nil {
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.remove(segment)
+}
+
+// Defer is for a sealed segment whose rows did NOT make it to clickhouse, it
+// waits in line for Replay to have another go at it
+func (s *Spool) Defer(segment *spoolSegment) {
+
+	if segment == nil {
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.pending = append(s.pending, segment)
+	s.enforceLimit()
+	s.updateGauges()
+}
+
+// Replay sends deferred segments to clickhouse, oldest first, backing off while
+// clickhouse is still unhappy, until the context is cancelled
+func (s *Spool) Replay(ctx context.Context, send func([]EnrichedLog) error) {
+
+	wait := minReplayBackoff
+
+	for {
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+
+		s.mutex.Lock()
+		var segment *spoolSegment
+		if len(s.pending) > 0 {
+			segment = s.pending[0]
+		}
+		s.mutex.Unlock()
+
+		if segment == nil {
+			wait = minReplayBackoff
+			continue
+		}
+
+		rows, err := readSegment(segment.path)
+		if errors.Is(err, os.ErrNotExist) {
+			// dropped to make room while we weren't looking, nothing to do
+			continue
+		} else if err != nil {
+			log.Printf("[ERROR] Could not read spool segment %v, throwing it away: %v", segment.path, err)
+			s.Commit(segment)
+			spoolDroppedRows.Add(float64(segment.rows))
+			continue
+		}
+
+		err = send(rows)
+		if err != nil {
+			wait = min(max(wait*2, minReplayBackoff), maxReplayBackoff)
+			log.Printf("[ERROR] Could not replay spool segment %v, retrying in %v: %v", segment.path, wait, err)
+			continue
+		}
+
+		s.Commit(segment)
+		spoolReplayedRows.Add(float64(len(rows)))
+		log.Printf("[INFO] Replayed %v rows from spool segment %v", len(rows), segment.path)
+
+		// there might be more waiting, so go right back for the next one
+		wait = 0
+	}
+}
+
+// must hold the mutex
+func (s *Spool) remove(segment *spoolSegment) {
+
+	if segment.removed {
+		return
+	}
+	segment.removed = true
+
+	for i, p := range s.pending {
+		if p == segment {
+			s.pending = append(s.pending[:i], s.pending[i+1:]...)
+			break
+		}
+	}
+
+	// it's not ours to count any more either way. Left behind on disk, it's
+	// picked up again on the next start
+	s.totalBytes -= segment.bytes
+
+	err := os.Remove(segment.path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Printf("[ERROR] Could not delete spool segment %v: %v", segment.path, err)
+	}
+
+	s.updateGauges()
+}
+
+// must hold the mutex. Drops the oldest pending segments until we're back under
+// the size limit, better to lose old data than to fill the disk and lose it all
+func (s *Spool) enforceLimit() {
+	for s.totalBytes > s.maxBytes && len(s.pending) > 0 {
+		oldest := s.pending[0]
+		log.Printf("[ERROR] Spool is over %v bytes, dropping segment %v with %v rows", s.maxBytes, oldest.path, oldest.rows)
+		spoolDroppedRows.Add(float64(oldest.rows))
+		s.remove(oldest)
+	}
+}
+
+// must hold the mutex
+func (s *Spool) updateGauges() {
+
+	rows := 0
+	for _, segment := range s.pending {
+		rows += segment.rows
+	}
+
+	spoolSegments.Set(float64(len(s.pending)))
+	spoolRows.Set(float64(rows))
+	spoolBytes.Set(float64(s.totalBytes))
+}
+
+func readSegment(path string) ([]EnrichedLog, error) {
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	defer file.Close()
+
+	rows := []EnrichedLog{}
+	skipped := 0
+
+	// a whole frame of body comes out bigger once enriched
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 4*maxFrameSize)
+	for scanner.Scan() {
+		var enriched EnrichedLog
+		err = json.Unmarshal(scanner.Bytes(), &enriched)
+		if err != nil {
+			// most likely a half-written last line from a crash
+			skipped++
+			continue
+		}
+		rows = append(rows, enriched)
+	}
+
+	if skipped > 0 {
+		log.Printf("[WARN] Skipped %v unreadable rows in spool segment %v", skipped, path)
+	}
+
+	return rows, scanner.Err()
+}
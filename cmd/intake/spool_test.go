@@ -0,0 +1,207 @@
+package intake
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSpoolReplay(t *testing.T) {
+
+	spool, err := OpenSpool(t.TempDir(), 1024*1024)
+	assert.Nil(t, err)
+
+	for n := 0; n < 3; n++ {
+		assert.Nil(t, spool.Append(EnrichedLog{PullZoneId: 1234, Path: "/", Timestamp: int64(n)}))
+	}
+
+	segment, err := spool.Seal()
+	assert.Nil(t, err)
+	assert.Equal(t, 3, segment.rows)
+	assert.Equal(t, sealedSegmentSuffix, filepath.Ext(segment.path))
+
+	// nothing new since, so nothing to seal
+	empty, err := spool.Seal()
+	assert.Nil(t, err)
+	assert.Nil(t, empty)
+
+	// clickhouse didn't take it
+	spool.Defer(segment)
+	assert.Equal(t, float64(3), testutil.ToFloat64(spoolRows))
+	assert.Equal(t, float64(1), testutil.ToFloat64(spoolSegments))
+
+	replayed := []EnrichedLog{}
+	failures := 0
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	spool.Replay(ctx, func(rows []EnrichedLog) error {
+		// still down the first time round
+		if failures == 0 {
+			failures++
+			return assert.AnError
+		}
+		replayed = append(replayed, rows...)
+		cancel()
+		return nil
+	})
+
+	assert.Equal(t, 3, len(replayed))
+	assert.Equal(t, int64(2), replayed[2].Timestamp)
+
+	_, err = os.Stat(segment.path)
+	assert.True(t, os.IsNotExist(err))
+	assert.Equal(t, float64(0), testutil.ToFloat64(spoolRows))
+	assert.Equal(t, float64(0), testutil.ToFloat64(spoolBytes))
+}
+
+func TestSpoolRecoversFromCrash(t *testing.T) {
+
+	dir := t.TempDir()
+
+	spool, err := OpenSpool(dir, 1024*1024)
+	assert.Nil(t, err)
+
+	assert.Nil(t, spool.Append(EnrichedLog{PullZoneId: 1234, Path: "/one"}))
+	assert.Nil(t, spool.Append(EnrichedLog{PullZoneId: 1234, Path: "/two"}))
+
+	// died before sealing, with half a row on the end
+	assert.Nil(t, spool.current.writer.Flush())
+	_, err = spool.current.file.WriteString(`{"PullZoneId":1234,"Pa`)
+	assert.Nil(t, err)
+	assert.Nil(t, spool.current.file.Close())
+	openPath := spool.current.path
+
+	restarted, err := OpenSpool(dir, 1024*1024)
+	assert.Nil(t, err)
+
+	assert.Equal(t, 1, len(restarted.pending))
+	assert.Equal(t, 2, restarted.pending[0].rows)
+	assert.Equal(t, float64(2), testutil.ToFloat64(spoolRows))
+
+	// sealed on the way in
+	_, err = os.Stat(openPath)
+	assert.True(t, os.IsNotExist(err))
+
+	rows, err := readSegment(restarted.pending[0].path)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"/one", "/two"}, []string{rows[0].Path, rows[1].Path})
+}
+
+func TestSpoolCommit(t *testing.T) {
+
+	spool, err := OpenSpool(t.TempDir(), 1024*1024)
+	assert.Nil(t, err)
+
+	assert.Nil(t, spool.Append(EnrichedLog{PullZoneId: 1234}))
+
+	segment, err := spool.Seal()
+	assert.Nil(t, err)
+
+	spool.Commit(segment)
+
+	_, err = os.Stat(segment.path)
+	assert.True(t, os.IsNotExist(err))
+	assert.Equal(t, int64(0), spool.totalBytes)
+	assert.Equal(t, 0, len(spool.pending))
+	assert.Equal(t, float64(0), testutil.ToFloat64(spoolBytes))
+
+	// and nothing left for a restart to replay
+	entries, err := os.ReadDir(spool.dir)
+	assert.Nil(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestSpoolRemoveFailure(t *testing.T) {
+
+	spool, err := OpenSpool(t.TempDir(), 1024*1024)
+	assert.Nil(t, err)
+
+	assert.Nil(t, spool.Append(EnrichedLog{PullZoneId: 1234}))
+	segment, err := spool.Seal()
+	assert.Nil(t, err)
+	spool.Defer(segment)
+
+	// a directory with something in it won't go with os.Remove
+	assert.Nil(t, os.Remove(segment.path))
+	assert.Nil(t, os.MkdirAll(filepath.Join(segment.path, "stuck"), 0755))
+
+	spool.Commit(segment)
+
+	assert.Equal(t, 0, len(spool.pending))
+	assert.Equal(t, int64(0), spool.totalBytes)
+
+	// and going again doesn't count it twice
+	spool.Commit(segment)
+	assert.Equal(t, int64(0), spool.totalBytes)
+}
+
+func TestSpoolEnforceLimit(t *testing.T) {
+
+	spool, err := OpenSpool(t.TempDir(), 1024*1024)
+	assert.Nil(t, err)
+
+	segments := []*spoolSegment{}
+	for n := 0; n < 3; n++ {
+		assert.Nil(t, spool.Append(EnrichedLog{PullZoneId: 1234, Timestamp: int64(n)}))
+		assert.Nil(t, spool.Append(EnrichedLog{PullZoneId: 1234, Timestamp: int64(n)}))
+		segment, err := spool.Seal()
+		assert.Nil(t, err)
+		spool.Defer(segment)
+		segments = append(segments, segment)
+		// names are nanosecond timestamps
+		time.Sleep(time.Millisecond)
+	}
+
+	assert.Equal(t, float64(6), testutil.ToFloat64(spoolRows))
+	dropped := testutil.ToFloat64(spoolDroppedRows)
+
+	// room for two segments and no more
+	spool.mutex.Lock()
+	spool.maxBytes = segments[1].bytes + segments[2].bytes
+	spool.enforceLimit()
+	spool.mutex.Unlock()
+
+	assert.Equal(t, []*spoolSegment{segments[1], segments[2]}, spool.pending)
+	_, err = os.Stat(segments[0].path)
+	assert.True(t, os.IsNotExist(err))
+
+	assert.Equal(t, dropped+2, testutil.ToFloat64(spoolDroppedRows))
+	assert.Equal(t, float64(4), testutil.ToFloat64(spoolRows))
+	assert.Equal(t, float64(2), testutil.ToFloat64(spoolSegments))
+	assert.Equal(t, float64(segments[1].bytes+segments[2].bytes), testutil.ToFloat64(spoolBytes))
+}
+
+func TestSpoolOversizedRow(t *testing.T) {
+
+	dir := t.TempDir()
+
+	spool, err := OpenSpool(dir, 1024*1024)
+	assert.Nil(t, err)
+
+	// bigger than the scanner's default line limit
+	path := "/" + strings.Repeat("a", 2*maxFrameSize)
+	assert.Nil(t, spool.Append(EnrichedLog{PullZoneId: 1234, Path: path}))
+
+	segment, err := spool.Seal()
+	assert.Nil(t, err)
+	spool.Defer(segment)
+
+	rows, err := readSegment(segment.path)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(rows))
+	assert.Equal(t, path, rows[0].Path)
+
+	// and it doesn't stop a restart
+	restarted, err := OpenSpool(dir, 1024*1024)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(restarted.pending))
+	assert.Equal(t, 1, restarted.pending[0].rows)
+}
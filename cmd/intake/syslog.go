@@ -0,0 +1,330 @@
+package intake
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+)
+
+// bunny logs are a few hundred bytes, anything bigger than this is garbage (or
+// an attack) and we'd rather skip it than buffer it
+const maxFrameSize = 64 * 1024
+
+// SyslogMessage is one RFC 5424 message, with the header fields broken out and
+// the body (for bunny, a JSON blob) left as raw bytes for whoever parses it next
+type SyslogMessage struct {
+	Priority       int
+	Facility       int
+	Severity       int
+	Version        int
+	Timestamp      time.Time
+	Hostname       string
+	AppName        string
+	ProcId         string
+	MsgId          string
+	StructuredData string
+	Body           []byte
+
+	// not from the message itself, filled in by whichever listener got it
+	Source     string
+	ReceivedAt time.Time
+	Decoder    Decoder // for the body, nil means bunny
+	Line       int     // which line of Source it was, only for imports
+	// the sender already proved which zone it's sending for (with a push token),
+	// so there's no need to look for a token in the structured data
+	Authenticated bool
+}
+
+// FrameError means a single frame was malformed, but the reader has already
+// skipped past it and can keep going -- as opposed to any other error from
+// Next, which means the underlying connection is done for
+type FrameError struct {
+	Err error
+}
+
+func (e *FrameError) Error() string {
+	return fmt.Sprintf("Malformed syslog frame: %v", e.Err)
+}
+
+func (e *FrameError) Unwrap() error {
+	return e.Err
+}
+
+// SyslogReader pulls messages off a stream using either of the RFC 6587 framings,
+// octet-counting ("123 <34>1 ...") or non-transparent ("<34>1 ...\n"), detected
+// per frame so a sender can't confuse us by switching halfway through
+type SyslogReader struct {
+	reader *bufio.Reader
+}
+
+func NewSyslogReader(r io.Reader) *SyslogReader {
+	return &SyslogReader{bufio.NewReaderSize(r, maxFrameSize)}
+}
+
+func (s *SyslogReader) Next() (SyslogMessage, error) {
+
+	// skip any trailers left over from the previous frame, some senders use
+	// CRLF or NUL instead of a plain LF
+	for {
+		b, err := s.reader.ReadByte()
+		if err != nil {
+			return SyslogMessage{}, err
+		}
+		if b == '\n' || b == '\r' || b == 0 || b == ' ' {
+			continue
+		}
+		s.reader.UnreadByte()
+		break
+	}
+
+	first, err := s.reader.Peek(1)
+	if err != nil {
+		return SyslogMessage{}, err
+	}
+
+	var frame []byte
+
+	switch {
+
+	case first[0] >= '0' && first[0] <= '9':
+		frame, err = s.readOctetCounted()
+
+	case first[0] == '<':
+		frame, err = s.readNonTransparent()
+
+	default:
+		// no idea what this is, throw away the rest of the line and try again
+		err = s.discardLine()
+		if err == nil {
+			err = &FrameError{fmt.Errorf("Frame starts with unexpected byte %q", first[0])}
+		}
+	}
+
+	if err != nil {
+		return SyslogMessage{}, err
+	}
+
+	message, err := ParseSyslogMessage(frame)
+	if err != nil {
+		return SyslogMessage{}, &FrameError{err}
+	}
+
+	return message, nil
+}
+
+func (s *SyslogReader) readOctetCounted() ([]byte, error) {
+
+	// read the length one byte at a time, so garbage that happens to start with a
+	// digit can't make us swallow a bunch of perfectly good frames after it
+	length := 0
+	for digits := 0; ; digits++ {
+		b, err := s.reader.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		if b == ' ' && digits > 0 {
+			break
+		}
+		if b < '0' || b > '9' || digits >= 9 {
+			s.reader.UnreadByte()
+			return nil, s.resync(fmt.Errorf("Invalid frame length prefix"))
+		}
+		length = length*10 + int(b-'0')
+	}
+
+	if length == 0 {
+		return nil, &FrameError{fmt.Errorf("Frame has zero length")}
+	}
+
+	if length > maxFrameSize {
+		// the length itself is sane, so we can skip exactly this frame
+		_, err := s.reader.Discard(length)
+		if err != nil {
+			return nil, err
+		}
+		return nil, &FrameError{fmt.Errorf("Frame of %v bytes exceeds max of %v", length, maxFrameSize)}
+	}
+
+	frame := make([]byte, length)
+
+	_, err := io.ReadFull(s.reader, frame)
+	if err != nil {
+		return nil, err
+	}
+
+	return frame, nil
+}
+
+func (s *SyslogReader) readNonTransparent() ([]byte, error) {
+
+	line, err := s.reader.ReadSlice('\n')
+	if errors.Is(err, bufio.ErrBufferFull) {
+		return nil, s.resync(fmt.Errorf("Frame exceeds max of %v bytes", maxFrameSize))
+	} else if err != nil {
+		return nil, err
+	}
+
+	line = bytes.TrimRight(line, "\r\n")
+
+	// ReadSlice's result is only valid until the next read, so copy it out
+	frame := make([]byte, len(line))
+	copy(frame, line)
+
+	return frame, nil
+}
+
+// throws away everything up to the next newline, then reports the given error as
+// a (recoverable) FrameError, unless reading failed along the way
+func (s *SyslogReader) resync(reason error) error {
+	err := s.discardLine()
+	if err != nil {
+		return err
+	}
+	return &FrameError{reason}
+}
+
+func (s *SyslogReader) discardLine() error {
+	for {
+		_, err := s.reader.ReadSlice('\n')
+		if errors.Is(err, bufio.ErrBufferFull) {
+			continue
+		}
+		return err
+	}
+}
+
+// ParseSyslogMessage parses a single, already-deframed RFC 5424 message
+func ParseSyslogMessage(frame []byte) (SyslogMessage, error) {
+
+	message := SyslogMessage{}
+
+	// <PRI>VERSION
+	if len(frame) == 0 || frame[0] != '<' {
+		return message, fmt.Errorf("Message does not start with '<'")
+	}
+
+	end := bytes.IndexByte(frame, '>')
+	if end < 2 || end > 4 {
+		return message, fmt.Errorf("Message has invalid PRI")
+	}
+
+	priority, err := strconv.Atoi(string(frame[1:end]))
+	if err != nil || priority > 191 {
+		return message, fmt.Errorf("Message has invalid PRI %q", frame[1:end])
+	}
+
+	message.Priority = priority
+	message.Facility = priority / 8
+	message.Severity = priority % 8
+
+	rest := frame[end+1:]
+
+	versionStr, rest := nextField(rest)
+	version, err := strconv.Atoi(versionStr)
+	if err != nil || version < 1 {
+		return message, fmt.Errorf("Message has invalid VERSION %q", versionStr)
+	}
+	message.Version = version
+
+	// TIMESTAMP HOSTNAME APP-NAME PROCID MSGID
+	var fields [5]string
+	for i := range fields {
+		if len(rest) == 0 {
+			return message, fmt.Errorf("Message header is truncated")
+		}
+		fields[i], rest = nextField(rest)
+	}
+
+	if fields[0] != "-" {
+		message.Timestamp, err = time.Parse(time.RFC3339Nano, fields[0])
+		if err != nil {
+			return message, fmt.Errorf("Message has invalid TIMESTAMP: %v", err)
+		}
+	}
+
+	message.Hostname = nilValue(fields[1])
+	message.AppName = nilValue(fields[2])
+	message.ProcId = nilValue(fields[3])
+	message.MsgId = nilValue(fields[4])
+
+	// STRUCTURED-DATA
+	if len(rest) == 0 {
+		return message, fmt.Errorf("Message header is truncated")
+	}
+
+	sdLength, err := structuredDataLength(rest)
+	if err != nil {
+		return message, err
+	}
+	message.StructuredData = nilValue(string(rest[:sdLength]))
+	rest = rest[sdLength:]
+
+	// MSG, which is optional, and may start with a BOM that we don't want
+	if len(rest) > 0 {
+		if rest[0] != ' ' {
+			return message, fmt.Errorf("Message has junk after STRUCTURED-DATA")
+		}
+		rest = bytes.TrimPrefix(rest[1:], []byte("\xEF\xBB\xBF"))
+	}
+
+	message.Body = make([]byte, len(rest))
+	copy(message.Body, rest)
+
+	return message, nil
+}
+
+func nextField(input []byte) (string, []byte) {
+	space := bytes.IndexByte(input, ' ')
+	if space == -1 {
+		return string(input), nil
+	}
+	return string(input[:space]), input[space+1:]
+}
+
+func nilValue(field string) string {
+	if field == "-" {
+		return ""
+	}
+	return field
+}
+
+// returns how many bytes of the input make up the STRUCTURED-DATA, which is
+// either "-" or any number of [id key="value"] elements, where values can
+// contain escaped quotes and brackets, so we can't just look for ']'
+func structuredDataLength(input []byte) (int, error) {
+
+	if input[0] == '-' {
+		return 1, nil
+	}
+
+	i := 0
+	for i < len(input) && input[i] == '[' {
+		inQuotes := false
+		closed := false
+		for i++; i < len(input); i++ {
+			c := input[i]
+			if inQuotes && c == '\\' {
+				i++
+			} else if c == '"' {
+				inQuotes = !inQuotes
+			} else if c == ']' && !inQuotes {
+				closed = true
+				i++
+				break
+			}
+		}
+		if !closed {
+			return 0, fmt.Errorf("Message has unterminated STRUCTURED-DATA")
+		}
+	}
+
+	if i == 0 {
+		return 0, fmt.Errorf("Message has invalid STRUCTURED-DATA")
+	}
+
+	return i, nil
+}
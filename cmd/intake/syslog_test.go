@@ -0,0 +1,123 @@
+package intake
+
+import (
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const bunnyBody = `{"PullZoneId":1234,"UserAgent":"Mozilla/5.0 {weird}","PathAndQuery":"/a?b={c}"}`
+
+func TestParseSyslogMessage(t *testing.T) {
+
+	frame := `<134>1 2024-01-02T03:04:05.678Z edge-1 bunnycdn 42 access [meta@1 token="a\"]b"] ` + bunnyBody
+
+	message, err := ParseSyslogMessage([]byte(frame))
+	assert.NoError(t, err)
+
+	assert.Equal(t, 134, message.Priority)
+	assert.Equal(t, 16, message.Facility)
+	assert.Equal(t, 6, message.Severity)
+	assert.Equal(t, 1, message.Version)
+	assert.Equal(t, time.Date(2024, 1, 2, 3, 4, 5, 678000000, time.UTC), message.Timestamp)
+	assert.Equal(t, "edge-1", message.Hostname)
+	assert.Equal(t, "bunnycdn", message.AppName)
+	assert.Equal(t, "42", message.ProcId)
+	assert.Equal(t, "access", message.MsgId)
+	assert.Equal(t, `[meta@1 token="a\"]b"]`, message.StructuredData)
+	assert.Equal(t, bunnyBody, string(message.Body))
+}
+
+func TestParseSyslogMessageNilValues(t *testing.T) {
+
+	message, err := ParseSyslogMessage([]byte("<14>1 - - - - - -"))
+	assert.NoError(t, err)
+
+	assert.True(t, message.Timestamp.IsZero())
+	assert.Equal(t, "", message.Hostname)
+	assert.Equal(t, "", message.StructuredData)
+	assert.Equal(t, 0, len(message.Body))
+}
+
+func TestParseSyslogMessageMalformed(t *testing.T) {
+
+	frames := []string{
+		"",
+		"hello",
+		"<999>1 - - - - - -",
+		"<14>0 - - - - - -",
+		"<14>1 yesterday - - - - -",
+		"<14>1 - - - -",
+		"<14>1 - - - - - [unterminated",
+		"<14>1 - - - - - -junk",
+	}
+
+	for _, frame := range frames {
+		_, err := ParseSyslogMessage([]byte(frame))
+		assert.Error(t, err, "frame %q", frame)
+	}
+}
+
+func TestSyslogReaderFramings(t *testing.T) {
+
+	nonTransparent := "<134>1 - host app - - - " + bunnyBody
+	octetCounted := "<134>1 - host app - - - " + bunnyBody + "\n{still the same frame}"
+
+	stream := nonTransparent + "\r\n" +
+		strings.Repeat("x", 10) + "\n" + // garbage line
+		"4x2 nope\n" + // bad length prefix
+		strconv.Itoa(len(octetCounted)) + " " + octetCounted +
+		nonTransparent + "\n"
+
+	reader := NewSyslogReader(strings.NewReader(stream))
+
+	message, err := reader.Next()
+	assert.NoError(t, err)
+	assert.Equal(t, bunnyBody, string(message.Body))
+
+	var frameErr *FrameError
+
+	_, err = reader.Next()
+	assert.True(t, errors.As(err, &frameErr))
+
+	_, err = reader.Next()
+	assert.True(t, errors.As(err, &frameErr))
+
+	message, err = reader.Next()
+	assert.NoError(t, err)
+	assert.Equal(t, bunnyBody+"\n{still the same frame}", string(message.Body))
+
+	message, err = reader.Next()
+	assert.NoError(t, err)
+	assert.Equal(t, "host", message.Hostname)
+
+	_, err = reader.Next()
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestSyslogReaderOversizedFrame(t *testing.T) {
+
+	huge := "<134>1 - - - - - - " + strings.Repeat("a", maxFrameSize+1)
+	good := "<134>1 - - - - - - {}"
+
+	stream := strconv.Itoa(len(huge)) + " " + huge + huge + "\n" + good + "\n"
+
+	reader := NewSyslogReader(strings.NewReader(stream))
+
+	var frameErr *FrameError
+
+	_, err := reader.Next()
+	assert.True(t, errors.As(err, &frameErr))
+
+	_, err = reader.Next()
+	assert.True(t, errors.As(err, &frameErr))
+
+	message, err := reader.Next()
+	assert.NoError(t, err)
+	assert.Equal(t, "{}", string(message.Body))
+}
@@ -1,67 +1,169 @@
 package intake
 
 import (
-	"fmt"
 	"net"
 	"testing"
+	"time"
+
+	"ecstatic/util"
 
 	"github.com/stretchr/testify/assert"
 )
 
 func TestNotBot(t *testing.T) {
 
-	mock := MockGeo{}
-	tagger := Tagger{mock}
+	str := `{"PullZoneId":1234,"Status":200,"Timestamp":1507167062421,"BytesSent":412,"RemoteIp":"163.172.53.0","Referer":"-","PathAndQuery":"/favicon.ico","Host":"www.example.com","UserAgent":"Mozilla/5.0 (Windows NT 10.0) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/65.0.3325.146 Safari/537.36","Country":"DE"}`
+
+	record, err := BunnyDecoder{}.Decode([]byte(str))
+	assert.NoError(t, err)
+
+	actual := testEnricher().Enrich(record)
+
+	assert.Equal(t, 1234, actual.PullZoneId)
+	assert.Equal(t, int64(1507167062), actual.Timestamp)
+	assert.Equal(t, "Chrome", actual.Browser)
+	assert.Equal(t, "DE", actual.Country)
+	assert.Equal(t, "Desktop", actual.Device)
+	assert.Equal(t, "Image", actual.FileType)
+	assert.Equal(t, false, actual.IsProbablyBot)
+	assert.Equal(t, "", actual.BotReason)
+	assert.Equal(t, "Windows", actual.Os)
+	assert.Equal(t, "/favicon.ico", actual.Path)
+	assert.Equal(t, 200, actual.StatusCode)
+	assert.Equal(t, "2xx", actual.StatusCategory)
+	assert.Equal(t, "North Rhine-Westphalia", actual.Region)
+	assert.Equal(t, "Cologne", actual.City)
+	assert.Equal(t, uint32(12876), actual.Asn)
+}
+
+func TestBot(t *testing.T) {
 
-	str := "HIT|200|1507167062421|412|390|163.172.53.229|-|https://www.example.com/favicon.ico|WA|Mozilla/5.0 (Windows NT 10.0) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/65.0.3325.146 Safari/537.36|322b688bd63fb63f2babe9de30a5d262|DE"
+	str := `{"PullZoneId":1234,"Status":404,"Timestamp":1507167062421,"BytesSent":412,"RemoteIp":"163.172.53.0","Referer":"-","PathAndQuery":"/favicon.ico","Host":"www.example.com","UserAgent":"curl/7.54.1","Country":"DE"}`
 
-	bunny, err := stringToBunnyLog(str)
+	record, err := BunnyDecoder{}.Decode([]byte(str))
 	assert.NoError(t, err)
 
-	actual := tagger.Tags(bunny)
-
-	expected := map[string]string{
-		"":               "",
-		"browser":        "Chrome",
-		"country":        "Unknown",
-		"device":         "Desktop",
-		"filetype":       "image",
-		"isprobablybot":  "false",
-		"os":             "Windows",
-		"path":           "/favicon.ico",
-		"statuscode":     "200",
-		"statuscategory": "2xx",
+	actual := testEnricher().Enrich(record)
+
+	assert.Equal(t, "curl", actual.Browser)
+	assert.Equal(t, "Unknown", actual.Device)
+	assert.Equal(t, "Image", actual.FileType)
+	assert.Equal(t, true, actual.IsProbablyBot)
+	assert.Equal(t, BotUserAgent, actual.BotReason)
+	assert.Equal(t, "Unknown", actual.Os)
+	assert.Equal(t, "/favicon.ico", actual.Path)
+	assert.Equal(t, 404, actual.StatusCode)
+	assert.Equal(t, "4xx", actual.StatusCategory)
+}
+
+// with the embedded referrer list, which had better parse
+func testEnricher() Enricher {
+	referrers, err := LoadReferrerClassifier("")
+	if err != nil {
+		panic(err)
 	}
+	return NewEnricher(NewVisitorSalts(nil), referrers, map[int]util.SiteOptions{1234: {KeepQueryParams: []string{"page"}}}, MockGeo{}, BotPolicy{MaxRequests: 10, Window: time.Minute, AssetlessPages: 3})
+}
 
-	assert.Equal(t, expected, actual)
+// knows about exactly one (already anonymized) network
+type MockGeo struct{}
 
+func (m MockGeo) Lookup(ip net.IP) GeoInfo {
+	if ip.Equal(net.ParseIP("163.172.53.0")) {
+		return GeoInfo{"North Rhine-Westphalia", "Cologne", 12876}
+	}
+	return GeoInfo{}
 }
 
-func TestBot(t *testing.T) {
+func TestReferrer(t *testing.T) {
 
-	mock := MockGeo{}
-	tagger := Tagger{mock}
+	referrers, err := LoadReferrerClassifier("")
+	assert.NoError(t, err)
 
-	str := "HIT|404|1507167062421|412|390|163.172.53.229|-|https://www.example.com/favicon.ico|WA|curl/7.54.1|322b688bd63fb63f2babe9de30a5d262|DE"
+	cases := []struct {
+		referrer, source, channel string
+	}{
+		{"-", "Direct", ChannelDirect},
+		{"", "Direct", ChannelDirect},
+		{"https://www.google.co.uk/", "Google", ChannelSearch},
+		{"https://google.com/search?q=hi", "Google", ChannelSearch},
+		{"https://mail.google.com/mail/u/0/", "Gmail", ChannelEmail},
+		{"https://l.facebook.com/l.php?u=x", "Facebook", ChannelSocial},
+		{"https://someone.substack.com/p/post", "Substack", ChannelEmail},
+		{"https://www.example.com/other-page", "example.com", ChannelInternal},
+		{"https://blog.example.org:8443/", "blog.example.org", ChannelReferral},
+	}
 
-	bunny, err := stringToBunnyLog(str)
+	for _, c := range cases {
+		source, channel := referrers.Classify(c.referrer, "example.com")
+		assert.Equal(t, c.source, source, c.referrer)
+		assert.Equal(t, c.channel, channel, c.referrer)
+	}
+}
+
+func TestUtm(t *testing.T) {
+
+	str := `{"PullZoneId":1234,"Status":200,"Referer":"-","PathAndQuery":"/post?utm_source=weekly&utm_medium=email&utm_campaign=launch%20day","Host":"www.example.com"}`
+
+	record, err := BunnyDecoder{}.Decode([]byte(str))
 	assert.NoError(t, err)
 
-	actual := tagger.Tags(bunny)
-
-	expected := map[string]string{
-		"":               "",
-		"browser":        "curl",
-		"country":        "Unknown",
-		"device":         "Unknown",
-		"filetype":       "image",
-		"isprobablybot":  "true",
-		"os":             "",
-		"path":           "/favicon.ico",
-		"statuscode":     "404",
-		"statuscategory": "4xx",
+	actual := testEnricher().Enrich(record)
+
+	assert.Equal(t, "weekly", actual.UtmSource)
+	assert.Equal(t, "email", actual.UtmMedium)
+	assert.Equal(t, "launch day", actual.UtmCampaign)
+	assert.Equal(t, "Direct", actual.ReferrerSource)
+	assert.Equal(t, ChannelEmail, actual.ReferrerChannel)
+}
+
+func TestNormalizePath(t *testing.T) {
+
+	cases := []struct {
+		pathAndQuery, path, query string
+	}{
+		{"/about", "/about", ""},
+		{"/about/", "/about", ""},
+		{"/about/index.html", "/about", ""},
+		{"/about?x=1", "/about", "x=1"},
+		{"/", "/", ""},
+		{"/index.html", "/", ""},
+		{"", "/", ""},
+		{"/blog/?page=2&utm_source=x", "/blog?page=2", "page=2&utm_source=x"},
+		{"/blog?utm_source=x", "/blog", "utm_source=x"},
+		{"/style.css?v=3#top", "/style.css", "v=3"},
+	}
+
+	for _, c := range cases {
+		path, query := NormalizePath(c.pathAndQuery, []string{"page"})
+		assert.Equal(t, c.path, path, c.pathAndQuery)
+		assert.Equal(t, c.query, query, c.pathAndQuery)
 	}
 
-	assert.Equal(t, expected, actual)
+	// only for the sites that asked
+	path, _ := NormalizePath("/blog?page=2", nil)
+	assert.Equal(t, "/blog", path)
+}
+
+func TestGeoDegrades(t *testing.T) {
+
+	// no database at all
+	assert.Equal(t, GeoInfo{}, Geo(nil, LogRecord{RemoteIp: "163.172.53.0"}))
+
+	// a database that isn't there (yet)
+	missing := OpenGeoDatabase(t.TempDir() + "/nope.mmdb")
+	assert.Equal(t, GeoInfo{}, Geo(missing, LogRecord{RemoteIp: "163.172.53.0"}))
+
+	// garbage IP
+	assert.Equal(t, GeoInfo{}, Geo(MockGeo{}, LogRecord{RemoteIp: "-"}))
+
+	// a city database and an ASN database together
+	both := GeoDatabases{missing, MockGeo{}}
+	assert.Equal(t, "Cologne", Geo(both, LogRecord{RemoteIp: "163.172.53.0"}).City)
+}
 
+func TestInsertAccesslog(t *testing.T) {
+	assert.Contains(t, insertAccesslog, "INSERT INTO accesslog (PullZoneId, Timestamp, ")
+	assert.Contains(t, insertAccesslog, ", RequestId, ")
+	assert.Contains(t, insertAccesslog, ", HeaderRange)")
 }
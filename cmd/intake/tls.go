@@ -0,0 +1,43 @@
+package intake
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+)
+
+// LoadTlsConfig builds the server config for syslog over TLS (RFC 5425). If a
+// client CA is given, senders must present a cert signed by it, otherwise
+// anyone who can finish a handshake gets in
+func LoadTlsConfig(certPath, keyPath, clientCaPath string) (*tls.Config, error) {
+
+	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("Could not load TLS cert %v and key %v: %w", certPath, keyPath, err)
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if clientCaPath == "" {
+		return config, nil
+	}
+
+	caBytes, err := os.ReadFile(clientCaPath)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read TLS client CA %v: %w", clientCaPath, err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caBytes) {
+		return nil, fmt.Errorf("No PEM certificates found in TLS client CA %v", clientCaPath)
+	}
+
+	config.ClientCAs = pool
+	config.ClientAuth = tls.RequireAndVerifyClientCert
+
+	return config, nil
+}
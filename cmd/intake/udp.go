@@ -0,0 +1,103 @@
+package intake
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// UdpListener takes syslog over UDP (RFC 5426), where there's no framing to
+// worry about, since every datagram is exactly one message
+type UdpListener struct {
+	port      string
+	buffer    *MessageBuffer
+	decoder   Decoder
+	allowlist *IpAllowlist // nil to let anyone in
+
+	mutex   sync.Mutex
+	conn    net.PacketConn
+	closed  bool
+	readers sync.WaitGroup
+}
+
+func (u *UdpListener) Listen() {
+
+	conn, err := net.ListenPacket("udp", fmt.Sprintf(":%v", u.port))
+	if err != nil {
+		log.Printf("[ERROR] Could not listen for UDP on port %v: %v", u.port, err)
+		return
+	}
+
+	u.mutex.Lock()
+	if u.closed {
+		// shut down before we even got going
+		u.mutex.Unlock()
+		conn.Close()
+		return
+	}
+	u.conn = conn
+	u.readers.Add(1)
+	u.mutex.Unlock()
+
+	defer u.readers.Done()
+	defer conn.Close()
+
+	// big enough for the largest possible datagram, reused for every read since
+	// ParseSyslogMessage copies out whatever it keeps
+	buffer := make([]byte, 65535)
+
+	for {
+
+		n, addr, err := conn.ReadFrom(buffer)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		} else if err != nil {
+			log.Printf("[ERROR] Could not read UDP datagram: %v", err)
+			continue
+		}
+
+		// no connection to refuse, so every datagram gets checked, quietly since
+		// anyone can spray us with these
+		if !u.allowlist.Allows(addr) {
+			senderRejections.WithLabelValues(RejectIp).Inc()
+			continue
+		}
+
+		// a lot of senders tack a newline on anyway, even though they don't need to
+		datagram := bytes.TrimRight(buffer[:n], "\r\n\x00")
+
+		message, err := ParseSyslogMessage(datagram)
+		if err != nil {
+			log.Printf("[WARN] Skipping syslog datagram from %v: %v", addr, err)
+			framesParsed.WithLabelValues("udp", "malformed").Inc()
+			continue
+		}
+
+		framesParsed.WithLabelValues("udp", "ok").Inc()
+		lastMessageTime.SetToCurrentTime()
+
+		message.Source = fmt.Sprintf("udp://%v", addr)
+		message.ReceivedAt = time.Now()
+		message.Decoder = u.decoder
+
+		u.buffer.Push(message)
+	}
+}
+
+// Shutdown stops reading datagrams, then waits (until the deadline) for the one
+// we're in the middle of, if any, to be handed off
+func (u *UdpListener) Shutdown(deadline time.Time) error {
+
+	u.mutex.Lock()
+	u.closed = true
+	if u.conn != nil {
+		u.conn.Close()
+	}
+	u.mutex.Unlock()
+
+	return waitUntil(&u.readers, deadline)
+}
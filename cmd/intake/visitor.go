@@ -0,0 +1,167 @@
+package intake
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/binary"
+	"errors"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	ch "github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+)
+
+// VisitorSalts hands out a random salt per UTC day, for hashing visitors the same
+// way plausible does: the same IP and user agent on the same site on the same
+// day get the same hash, but nothing links them across days, and once the salt
+// is gone not even we can reverse it. Only today's and yesterday's are kept,
+// the latter so late arrivals (or replays from the spool) just after midnight
+// still count as the visitor they are. With a store, every intake (and every
+// restart) shares the day's salt, otherwise they only live in memory, and a
+// restart makes everyone a new visitor for the rest of the day
+type VisitorSalts struct {
+	mutex sync.Mutex
+	salts map[int64][]byte
+	now   func() time.Time
+
+	// nil for memory only
+	store SaltStore
+	// the days whose salt came from the store, the rest are ours until it's back
+	stored  map[int64]bool
+	retryAt time.Time
+}
+
+// SaltStore keeps each day's salt somewhere every intake can see it
+type SaltStore interface {
+	// Salt returns the day's salt, making it the given one if there isn't one yet
+	Salt(ctx context.Context, day int64, salt []byte) ([]byte, error)
+}
+
+// how long to get by on a salt of our own when the store can't be reached
+const saltStoreRetry = time.Minute
+
+func NewVisitorSalts(store SaltStore) *VisitorSalts {
+	return &VisitorSalts{salts: map[int64][]byte{}, now: time.Now, store: store, stored: map[int64]bool{}}
+}
+
+// returns nil if the day's salt is already gone (or the day hasn't happened yet)
+func (v *VisitorSalts) salt(day int64) []byte {
+
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	now := v.now()
+	today := now.Unix() / 86400
+
+	for d := range v.salts {
+		if d < today-1 {
+			delete(v.salts, d)
+			delete(v.stored, d)
+		}
+	}
+
+	if day < today-1 || day > today {
+		return nil
+	}
+
+	salt, ok := v.salts[day]
+	if ok && (v.store == nil || v.stored[day] || now.Before(v.retryAt)) {
+		return salt
+	}
+
+	if !ok {
+		salt = make([]byte, 32)
+		_, err := rand.Read(salt)
+		if err != nil {
+			// the docs say this never actually happens
+			panic(err)
+		}
+		v.salts[day] = salt
+	}
+
+	if v.store != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		shared, err := v.store.Salt(ctx, day, salt)
+		if err != nil {
+			log.Printf("[ERROR] Could not get visitor salt from store, using our own for now: %v", err)
+			v.retryAt = now.Add(saltStoreRetry)
+			return salt
+		}
+
+		salt = shared
+		v.salts[day] = salt
+		v.stored[day] = true
+	}
+
+	return salt
+}
+
+// ClickhouseSalts keeps the salts in visitor_salts, see schema/migrations/0029,
+// which drops them once they're older than yesterday
+type ClickhouseSalts struct {
+	clickConn ch.Conn
+}
+
+// whichever salt went in first wins, so two intakes making one at the same
+// time still end up agreeing
+const selectSalt = "SELECT Salt FROM visitor_salts WHERE Day = ? ORDER BY CreatedAt, Salt LIMIT 1"
+
+func (c ClickhouseSalts) Salt(ctx context.Context, day int64, salt []byte) ([]byte, error) {
+
+	date := time.Unix(day*86400, 0).UTC()
+
+	var existing string
+	err := c.clickConn.QueryRow(ctx, selectSalt, date).Scan(&existing)
+	if err == nil {
+		return []byte(existing), nil
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+
+	err = c.clickConn.Exec(ctx, "INSERT INTO visitor_salts (Day, Salt) VALUES (?, ?)", date, string(salt))
+	if err != nil {
+		return nil, err
+	}
+
+	err = c.clickConn.QueryRow(ctx, selectSalt, date).Scan(&existing)
+	if err != nil {
+		return nil, err
+	}
+
+	return []byte(existing), nil
+}
+
+// VisitorId is 0 (i.e. unknown) if the log is from too long ago to have a salt
+func (v *VisitorSalts) VisitorId(record LogRecord) uint64 {
+
+	// records are in epoch ms
+	salt := v.salt(record.Timestamp / 1000 / 86400)
+	if salt == nil {
+		return 0
+	}
+
+	// the IP has already had its last octet zeroed out by the time we see it.
+	// the NULs keep "1" + "23" and "12" + "3" from hashing the same
+	hash := sha256.New()
+	hash.Write(salt)
+	hash.Write([]byte(strconv.Itoa(record.PullZoneId)))
+	hash.Write([]byte{0})
+	hash.Write([]byte(record.RemoteIp))
+	hash.Write([]byte{0})
+	hash.Write([]byte(record.UserAgent))
+
+	id := binary.BigEndian.Uint64(hash.Sum(nil))
+
+	// 0 means unknown, and we'd rather not have a visitor vanish on the off chance
+	if id == 0 {
+		id = 1
+	}
+
+	return id
+}
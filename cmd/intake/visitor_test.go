@@ -0,0 +1,89 @@
+package intake
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVisitorId(t *testing.T) {
+
+	now := time.Date(2024, 3, 2, 12, 0, 0, 0, time.UTC)
+	salts := NewVisitorSalts(nil)
+	salts.now = func() time.Time { return now }
+
+	bunny := LogRecord{PullZoneId: 1234, RemoteIp: "163.172.53.0", UserAgent: "Mozilla/5.0", Timestamp: now.UnixMilli()}
+
+	today := salts.VisitorId(bunny)
+	assert.NotEqual(t, uint64(0), today)
+	assert.Equal(t, today, salts.VisitorId(bunny))
+
+	otherZone := bunny
+	otherZone.PullZoneId = 5678
+	assert.NotEqual(t, today, salts.VisitorId(otherZone))
+
+	// yesterday still has a salt, but a different one
+	yesterday := bunny
+	yesterday.Timestamp = now.Add(-24 * time.Hour).UnixMilli()
+	yesterdayId := salts.VisitorId(yesterday)
+	assert.NotEqual(t, uint64(0), yesterdayId)
+	assert.NotEqual(t, today, yesterdayId)
+
+	// the day before that is gone
+	older := bunny
+	older.Timestamp = now.Add(-48 * time.Hour).UnixMilli()
+	assert.Equal(t, uint64(0), salts.VisitorId(older))
+
+	// and once a day goes by, so is the salt for what used to be yesterday
+	now = now.Add(24 * time.Hour)
+	assert.Equal(t, uint64(0), salts.VisitorId(yesterday))
+	assert.Equal(t, today, salts.VisitorId(bunny))
+	assert.Equal(t, 1, len(salts.salts))
+}
+
+// like ClickhouseSalts, but in memory, and maybe down
+type mockSaltStore struct {
+	salts map[int64][]byte
+	down  bool
+}
+
+func (m *mockSaltStore) Salt(ctx context.Context, day int64, salt []byte) ([]byte, error) {
+	if m.down {
+		return nil, assert.AnError
+	}
+	if _, ok := m.salts[day]; !ok {
+		m.salts[day] = salt
+	}
+	return m.salts[day], nil
+}
+
+func TestVisitorSaltsStore(t *testing.T) {
+
+	now := time.Date(2024, 3, 2, 12, 0, 0, 0, time.UTC)
+	store := &mockSaltStore{salts: map[int64][]byte{}}
+
+	bunny := LogRecord{PullZoneId: 1234, RemoteIp: "163.172.53.0", UserAgent: "Mozilla/5.0", Timestamp: now.UnixMilli()}
+
+	first := NewVisitorSalts(store)
+	first.now = func() time.Time { return now }
+	id := first.VisitorId(bunny)
+
+	// a restart, or another intake, gets the same salt
+	second := NewVisitorSalts(store)
+	second.now = func() time.Time { return now }
+	assert.Equal(t, id, second.VisitorId(bunny))
+
+	// with the store down, a salt of our own gets us by
+	store.down = true
+	third := NewVisitorSalts(store)
+	third.now = func() time.Time { return now }
+	assert.NotEqual(t, id, third.VisitorId(bunny))
+
+	// until it's back and we try again
+	store.down = false
+	assert.NotEqual(t, id, third.VisitorId(bunny))
+	now = now.Add(saltStoreRetry)
+	assert.Equal(t, id, third.VisitorId(bunny))
+}
@@ -0,0 +1,102 @@
+package migrate
+
+import (
+	"context"
+	"log"
+
+	"ecstatic/schema"
+	"ecstatic/util"
+
+	ch "github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+	"github.com/spf13/cobra"
+)
+
+var MigrateCmd = &cobra.Command{
+	Use:   "migrate",
+	Short: "migrate - brings the ClickHouse schema up to date, or says how far behind it is",
+}
+
+var UpCmd = &cobra.Command{
+	Use:   "up",
+	Short: "up - applies every migration that hasn't been applied yet, in order",
+	Run: func(cmd *cobra.Command, args []string) {
+
+		ctx := context.Background()
+		clickhouseConn := connect()
+		defer clickhouseConn.Close()
+
+		log.Printf("[INFO] Applying pending migrations...")
+
+		done, err := schema.Up(ctx, clickhouseConn)
+		for _, migration := range done {
+			log.Printf("[INFO] Applied %v", migration.Name)
+		}
+		if err != nil {
+			log.Fatalf("[ERROR] Stopped after %v migrations: %v", len(done), err)
+		}
+
+		log.Printf("[INFO] Applied %v migrations, schema is up to date", len(done))
+	},
+}
+
+var StatusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "status - lists every migration and whether it has been applied",
+	Run: func(cmd *cobra.Command, args []string) {
+
+		ctx := context.Background()
+		clickhouseConn := connect()
+		defer clickhouseConn.Close()
+
+		migrations, err := schema.Migrations()
+		if err != nil {
+			log.Fatalf("[ERROR] Could not read migrations: %v", err)
+		}
+
+		applied, err := schema.Applied(ctx, clickhouseConn)
+		if err != nil {
+			log.Fatalf("[ERROR] Could not read applied migrations: %v", err)
+		}
+
+		pending := 0
+		for _, migration := range migrations {
+			if appliedAt, ok := applied[migration.Version]; ok {
+				log.Printf("[INFO] applied %v  %v", appliedAt.Format("2006-01-02 15:04:05"), migration.Name)
+			} else {
+				log.Printf("[INFO] PENDING                      %v", migration.Name)
+				pending++
+			}
+		}
+
+		log.Printf("[INFO] %v of %v migrations pending", pending, len(migrations))
+	},
+}
+
+func init() {
+	MigrateCmd.AddCommand(UpCmd)
+	MigrateCmd.AddCommand(StatusCmd)
+}
+
+func connect() driver.Conn {
+
+	configNames := []string{
+		"CLICKHOUSE_URL",
+		"CLICKHOUSE_DATABASE",
+	}
+
+	config, err := util.GetEnvConfigs(configNames)
+	if err != nil {
+		log.Fatalf("[ERROR] Could not parse configs from environment: %v", err)
+	}
+
+	clickhouseConn, err := ch.Open(&ch.Options{
+		Addr: []string{config["CLICKHOUSE_URL"]},
+		Auth: ch.Auth{Database: config["CLICKHOUSE_DATABASE"]},
+	})
+	if err != nil {
+		log.Fatalf("[ERROR] Could not create clickhouse connection: %v\n", err)
+	}
+
+	return clickhouseConn
+}
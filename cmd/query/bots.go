@@ -0,0 +1,89 @@
+package query
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+)
+
+// how many of each crawler's paths to list
+const botReportTopPaths = 10
+
+// BotReportRow is one crawler, going by its user agent family, and what it
+// cost us over the range
+type BotReportRow struct {
+	Family   string   `json:"Family"`
+	Requests uint64   `json:"Requests"`
+	Bytes    uint64   `json:"Bytes"`
+	Paths    uint64   `json:"Paths"`
+	TopPaths []string `json:"TopPaths"`
+	Reasons  []string `json:"Reasons"`
+}
+
+// HandleBotReport lists the zone's biggest crawlers by bytes, with how many
+// requests they made, how many different paths they hit and which the most,
+// and why we took them for bots
+func (q Query) HandleBotReport(out http.ResponseWriter, req *http.Request) {
+
+	params, err := ParseBotReportParams(req.URL.Query())
+	if err != nil {
+		http.Error(out, err.Error()+", quitting", http.StatusBadRequest)
+		return
+	}
+
+	query, err := BuildBotReportQuery(params)
+	if err != nil {
+		log.Printf("Could not build query: %v", err)
+		http.Error(out, "Could not build query", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Query to clickhouse: %s %v", query.Sql, query.Parameters)
+
+	result := []BotReportRow{}
+	err = q.clickConn.Select(clickhouse.Context(req.Context(), clickhouse.WithParameters(query.Parameters)), &result, query.Sql)
+
+	if err != nil {
+		log.Printf("Query was unsuccessful: %v", err)
+		http.Error(out, "Query was unsuccessful", http.StatusInternalServerError)
+		return
+	}
+
+	out.Header().Set("Content-Type", "application/json")
+
+	err = json.NewEncoder(out).Encode(result)
+	if err != nil {
+		http.Error(out, "Unable to serialize JSON output for HTTP", http.StatusInternalServerError)
+		return
+	}
+}
+
+// always from accesslog, the rollups only having one dimension at a time
+func BuildBotReportQuery(params BotReportParams) (ClickhouseQuery, error) {
+
+	query := newQueryBuilder()
+
+	query.write("SELECT ")
+	query.write("toString(Browser) as Family, ")
+	query.write("count() as Requests, ")
+	query.write("SUM(BytesSent) as Bytes, ")
+	query.write("uniqCombined(Path) as Paths, ")
+	query.write("topK(", strconv.Itoa(botReportTopPaths), ")(Path) as TopPaths, ")
+	query.write("arraySort(groupUniqArray(toString(BotReason))) as Reasons ")
+
+	query.write("FROM accesslog ")
+
+	query.write("WHERE PullZoneId = ", query.bind("zoneId", "UInt32", params.ZoneId), " ")
+	query.write("AND Timestamp >= toDateTime(", query.bind("start", "Int64", params.Start), ") ")
+	query.write("AND Timestamp < toDateTime(", query.bind("end", "Int64", params.End), ") ")
+	query.bots("only")
+
+	query.write("GROUP BY Family ")
+	query.write("ORDER BY Bytes DESC, Requests DESC ")
+	query.write("LIMIT ", query.bind("limit", "UInt32", params.Limit))
+
+	return query.build()
+}
@@ -0,0 +1,70 @@
+package query
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+)
+
+// ClickhouseQuery is SQL with {name:Type} placeholders, and what goes in them,
+// which clickhouse fills in itself, so nothing in Parameters can change what
+// the SQL means
+type ClickhouseQuery struct {
+	Sql        string
+	Parameters clickhouse.Parameters
+}
+
+// queryBuilder only takes SQL as constants and identifiers from DIMENSIONS and
+// BUCKETS, everything else has to go through bind
+type queryBuilder struct {
+	sql    strings.Builder
+	params clickhouse.Parameters
+	// the first thing to go wrong, for build to hand back
+	err error
+}
+
+func newQueryBuilder() *queryBuilder {
+	return &queryBuilder{params: clickhouse.Parameters{}}
+}
+
+// write is for SQL we wrote, never anything from the client
+func (b *queryBuilder) write(sql ...string) *queryBuilder {
+	for _, part := range sql {
+		b.sql.WriteString(part)
+	}
+	return b
+}
+
+// bind adds a parameter, returning its placeholder. Binding the same name
+// twice is fine, so long as it's the same value both times, otherwise build
+// fails, keeping the first
+func (b *queryBuilder) bind(name, chType string, value any) string {
+	str := fmt.Sprint(value)
+	if existing, ok := b.params[name]; ok && existing != str {
+		if b.err == nil {
+			b.err = fmt.Errorf("Query parameter %s bound to both %v and %v", name, existing, str)
+		}
+	} else {
+		b.params[name] = str
+	}
+	return fmt.Sprintf("{%s:%s}", name, chType)
+}
+
+func (b *queryBuilder) build() (ClickhouseQuery, error) {
+	if b.err != nil {
+		return ClickhouseQuery{}, b.err
+	}
+	return ClickhouseQuery{b.sql.String(), b.params}, nil
+}
+
+// bots filter for a query on accesslog or a rollup, "true" being everything
+func (b *queryBuilder) bots(bots string) *queryBuilder {
+	switch bots {
+	case "false":
+		return b.write("AND NOT IsProbablyBot ")
+	case "only":
+		return b.write("AND IsProbablyBot ")
+	}
+	return b
+}
@@ -117,6 +117,7 @@ var QueryCmd = &cobra.Command{
 		r.Use(promHttpStd.HandlerProvider("", promMiddleware))
 
 		r.Get("/query", q.HandleQuery)
+		r.Get("/bots", q.HandleBotReport)
 
 		// ------------------------------------------------------------------------
 
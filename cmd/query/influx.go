@@ -1,108 +1,54 @@
 package query
 
 import (
+	"context"
 	"encoding/json"
-	"fmt"
 	"log"
+	"math"
 	"net/http"
-	"strconv"
-	"strings"
 	"time"
 
+	"github.com/ClickHouse/clickhouse-go/v2"
 	ch "github.com/ClickHouse/clickhouse-go/v2/lib/driver"
-	"golang.org/x/exp/slices"
 )
 
 type Query struct {
 	clickConn ch.Conn
 }
 
+// QueryResult is a row of what BuildClickhouseQuery returns, with the metrics
+// in the order they were asked for
 type QueryResult struct {
 	WindowStart time.Time
 	GroupKey    string
-	Hits        uint64
-	Bytes       uint64
+	Metrics     []float64
 }
 
+// Point is a bucket of a timeseries, with whichever metrics were asked for.
+// Counts come out as whole numbers, but everything is a float to keep it simple
 type Point struct {
-	Time  int64  `json:"Time"`
-	Hits  uint64 `json:"Hits"`
-	Bytes uint64 `json:"Bytes"`
+	Time    int64              `json:"Time"`
+	Metrics map[string]float64 `json:"Metrics"`
 }
 
-// below should be const, but golang knows better
-var VALIDGROUPBYS = []string{"Browser", "Os", "Device", "Country", "Path", "StatusCategory"}
-var VALIDBUCKETBYS = []string{"hour", "day", "week", "month"}
-var VALIDBOTS = []string{"true", "false"}
-
 func (q Query) HandleQuery(out http.ResponseWriter, req *http.Request) {
 
-	// todo, this is gross. there must be a better way of defining and validating API spec
-
-	zoneId := req.URL.Query().Get("zoneid")
-	if zoneId == "" {
-		http.Error(out, "Query param 'zoneid' not provided, quitting", http.StatusBadRequest)
-		return
-	}
-
-	unixStartStr := req.URL.Query().Get("start")
-	if unixStartStr == "" {
-		http.Error(out, "Query param 'start' not provided, quitting", http.StatusBadRequest)
-		return
-	}
-
-	unixStart, err := strconv.Atoi(unixStartStr)
+	params, err := ParseQueryParams(req.URL.Query())
 	if err != nil {
-		http.Error(out, "Query param 'start' is not a valid int, quitting", http.StatusBadRequest)
+		http.Error(out, err.Error()+", quitting", http.StatusBadRequest)
 		return
 	}
 
-	unixEndStr := req.URL.Query().Get("end")
-	if unixEndStr == "" {
-		http.Error(out, "Query param 'end' not provided, quitting", http.StatusBadRequest)
-		return
-	}
-
-	unixEnd, err := strconv.Atoi(unixEndStr)
+	query, err := BuildClickhouseQuery(params)
 	if err != nil {
-		http.Error(out, "Query param 'end' is not a valid int, quitting", http.StatusBadRequest)
+		log.Printf("Could not build query: %v", err)
+		http.Error(out, "Could not build query", http.StatusInternalServerError)
 		return
 	}
 
-	includeBots := req.URL.Query().Get("bots")
-	if !slices.Contains(VALIDBOTS, includeBots) {
-		http.Error(out, fmt.Sprintf("Invalid bots %s (try one of %v)", includeBots, VALIDBOTS), http.StatusBadRequest)
-		return
-	}
+	log.Printf("Query to clickhouse: %s %v", query.Sql, query.Parameters)
 
-	groupby := req.URL.Query().Get("groupby")
-	if !slices.Contains(VALIDGROUPBYS, groupby) {
-		http.Error(out, fmt.Sprintf("Invalid groupby %s (try one of %v)", groupby, VALIDGROUPBYS), http.StatusBadRequest)
-		return
-	}
-
-	bucketby := req.URL.Query().Get("bucketby")
-	if !slices.Contains(VALIDBUCKETBYS, bucketby) {
-		http.Error(out, fmt.Sprintf("Invalid bucketby %s (try one of %v)", bucketby, VALIDBUCKETBYS), http.StatusBadRequest)
-		return
-	}
-
-	timezone := req.URL.Query().Get("tz")
-	if (len(timezone) < 8) || (len(timezone) > 30) || (!strings.ContainsRune(timezone, '/')) {
-		http.Error(out, fmt.Sprintf("Invalid timezone %s", timezone), http.StatusBadRequest)
-		return
-	}
-
-	queryStr := BuildClickhouseQuery(zoneId, includeBots, groupby, bucketby, timezone, unixStart, unixEnd)
-	// if err != nil {
-	// 	http.Error(out, fmt.Sprintf("Unable to create valid query for influxdb: %w", err), http.StatusBadRequest)
-	// 	return
-	// }
-
-	log.Printf("Query to clickhouse: %s", queryStr)
-
-	var result []QueryResult
-	err = q.clickConn.Select(req.Context(), &result, queryStr)
+	result, err := q.selectResults(req.Context(), query, len(params.Metrics))
 
 	if err != nil {
 		log.Printf("Query was unsuccessful: %v", err)
@@ -110,7 +56,7 @@ func (q Query) HandleQuery(out http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	timeserieses := QueryResultToPoints(result)
+	timeserieses := QueryResultToPoints(result, params.Metrics)
 
 	// TODO, can/should probably use go-chi render for all this?
 	out.Header().Set("Content-Type", "application/json")
@@ -124,54 +70,151 @@ func (q Query) HandleQuery(out http.ResponseWriter, req *http.Request) {
 	return
 }
 
-func BuildClickhouseQuery(zoneId, includeBots, groupby, bucketby, timezone string, unixStart, unixEnd int) string {
+// the metrics vary by query, so no Select into a struct
+func (q Query) selectResults(ctx context.Context, query ClickhouseQuery, metrics int) ([]QueryResult, error) {
+
+	rows, err := q.clickConn.Query(clickhouse.Context(ctx, clickhouse.WithParameters(query.Parameters)), query.Sql)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	results := []QueryResult{}
+
+	for rows.Next() {
+		result := QueryResult{Metrics: make([]float64, metrics)}
+		dest := []any{&result.WindowStart, &result.GroupKey}
+		for n := range result.Metrics {
+			dest = append(dest, &result.Metrics[n])
+		}
+		err = rows.Scan(dest...)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, result)
+	}
 
-	var query strings.Builder
+	return results, rows.Err()
+}
 
-	query.WriteString("SELECT ")
+// BuildClickhouseQuery reads from the coarsest rollup that can answer, if any,
+// and from accesslog for the rest
+func BuildClickhouseQuery(params QueryParams) (ClickhouseQuery, error) {
 
-	timeFunctionMap := map[string]string{
-		"hour":  "toStartOfHour",
-		"day":   "toStartOfDay",
-		"week":  "toStartOfWeek",
-		"month": "toStartOfMonth",
+	rollup, rollupStart, rollupEnd, ok := PickRollup(params.BucketBy, params.Timezone, params.Start, params.End)
+	if !ok {
+		return buildAccesslogQuery(params)
 	}
 
+	return buildRollupQuery(rollup, rollupStart, rollupEnd, params)
+}
+
+func buildAccesslogQuery(params QueryParams) (ClickhouseQuery, error) {
+
+	query := newQueryBuilder()
+
+	zoneId := query.bind("zoneId", "UInt32", params.ZoneId)
+	timezone := query.bind("tz", "String", params.Timezone)
+
+	query.write("SELECT ")
+
 	// the toDateTime is necessary here so we end up with times formatted per the client's TZ
-	timeFn := timeFunctionMap[bucketby]
-	query.WriteString(fmt.Sprintf("%s(toDateTime(Timestamp, '%s')) as WindowStart, ", timeFn, timezone))
+	query.write(params.BucketBy.StartFn, "(toDateTime(Timestamp, ", timezone, ")) as WindowStart, ")
 
-	query.WriteString(fmt.Sprintf("%s as GroupKey, ", groupby))
+	query.write(params.GroupBy.Column, " as GroupKey")
+
+	for _, metric := range params.Metrics {
+		query.write(", toFloat64(", metric.Accesslog, ") as Metric", metric.Name)
+	}
 
-	// a bit silly, but we only want to count PAGE loads as "hits"
-	query.WriteString("COUNT(CASE WHEN FileType = 'Page' THEN 1 ELSE 0 END) as Hits, ")
-	// but count the bytes as total because otherwise would be nonsense
-	query.WriteString("SUM(BytesSent) as Bytes ")
+	query.write(" ")
 
-	query.WriteString("FROM accesslog ")
+	query.write("FROM accesslog ")
 
-	query.WriteString(fmt.Sprintf("WHERE PullZoneId = '%s' ", zoneId))
+	query.write("WHERE PullZoneId = ", zoneId, " ")
 
-	// the toDateTime might not be necessary here since we're supplying epoch ms, but shrug
-	query.WriteString(fmt.Sprintf("AND Timestamp >= toDateTime(%d, '%s') ", unixStart, timezone))
-	query.WriteString(fmt.Sprintf("AND Timestamp < toDateTime(%d, '%s') ", unixEnd, timezone))
+	query.write("AND Timestamp >= toDateTime(", query.bind("start", "Int64", params.Start), ") ")
+	query.write("AND Timestamp < toDateTime(", query.bind("end", "Int64", params.End), ") ")
+	query.bots(params.Bots)
 
-	query.WriteString("GROUP BY WindowStart, GroupKey ")
+	query.write("GROUP BY WindowStart, GroupKey ")
+
+	query.write("ORDER BY WindowStart ASC WITH FILL STEP ", params.BucketBy.IntervalFn, "(1)")
+
+	return query.build()
+}
 
-	intervalFunctionMap := map[string]string{
-		"hour":  "toIntervalHour",
-		"day":   "toIntervalDay",
-		"week":  "toIntervalWeek",
-		"month": "toIntervalMonth",
+// the rollup's rows from rollupStart to rollupEnd, plus accesslog's for
+// whatever's left at either end, which get summed up together into the same
+// buckets. accesslog's visitors go in as uniqCombined states, the same as the
+// rollup keeps, so a visitor on both sides of the line only counts once
+func buildRollupQuery(rollup Rollup, rollupStart, rollupEnd int64, params QueryParams) (ClickhouseQuery, error) {
+
+	query := newQueryBuilder()
+
+	zoneId := query.bind("zoneId", "UInt32", params.ZoneId)
+	timezone := query.bind("tz", "String", params.Timezone)
+	start := query.bind("start", "Int64", params.Start)
+	end := query.bind("end", "Int64", params.End)
+	rollupStartParam := query.bind("rollupStart", "Int64", rollupStart)
+	rollupEndParam := query.bind("rollupEnd", "Int64", rollupEnd)
+
+	query.write("SELECT ")
+
+	query.write(params.BucketBy.StartFn, "(toDateTime(Start, ", timezone, ")) as WindowStart, ")
+
+	query.write("GroupKey")
+
+	for _, metric := range params.Metrics {
+		query.write(", toFloat64(", metric.Rollup, ") as Metric", metric.Name)
+	}
+
+	query.write(" ")
+
+	query.write("FROM (")
+
+	query.write("SELECT Start, GroupKey, Requests, Pageviews, Visitors, Bytes, CachedRequests, ClientErrors, ServerErrors, BytesSaved ")
+	query.write("FROM ", rollup.Table, " ")
+	query.write("WHERE PullZoneId = ", zoneId, " ")
+	query.write("AND Dimension = ", query.bind("dimension", "String", params.GroupBy.Name), " ")
+	query.write("AND Start >= toDateTime(", rollupStartParam, ") ")
+	query.write("AND Start < toDateTime(", rollupEndParam, ") ")
+	query.bots(params.Bots)
+
+	// nothing left over when the range is whole steps already
+	if params.Start < rollupStart || rollupEnd < params.End {
+
+		query.write("UNION ALL ")
+
+		// same as the rollups do it, see schema/migrations/0027
+		query.write("SELECT toDateTime(Timestamp, 'UTC') as Start, ")
+		query.write("toString(", params.GroupBy.Column, ") as GroupKey, ")
+		query.write("count() as Requests, ")
+		query.write("countIf(FileType = 'Page') as Pageviews, ")
+		query.write("uniqCombinedStateIf(VisitorId, VisitorId != 0) as Visitors, ")
+		query.write("SUM(BytesSent) as Bytes, ")
+		query.write("countIf(Cached) as CachedRequests, ")
+		query.write("countIf(StatusCategory = '4xx') as ClientErrors, ")
+		query.write("countIf(StatusCategory = '5xx') as ServerErrors, ")
+		query.write("sumIf(BodyBytesSent * (GzipRatio - 1), GzipRatio > 1) as BytesSaved ")
+		query.write("FROM accesslog ")
+		query.write("WHERE PullZoneId = ", zoneId, " ")
+		query.write("AND ((Timestamp >= toDateTime(", start, ") AND Timestamp < toDateTime(", rollupStartParam, ")) ")
+		query.write("OR (Timestamp >= toDateTime(", rollupEndParam, ") AND Timestamp < toDateTime(", end, "))) ")
+		query.bots(params.Bots)
+		query.write("GROUP BY Start, GroupKey")
 	}
 
-	interval := intervalFunctionMap[bucketby]
-	query.WriteString(fmt.Sprintf("ORDER BY WindowStart ASC WITH FILL STEP %s(1)", interval))
+	query.write(") ")
+
+	query.write("GROUP BY WindowStart, GroupKey ")
 
-	return query.String()
+	query.write("ORDER BY WindowStart ASC WITH FILL STEP ", params.BucketBy.IntervalFn, "(1)")
+
+	return query.build()
 }
 
-func QueryResultToPoints(rows []QueryResult) map[string][]Point {
+func QueryResultToPoints(rows []QueryResult, metrics []Metric) map[string][]Point {
 
 	timeserieses := map[string][]Point{}
 
@@ -183,21 +226,16 @@ func QueryResultToPoints(rows []QueryResult) map[string][]Point {
 			timeserieses[row.GroupKey] = make([]Point, 0)
 		}
 
-		point := Point{row.WindowStart.Unix(), row.Hits, row.Bytes}
+		point := Point{row.WindowStart.Unix(), map[string]float64{}}
+		for n, metric := range metrics {
+			// a ratio of nothing, which JSON has no way of saying
+			if math.IsNaN(row.Metrics[n]) {
+				row.Metrics[n] = 0
+			}
+			point.Metrics[metric.Name] = row.Metrics[n]
+		}
 		timeserieses[row.GroupKey] = append(timeserieses[row.GroupKey], point)
 	}
 
 	return timeserieses
 }
-
-// func (i InfluxClient) BuildInfluxQuery() (string, error) {
-
-// 	// if includeBots is true, then we want everything -- so no filter
-// 	// todo -- isprobablybot is a string ?? should fix that
-// 	if includeBots == "false" {
-// 		query.WriteString(" ")
-// 		query.WriteString(fmt.Sprintf("and isprobablybot = 'false'"))
-// 	}
-
-// 	return query.String(), nil
-// }
@@ -0,0 +1,36 @@
+package query
+
+// Metric is something a query can ask for, as SQL over accesslog's rows, and
+// as SQL over the rollups' (and accesslog's, made to look like the rollups',
+// see buildRollupQuery). Both only ever come from METRICS
+type Metric struct {
+	Name      string
+	Accesslog string
+	Rollup    string
+}
+
+// below should be const, but golang knows better
+var METRICS = []Metric{
+	{"Pageviews", "countIf(FileType = 'Page')", "SUM(Pageviews)"},
+	{"Requests", "count()", "SUM(Requests)"},
+	// approximate, but close enough and a lot cheaper than uniqExact. VisitorId 0
+	// is a log too old to have had a salt, so we don't know who that was
+	{"Visitors", "uniqCombinedIf(VisitorId, VisitorId != 0)", "uniqCombinedMerge(Visitors)"},
+	{"Bytes", "SUM(BytesSent)", "SUM(Bytes)"},
+	{"ClientErrorRate", "countIf(StatusCategory = '4xx') / count()", "SUM(ClientErrors) / SUM(Requests)"},
+	{"ServerErrorRate", "countIf(StatusCategory = '5xx') / count()", "SUM(ServerErrors) / SUM(Requests)"},
+	// of all requests, not just pages, since assets are most of what gets cached
+	{"CacheHitRatio", "countIf(Cached) / count()", "SUM(CachedRequests) / SUM(Requests)"},
+	// GzipRatio is uncompressed over compressed (0 when it wasn't), and the body
+	// bytes are what went out compressed, so the difference is what we didn't send
+	{"BytesSaved", "sumIf(BodyBytesSent * (GzipRatio - 1), GzipRatio > 1)", "SUM(BytesSaved)"},
+}
+var DEFAULTMETRICS = []string{"Pageviews", "Visitors", "Bytes"}
+
+func metricNames() []string {
+	names := []string{}
+	for _, metric := range METRICS {
+		names = append(names, metric.Name)
+	}
+	return names
+}
@@ -0,0 +1,225 @@
+package query
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/exp/slices"
+)
+
+// Dimension is something results can be grouped by. Column is what goes into
+// the SQL, and only ever comes from DIMENSIONS, never from a request
+type Dimension struct {
+	Name   string
+	Column string
+}
+
+// Bucket is a width of time results can be bucketed by, with the clickhouse
+// functions that round down to one and step from one to the next. Seconds is
+// the shortest it can be, months being at least 28 days
+type Bucket struct {
+	Name       string
+	StartFn    string
+	IntervalFn string
+	Seconds    int64
+}
+
+// below should be const, but golang knows better. DIMENSIONS is also written
+// out, name for name and in this order, in the ARRAY JOIN of the rollups'
+// materialized views and the copies that backfilled them (schema/migrations
+// 0017 to 0020 and 0025 to 0028, where 0019 still calls it VALIDGROUPBYS),
+// which TestRollupDimensions checks. A new one means new migrations redoing
+// the views
+var DIMENSIONS = []Dimension{
+	{"Browser", "Browser"},
+	{"Os", "Os"},
+	{"Device", "Device"},
+	{"Country", "Country"},
+	{"Path", "Path"},
+	{"StatusCategory", "StatusCategory"},
+	{"ReferrerSource", "ReferrerSource"},
+	{"ReferrerChannel", "ReferrerChannel"},
+	{"UtmSource", "UtmSource"},
+	{"UtmMedium", "UtmMedium"},
+	{"UtmCampaign", "UtmCampaign"},
+	{"Region", "Region"},
+	{"City", "City"},
+	{"BotReason", "BotReason"},
+	{"ServerZone", "ServerZone"},
+	{"Protocol", "Protocol"},
+}
+var BUCKETS = []Bucket{
+	{"hour", "toStartOfHour", "toIntervalHour", 60 * 60},
+	{"day", "toStartOfDay", "toIntervalDay", 24 * 60 * 60},
+	{"week", "toStartOfWeek", "toIntervalWeek", 7 * 24 * 60 * 60},
+	{"month", "toStartOfMonth", "toIntervalMonth", 28 * 24 * 60 * 60},
+}
+var VALIDBOTS = []string{"true", "false", "only"}
+
+// QueryParams is a query request, checked over, with nothing left in it that
+// came straight from the client other than numbers and a real timezone
+type QueryParams struct {
+	ZoneId   int
+	Bots     string
+	GroupBy  Dimension
+	BucketBy Bucket
+	Metrics  []Metric
+	Timezone *time.Location
+	Start    int64
+	End      int64
+}
+
+func ParseQueryParams(values url.Values) (QueryParams, error) {
+
+	params := QueryParams{}
+
+	var err error
+	params.ZoneId, params.Start, params.End, err = parseZoneRange(values)
+	if err != nil {
+		return params, err
+	}
+
+	params.Bots = values.Get("bots")
+	if !slices.Contains(VALIDBOTS, params.Bots) {
+		return params, fmt.Errorf("Invalid bots %q (try one of %v)", params.Bots, VALIDBOTS)
+	}
+
+	groupby := values.Get("groupby")
+	index := slices.IndexFunc(DIMENSIONS, func(d Dimension) bool { return d.Name == groupby })
+	if index < 0 {
+		return params, fmt.Errorf("Invalid groupby %q (try one of %v)", groupby, dimensionNames())
+	}
+	params.GroupBy = DIMENSIONS[index]
+
+	bucketby := values.Get("bucketby")
+	index = slices.IndexFunc(BUCKETS, func(b Bucket) bool { return b.Name == bucketby })
+	if index < 0 {
+		return params, fmt.Errorf("Invalid bucketby %q (try one of %v)", bucketby, bucketNames())
+	}
+	params.BucketBy = BUCKETS[index]
+
+	names := DEFAULTMETRICS
+	if values.Get("metrics") != "" {
+		names = strings.Split(values.Get("metrics"), ",")
+	}
+	for _, name := range names {
+		index = slices.IndexFunc(METRICS, func(m Metric) bool { return m.Name == name })
+		if index < 0 {
+			return params, fmt.Errorf("Invalid metric %q (try any of %v)", name, metricNames())
+		}
+		if slices.ContainsFunc(params.Metrics, func(m Metric) bool { return m.Name == name }) {
+			return params, fmt.Errorf("Metric %q asked for twice", name)
+		}
+		params.Metrics = append(params.Metrics, METRICS[index])
+	}
+
+	// LoadLocation takes "" and "Local" to mean the server's, which isn't
+	// anything the client could know, and won't go looking outside the zoneinfo
+	timezone := values.Get("tz")
+	location, err := time.LoadLocation(timezone)
+	if err != nil || timezone == "" || timezone == "Local" {
+		return params, fmt.Errorf("Invalid timezone %q", timezone)
+	}
+	params.Timezone = location
+
+	return params, nil
+}
+
+// BotReportParams is a bot report request, checked over like QueryParams
+type BotReportParams struct {
+	ZoneId int
+	Start  int64
+	End    int64
+	Limit  int
+}
+
+const (
+	defaultBotReportLimit = 20
+	maxBotReportLimit     = 100
+)
+
+func ParseBotReportParams(values url.Values) (BotReportParams, error) {
+
+	params := BotReportParams{Limit: defaultBotReportLimit}
+
+	var err error
+	params.ZoneId, params.Start, params.End, err = parseZoneRange(values)
+	if err != nil {
+		return params, err
+	}
+
+	if values.Get("limit") != "" {
+		limit, err := requiredInt(values, "limit")
+		if err != nil {
+			return params, err
+		}
+		if limit < 1 || limit > maxBotReportLimit {
+			return params, fmt.Errorf("Query param 'limit' must be from 1 to %v", maxBotReportLimit)
+		}
+		params.Limit = int(limit)
+	}
+
+	return params, nil
+}
+
+// the zone and time range every query needs
+func parseZoneRange(values url.Values) (zoneId int, start, end int64, err error) {
+
+	zoneId64, err := requiredInt(values, "zoneid")
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	if zoneId64 < 1 || zoneId64 > 1<<32-1 {
+		return 0, 0, 0, fmt.Errorf("Query param 'zoneid' is not a valid zone ID")
+	}
+
+	start, err = requiredInt(values, "start")
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	end, err = requiredInt(values, "end")
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	if start < 0 || end < start {
+		return 0, 0, 0, fmt.Errorf("Query params 'start' and 'end' are not a valid range")
+	}
+
+	return int(zoneId64), start, end, nil
+}
+
+func requiredInt(values url.Values, name string) (int64, error) {
+
+	str := values.Get(name)
+	if str == "" {
+		return 0, fmt.Errorf("Query param '%s' not provided", name)
+	}
+
+	value, err := strconv.ParseInt(str, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Query param '%s' is not a valid int", name)
+	}
+
+	return value, nil
+}
+
+func dimensionNames() []string {
+	names := []string{}
+	for _, dimension := range DIMENSIONS {
+		names = append(names, dimension.Name)
+	}
+	return names
+}
+
+func bucketNames() []string {
+	names := []string{}
+	for _, bucket := range BUCKETS {
+		names = append(names, bucket.Name)
+	}
+	return names
+}
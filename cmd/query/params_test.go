@@ -0,0 +1,254 @@
+package query
+
+import (
+	"math"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const validQuery = "zoneid=1234&bots=false&groupby=Country&bucketby=day&tz=Europe/Berlin&start=1704067200&end=1706745600"
+
+func TestParseQueryParams(t *testing.T) {
+
+	params := testParams(t, validQuery)
+
+	assert.Equal(t, 1234, params.ZoneId)
+	assert.Equal(t, "false", params.Bots)
+	assert.Equal(t, "Country", params.GroupBy.Column)
+	assert.Equal(t, "toStartOfDay", params.BucketBy.StartFn)
+	assert.Equal(t, "Europe/Berlin", params.Timezone.String())
+	assert.Equal(t, int64(1704067200), params.Start)
+	assert.Equal(t, int64(1706745600), params.End)
+}
+
+func TestParseQueryParamsRejectsMalicious(t *testing.T) {
+
+	cases := map[string]string{
+		"zoneid":   "1234' OR 1=1 --",
+		"groupby":  "Country, (SELECT password FROM users) as x",
+		"bucketby": "toStartOfDay(now())) --",
+		"bots":     "true' --",
+		"start":    "0 OR 1=1",
+		"end":      "1706745600; DROP TABLE accesslog",
+	}
+
+	timezones := []string{
+		// passes the old "8 to 30 chars with a slash" check
+		"Europe/Berlin') --",
+		"x/'); DROP TABLE accesslog; --",
+		"../../../../etc/passwd",
+		"/etc/localtime",
+		"Europe/Nowhere",
+		"Local",
+		"",
+	}
+
+	for param, value := range cases {
+		values, _ := url.ParseQuery(validQuery)
+		values.Set(param, value)
+		_, err := ParseQueryParams(values)
+		assert.Error(t, err, param)
+	}
+
+	for _, timezone := range timezones {
+		values, _ := url.ParseQuery(validQuery)
+		values.Set("tz", timezone)
+		_, err := ParseQueryParams(values)
+		assert.Error(t, err, timezone)
+	}
+
+	// and nothing missing
+	for _, param := range []string{"zoneid", "start", "end", "bots", "groupby", "bucketby", "tz"} {
+		values, _ := url.ParseQuery(validQuery)
+		values.Del(param)
+		_, err := ParseQueryParams(values)
+		assert.Error(t, err, param)
+	}
+
+	// nor nonsense
+	for _, query := range []string{"zoneid=0", "zoneid=-1", "zoneid=4294967296", "start=1706745601", "start=-1"} {
+		values, _ := url.ParseQuery(validQuery)
+		override, _ := url.ParseQuery(query)
+		for param := range override {
+			values.Set(param, override.Get(param))
+		}
+		_, err := ParseQueryParams(values)
+		assert.Error(t, err, query)
+	}
+}
+
+func TestBuildClickhouseQueryBindsValues(t *testing.T) {
+
+	// over a month of Berlin days, which is all hourly rollup, and not
+	params := testParams(t, validQuery)
+	for _, query := range []ClickhouseQuery{testBuild(t, BuildClickhouseQuery, params), testBuild(t, buildAccesslogQuery, params)} {
+
+		// nothing from the request made it into the SQL itself
+		assert.NotContains(t, query.Sql, "1234")
+		assert.NotContains(t, query.Sql, "Europe/Berlin")
+		assert.NotContains(t, query.Sql, "1704067200")
+
+		assert.Equal(t, "1234", query.Parameters["zoneId"])
+		assert.Equal(t, "Europe/Berlin", query.Parameters["tz"])
+		assert.Equal(t, "1704067200", query.Parameters["start"])
+
+		// every placeholder has a value
+		for _, placeholder := range strings.Split(query.Sql, "{")[1:] {
+			name, _, _ := strings.Cut(placeholder, ":")
+			assert.Contains(t, query.Parameters, name)
+		}
+	}
+}
+
+func TestBindTwice(t *testing.T) {
+
+	query := newQueryBuilder()
+	assert.Equal(t, "{zoneId:UInt32}", query.bind("zoneId", "UInt32", 1234))
+	query.bind("zoneId", "UInt32", 1234)
+	_, err := query.build()
+	assert.NoError(t, err)
+
+	// a mistake of ours, but not one worth a panic
+	query.bind("zoneId", "UInt32", 5678)
+	_, err = query.build()
+	assert.Error(t, err)
+	assert.Equal(t, "1234", query.params["zoneId"])
+}
+
+func testParams(t *testing.T, query string) QueryParams {
+	values, err := url.ParseQuery(query)
+	assert.NoError(t, err)
+	params, err := ParseQueryParams(values)
+	assert.NoError(t, err)
+	return params
+}
+
+func testBuild(t *testing.T, build func(QueryParams) (ClickhouseQuery, error), params QueryParams) ClickhouseQuery {
+	query, err := build(params)
+	assert.NoError(t, err)
+	return query
+}
+
+func testBucket(name string) Bucket {
+	for _, bucket := range BUCKETS {
+		if bucket.Name == name {
+			return bucket
+		}
+	}
+	panic(name)
+}
+
+func testLocation(name string) *time.Location {
+	location, err := time.LoadLocation(name)
+	if err != nil {
+		panic(err)
+	}
+	return location
+}
+
+func TestBotsFilter(t *testing.T) {
+
+	cases := map[string]string{
+		"true":  "",
+		"false": "AND NOT IsProbablyBot ",
+		"only":  "AND IsProbablyBot ",
+	}
+
+	for bots, filter := range cases {
+		values, _ := url.ParseQuery(validQuery)
+		values.Set("bots", bots)
+		params, err := ParseQueryParams(values)
+		assert.NoError(t, err)
+
+		// the rollup, and accesslog for the ragged end
+		params.End += 100
+		rollupQuery := testBuild(t, BuildClickhouseQuery, params)
+		accesslogQuery := testBuild(t, buildAccesslogQuery, params)
+
+		if filter == "" {
+			assert.NotContains(t, rollupQuery.Sql, "IsProbablyBot", bots)
+			assert.NotContains(t, accesslogQuery.Sql, "IsProbablyBot", bots)
+		} else {
+			assert.Equal(t, 2, strings.Count(rollupQuery.Sql, filter), bots)
+			assert.Equal(t, 1, strings.Count(accesslogQuery.Sql, filter), bots)
+		}
+	}
+}
+
+func TestBotReport(t *testing.T) {
+
+	values, _ := url.ParseQuery("zoneid=1234&start=1704067200&end=1706745600")
+	params, err := ParseBotReportParams(values)
+	assert.NoError(t, err)
+	assert.Equal(t, defaultBotReportLimit, params.Limit)
+
+	query, err := BuildBotReportQuery(params)
+	assert.NoError(t, err)
+	assert.Contains(t, query.Sql, "AND IsProbablyBot ")
+	assert.Equal(t, "1234", query.Parameters["zoneId"])
+	assert.Equal(t, "20", query.Parameters["limit"])
+
+	for _, limit := range []string{"0", "101", "10; DROP TABLE accesslog"} {
+		values.Set("limit", limit)
+		_, err = ParseBotReportParams(values)
+		assert.Error(t, err, limit)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+
+	// the default
+	params := testParams(t, validQuery)
+	assert.Equal(t, DEFAULTMETRICS, names(params.Metrics))
+
+	values, _ := url.ParseQuery(validQuery)
+	values.Set("metrics", "ServerErrorRate,Pageviews")
+	params, err := ParseQueryParams(values)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"ServerErrorRate", "Pageviews"}, names(params.Metrics))
+
+	// in the order asked for, over the rollup and over accesslog
+	for _, query := range []ClickhouseQuery{testBuild(t, BuildClickhouseQuery, params), testBuild(t, buildAccesslogQuery, params)} {
+		serverErrors := strings.Index(query.Sql, "as MetricServerErrorRate")
+		pageviews := strings.Index(query.Sql, "as MetricPageviews")
+		assert.True(t, 0 < serverErrors && serverErrors < pageviews, query.Sql)
+	}
+
+	// pageviews are pages, not everything
+	assert.Contains(t, testBuild(t, buildAccesslogQuery, params).Sql, "toFloat64(countIf(FileType = 'Page')) as MetricPageviews")
+
+	for _, metrics := range []string{"Hits", "Pageviews,Pageviews", "Pageviews,", "count()", "Pageviews) as x, (SELECT 1"} {
+		values.Set("metrics", metrics)
+		_, err = ParseQueryParams(values)
+		assert.Error(t, err, metrics)
+	}
+}
+
+func TestQueryResultToPoints(t *testing.T) {
+
+	metrics := []Metric{METRICS[0], METRICS[4]}
+	rows := []QueryResult{
+		{time.Unix(3600, 0), "Chrome", []float64{12, 0.25}},
+		{time.Unix(7200, 0), "Chrome", []float64{0, math.NaN()}},
+		{time.Unix(3600, 0), "Firefox", []float64{3, 0}},
+	}
+
+	points := QueryResultToPoints(rows, metrics)
+
+	assert.Len(t, points["Chrome"], 2)
+	assert.Equal(t, Point{3600, map[string]float64{"Pageviews": 12, "ClientErrorRate": 0.25}}, points["Chrome"][0])
+	assert.Equal(t, Point{7200, map[string]float64{"Pageviews": 0, "ClientErrorRate": 0}}, points["Chrome"][1])
+	assert.Equal(t, float64(3), points["Firefox"][0].Metrics["Pageviews"])
+}
+
+func names(metrics []Metric) []string {
+	names := []string{}
+	for _, metric := range metrics {
+		names = append(names, metric.Name)
+	}
+	return names
+}
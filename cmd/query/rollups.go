@@ -0,0 +1,65 @@
+package query
+
+import (
+	"time"
+)
+
+// Rollup is one of the pre-aggregated copies of accesslog (see
+// schema/migrations/0015 and 0016), one row per zone, dimension, group, and
+// Step seconds, starting on UTC boundaries
+type Rollup struct {
+	Table string
+	Step  int64
+}
+
+// below should be const, but golang knows better. Coarsest first
+var ROLLUPS = []Rollup{
+	{"accesslog_daily", 24 * 60 * 60},
+	{"accesslog_hourly", 60 * 60},
+}
+
+// PickRollup finds the coarsest rollup that can answer the query, along with
+// the part of the range it covers, whole steps only, the rest being left to
+// accesslog. A rollup row has to land in a single bucket, so the bucket has to
+// be at least a step, and the timezone's offset has to be whole steps for the
+// whole range. ok is false when nothing is better than accesslog
+func PickRollup(bucketby Bucket, location *time.Location, unixStart, unixEnd int64) (rollup Rollup, start, end int64, ok bool) {
+
+	for _, rollup := range ROLLUPS {
+
+		if bucketby.Seconds < rollup.Step || !offsetsAligned(location, rollup.Step, unixStart, unixEnd) {
+			continue
+		}
+
+		// rounded inwards, to whole steps
+		start := (unixStart + rollup.Step - 1) / rollup.Step * rollup.Step
+		end := unixEnd / rollup.Step * rollup.Step
+
+		if start < end {
+			return rollup, start, end, true
+		}
+	}
+
+	return Rollup{}, 0, 0, false
+}
+
+// whether the timezone is a whole number of steps off UTC from start to end.
+// Offsets only change at DST and the odd political decision, months apart, so
+// checking daily is plenty
+func offsetsAligned(location *time.Location, step, unixStart, unixEnd int64) bool {
+
+	const day = 24 * 60 * 60
+
+	for at := unixStart; ; at += day {
+		if at > unixEnd {
+			at = unixEnd
+		}
+		_, offset := time.Unix(at, 0).In(location).Zone()
+		if int64(offset)%step != 0 {
+			return false
+		}
+		if at == unixEnd {
+			return true
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package query
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+
+	"ecstatic/schema"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPickRollup(t *testing.T) {
+
+	// 2024-01-01 00:00 UTC to 2025-01-01 00:00 UTC
+	yearStart, yearEnd := int64(1704067200), int64(1735689600)
+
+	// by the month in UTC, all of it from the daily rollup
+	rollup, start, end, ok := PickRollup(testBucket("month"), testLocation("Etc/UTC"), yearStart, yearEnd)
+	assert.True(t, ok)
+	assert.Equal(t, "accesslog_daily", rollup.Table)
+	assert.Equal(t, yearStart, start)
+	assert.Equal(t, yearEnd, end)
+
+	// a day's worth of hours is too fine for the daily rollup
+	rollup, _, _, ok = PickRollup(testBucket("hour"), testLocation("Etc/UTC"), yearStart, yearEnd)
+	assert.True(t, ok)
+	assert.Equal(t, "accesslog_hourly", rollup.Table)
+
+	// UTC days aren't Berlin's, but its hours are
+	rollup, _, _, ok = PickRollup(testBucket("day"), testLocation("Europe/Berlin"), yearStart, yearEnd)
+	assert.True(t, ok)
+	assert.Equal(t, "accesslog_hourly", rollup.Table)
+
+	// and India is half an hour off
+	_, _, _, ok = PickRollup(testBucket("day"), testLocation("Asia/Kolkata"), yearStart, yearEnd)
+	assert.False(t, ok)
+
+	// ragged ends get rounded inwards, for accesslog to do
+	rollup, start, end, ok = PickRollup(testBucket("day"), testLocation("Etc/UTC"), yearStart+100, yearEnd-100)
+	assert.True(t, ok)
+	assert.Equal(t, "accesslog_daily", rollup.Table)
+	assert.Equal(t, yearStart+86400, start)
+	assert.Equal(t, yearEnd-86400, end)
+
+	// not even a whole hour in there
+	_, _, _, ok = PickRollup(testBucket("hour"), testLocation("Etc/UTC"), yearStart+100, yearStart+3000)
+	assert.False(t, ok)
+}
+
+func TestBuildClickhouseQueryRollup(t *testing.T) {
+
+	query := testBuild(t, BuildClickhouseQuery, testParams(t, "zoneid=1234&bots=true&groupby=Browser&bucketby=day&tz=Etc/UTC&start=1704067200&end=1735689600"))
+	assert.Contains(t, query.Sql, "FROM accesslog_daily ")
+	assert.Contains(t, query.Sql, "AND Dimension = {dimension:String} ")
+	assert.Equal(t, "Browser", query.Parameters["dimension"])
+	assert.NotContains(t, query.Sql, "UNION ALL")
+
+	query = testBuild(t, BuildClickhouseQuery, testParams(t, "zoneid=1234&bots=true&groupby=Browser&bucketby=day&tz=Etc/UTC&start=1704067300&end=1735689600"))
+	assert.Contains(t, query.Sql, "UNION ALL")
+	assert.Contains(t, query.Sql, "FROM accesslog ")
+
+	query = testBuild(t, BuildClickhouseQuery, testParams(t, "zoneid=1234&bots=true&groupby=Browser&bucketby=hour&tz=Asia/Kolkata&start=1704067200&end=1735689600"))
+	assert.NotContains(t, query.Sql, "accesslog_hourly")
+}
+
+// the rollups only know about the dimensions their views were made with, and
+// every view and backfill has its own copy of the list
+func TestRollupDimensions(t *testing.T) {
+
+	migrations, err := schema.Migrations()
+	assert.NoError(t, err)
+
+	arrayJoin := regexp.MustCompile(`(?s)ARRAY JOIN \[(.*?)\] AS Dim`)
+	dimension := regexp.MustCompile(`\('(\w+)', (?:toString\((\w+)\)|(\w+))\)`)
+
+	checked := 0
+	for _, migration := range migrations {
+		if !strings.Contains(migration.Sql, "ARRAY JOIN") {
+			continue
+		}
+		checked++
+
+		list := arrayJoin.FindStringSubmatch(migration.Sql)
+		if !assert.NotNil(t, list, migration.Name) {
+			continue
+		}
+
+		names, columns := []string{}, []string{}
+		for _, match := range dimension.FindAllStringSubmatch(list[1], -1) {
+			names = append(names, match[1])
+			columns = append(columns, match[2]+match[3])
+		}
+
+		expected := []string{}
+		for _, d := range DIMENSIONS {
+			expected = append(expected, d.Column)
+		}
+		assert.Equal(t, dimensionNames(), names, migration.Name)
+		assert.Equal(t, expected, columns, migration.Name)
+	}
+
+	// 0017 to 0020 and 0025 to 0028, so a new copy gets a look in here too
+	assert.Equal(t, 8, checked)
+}
@@ -14,6 +14,7 @@ require (
 	github.com/go-chi/jwtauth/v5 v5.1.1
 	github.com/lestrrat-go/jwx/v2 v2.0.11
 	github.com/mileusna/useragent v1.3.3
+	github.com/oschwald/maxminddb-golang v1.12.0
 	github.com/prometheus/client_golang v1.17.0
 	github.com/slok/go-http-metrics v0.11.0
 	github.com/spf13/cobra v1.7.0
@@ -1,9 +1,11 @@
 package main
 
 import (
+	"ecstatic/cmd/admin"
 	"ecstatic/cmd/api"
 	"ecstatic/cmd/git"
 	"ecstatic/cmd/intake"
+	"ecstatic/cmd/migrate"
 	"ecstatic/cmd/query"
 
 	"github.com/spf13/cobra"
@@ -14,9 +16,11 @@ func main() {
 		Use:   "ecstatic",
 		Short: "ecstatic - parse, store, and query server access logs",
 	}
+	rootCmd.AddCommand(admin.AdminCmd)
 	rootCmd.AddCommand(api.ApiCmd)
 	rootCmd.AddCommand(git.GitCmd)
 	rootCmd.AddCommand(intake.IntakeCmd)
+	rootCmd.AddCommand(migrate.MigrateCmd)
 	rootCmd.AddCommand(query.QueryCmd)
 	rootCmd.Execute()
 }
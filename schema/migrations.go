@@ -0,0 +1,211 @@
+// Package schema is the clickhouse schema, as an ordered list of migrations.
+// Each file in migrations/ is named NNNN_what_it_does.sql and holds exactly one
+// statement (that's all clickhouse will take per query). Written so they can be
+// run against a database that already has the change, since 0001 describes a
+// table that existed long before this did. What can't be written that way (a
+// RENAME, a copy that has to start over) says so in its leading comments:
+//
+//	-- only if: SELECT ...
+//	-- before: TRUNCATE TABLE ...
+//
+// "only if" is a query that comes out 0 once the migration isn't needed, and
+// the migration is then just recorded, and "before" runs first every time, to
+// undo whatever a run that failed partway left behind
+package schema
+
+import (
+	"context"
+	"embed"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	ch "github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+)
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+type Migration struct {
+	Version int
+	Name    string
+	Sql     string
+	// from the "-- only if:" and "-- before:" comments, if any
+	OnlyIf string
+	Before string
+}
+
+const (
+	onlyIfPrefix = "-- only if:"
+	beforePrefix = "-- before:"
+)
+
+// where we keep track of what's been applied, one row per migration
+const createTrackingTable = `CREATE TABLE IF NOT EXISTS schema_migrations
+(
+    Version   UInt32,
+    Name      String,
+    AppliedAt DateTime
+)
+ENGINE = MergeTree
+ORDER BY Version`
+
+// Migrations returns every migration there is, oldest first
+func Migrations() ([]Migration, error) {
+
+	entries, err := migrationFiles.ReadDir("migrations")
+	if err != nil {
+		return nil, fmt.Errorf("Could not read embedded migrations: %w", err)
+	}
+
+	migrations := []Migration{}
+	seen := map[int]string{}
+
+	for _, entry := range entries {
+
+		name := strings.TrimSuffix(entry.Name(), ".sql")
+
+		prefix, _, found := strings.Cut(name, "_")
+		version, err := strconv.Atoi(prefix)
+		if !found || err != nil || version < 1 {
+			return nil, fmt.Errorf("Migration %v is not named NNNN_description.sql", entry.Name())
+		}
+
+		if other, ok := seen[version]; ok {
+			return nil, fmt.Errorf("Migrations %v and %v have the same version", other, entry.Name())
+		}
+		seen[version] = entry.Name()
+
+		sql, err := migrationFiles.ReadFile(path.Join("migrations", entry.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("Could not read migration %v: %w", entry.Name(), err)
+		}
+
+		migration := Migration{Version: version, Name: name, Sql: string(sql)}
+
+		for _, line := range strings.Split(migration.Sql, "\n") {
+			if !strings.HasPrefix(line, "--") {
+				break
+			}
+			if guard, ok := strings.CutPrefix(line, onlyIfPrefix); ok {
+				migration.OnlyIf = strings.TrimSpace(guard)
+			}
+			if before, ok := strings.CutPrefix(line, beforePrefix); ok {
+				migration.Before = strings.TrimSpace(before)
+			}
+		}
+
+		migrations = append(migrations, migration)
+	}
+
+	sort.Slice(migrations, func(a, b int) bool {
+		return migrations[a].Version < migrations[b].Version
+	})
+
+	return migrations, nil
+}
+
+// Applied returns when each applied migration was applied, by version
+func Applied(ctx context.Context, conn ch.Conn) (map[int]time.Time, error) {
+
+	err := conn.Exec(ctx, createTrackingTable)
+	if err != nil {
+		return nil, fmt.Errorf("Could not create migrations table: %w", err)
+	}
+
+	rows, err := conn.Query(ctx, "SELECT Version, AppliedAt FROM schema_migrations")
+	if err != nil {
+		return nil, fmt.Errorf("Could not query migrations table: %w", err)
+	}
+
+	defer rows.Close()
+
+	applied := map[int]time.Time{}
+
+	for rows.Next() {
+		var version uint32
+		var appliedAt time.Time
+		err = rows.Scan(&version, &appliedAt)
+		if err != nil {
+			return nil, fmt.Errorf("Could not scan migrations table: %w", err)
+		}
+		applied[int(version)] = appliedAt
+	}
+
+	return applied, rows.Err()
+}
+
+// Pending returns the migrations that haven't been applied yet, oldest first
+func Pending(ctx context.Context, conn ch.Conn) ([]Migration, error) {
+
+	migrations, err := Migrations()
+	if err != nil {
+		return nil, err
+	}
+
+	applied, err := Applied(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
+
+	pending := []Migration{}
+	for _, migration := range migrations {
+		if _, ok := applied[migration.Version]; !ok {
+			pending = append(pending, migration)
+		}
+	}
+
+	return pending, nil
+}
+
+// Up applies every pending migration in order, stopping at the first one that
+// fails, and returns the ones that were applied
+func Up(ctx context.Context, conn ch.Conn) ([]Migration, error) {
+
+	pending, err := Pending(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
+
+	done := []Migration{}
+
+	for _, migration := range pending {
+
+		needed := uint8(1)
+		if migration.OnlyIf != "" {
+			err = conn.QueryRow(ctx, fmt.Sprintf("SELECT toUInt8((%s) != 0)", migration.OnlyIf)).Scan(&needed)
+			if err != nil {
+				return done, fmt.Errorf("Could not check whether migration %v is needed: %w", migration.Name, err)
+			}
+		}
+
+		if needed == 1 && migration.Before != "" {
+			err = conn.Exec(ctx, migration.Before)
+			if err != nil {
+				return done, fmt.Errorf("Could not prepare for migration %v: %w", migration.Name, err)
+			}
+		}
+
+		if needed == 1 {
+			err = conn.Exec(ctx, migration.Sql)
+			if err != nil {
+				return done, fmt.Errorf("Could not apply migration %v: %w", migration.Name, err)
+			}
+		}
+
+		// clickhouse has no transactions to speak of, so if this fails the migration
+		// runs again next time, which is why they all have to be safe to rerun, or
+		// else say how with "only if" and "before"
+		err = conn.Exec(ctx, "INSERT INTO schema_migrations (Version, Name, AppliedAt) VALUES (?, ?, ?)", uint32(migration.Version), migration.Name, time.Now())
+		if err != nil {
+			return done, fmt.Errorf("Applied migration %v, but could not record it: %w", migration.Name, err)
+		}
+
+		done = append(done, migration)
+	}
+
+	return done, nil
+}
@@ -0,0 +1,21 @@
+-- the accesslog table as it existed before migrations were tracked in the repo,
+-- one row per request, column order matches addToBatch in cmd/intake
+CREATE TABLE IF NOT EXISTS accesslog
+(
+    PullZoneId     UInt32,
+    Timestamp      DateTime,
+    BytesSent      UInt64,
+    StatusCode     UInt16,
+    StatusCategory LowCardinality(String),
+    Host           String,
+    Path           String,
+    Referrer       String,
+    Device         LowCardinality(String),
+    Browser        LowCardinality(String),
+    Os             LowCardinality(String),
+    Country        LowCardinality(String),
+    FileType       LowCardinality(String),
+    IsProbablyBot  Bool
+)
+ENGINE = MergeTree
+ORDER BY (PullZoneId, Timestamp)
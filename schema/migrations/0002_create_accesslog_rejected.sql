@@ -0,0 +1,13 @@
+-- dead letters from intake, for when DEADLETTER_SINK=clickhouse: logs that could
+-- not be parsed or inserted, kept raw so they can be replayed after a fix
+CREATE TABLE IF NOT EXISTS accesslog_rejected
+(
+    ReceivedAt DateTime64(3),
+    Source     String,
+    Stage      LowCardinality(String),
+    Error      String,
+    Raw        String
+)
+ENGINE = MergeTree
+ORDER BY ReceivedAt
+TTL toDateTime(ReceivedAt) + INTERVAL 30 DAY
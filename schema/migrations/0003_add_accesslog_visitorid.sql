@@ -0,0 +1,3 @@
+-- salted daily hash of zone, IP, and user agent, for counting unique visitors.
+-- 0 means unknown, which is everything from before this column existed
+ALTER TABLE accesslog ADD COLUMN IF NOT EXISTS VisitorId UInt64 AFTER IsProbablyBot
@@ -0,0 +1,8 @@
+-- canonical referrer source and channel (search, social, email, direct, internal,
+-- referral), plus the utm_* campaign tags from the query string
+ALTER TABLE accesslog
+    ADD COLUMN IF NOT EXISTS ReferrerSource  LowCardinality(String) AFTER VisitorId,
+    ADD COLUMN IF NOT EXISTS ReferrerChannel LowCardinality(String) AFTER ReferrerSource,
+    ADD COLUMN IF NOT EXISTS UtmSource       String AFTER ReferrerChannel,
+    ADD COLUMN IF NOT EXISTS UtmMedium       LowCardinality(String) AFTER UtmSource,
+    ADD COLUMN IF NOT EXISTS UtmCampaign     String AFTER UtmMedium
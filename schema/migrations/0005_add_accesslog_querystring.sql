@@ -0,0 +1,3 @@
+-- Path is now normalized (no query string, no index.html, no trailing slash),
+-- the query string it used to include goes here instead
+ALTER TABLE accesslog ADD COLUMN IF NOT EXISTS QueryString String AFTER UtmCampaign
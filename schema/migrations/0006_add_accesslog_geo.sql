@@ -0,0 +1,6 @@
+-- from the local geo database(s), empty (or 0) when there wasn't one or the IP
+-- wasn't in it
+ALTER TABLE accesslog
+    ADD COLUMN IF NOT EXISTS Region LowCardinality(String) AFTER QueryString,
+    ADD COLUMN IF NOT EXISTS City   LowCardinality(String) AFTER Region,
+    ADD COLUMN IF NOT EXISTS Asn    UInt32 AFTER City
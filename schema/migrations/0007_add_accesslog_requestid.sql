@@ -0,0 +1,3 @@
+-- bunny's ID for the request, so the same log coming in twice (say, from an
+-- import that overlaps the live feed) can be spotted
+ALTER TABLE accesslog ADD COLUMN IF NOT EXISTS RequestId String AFTER Asn
@@ -0,0 +1,5 @@
+-- which decoder (and, for formats that don't carry one, which zone) a dead
+-- letter was meant for, so a replay decodes it the same way
+ALTER TABLE accesslog_rejected
+    ADD COLUMN IF NOT EXISTS Format LowCardinality(String) DEFAULT 'bunny' AFTER Raw,
+    ADD COLUMN IF NOT EXISTS ZoneId UInt32 AFTER Format
@@ -0,0 +1,4 @@
+-- why IsProbablyBot is true (user_agent, ip_range, robots_txt, probe_path, rate,
+-- or no_assets), empty for humans and for rows from before it was tracked
+ALTER TABLE accesslog
+    ADD COLUMN IF NOT EXISTS BotReason LowCardinality(String) AFTER IsProbablyBot
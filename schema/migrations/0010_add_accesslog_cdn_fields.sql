@@ -0,0 +1,10 @@
+-- how the CDN served each request, for tuning caching. Zero/empty for rows from
+-- before these were kept, and for formats that don't say
+ALTER TABLE accesslog
+    ADD COLUMN IF NOT EXISTS Cached        Bool AFTER RequestId,
+    ADD COLUMN IF NOT EXISTS ServerZone    LowCardinality(String) AFTER Cached,
+    ADD COLUMN IF NOT EXISTS GzipRatio     Float32 AFTER ServerZone,
+    ADD COLUMN IF NOT EXISTS BodyBytesSent UInt64 AFTER GzipRatio,
+    ADD COLUMN IF NOT EXISTS Protocol      LowCardinality(String) AFTER BodyBytesSent,
+    ADD COLUMN IF NOT EXISTS IsSSL         Bool AFTER Protocol,
+    ADD COLUMN IF NOT EXISTS HeaderRange   String AFTER IsSSL
@@ -0,0 +1,10 @@
+-- everything so far, with intake stopped so nothing goes missing in between.
+-- Rows from before RequestId was kept get a random one, since collapsing every
+-- old row in the same second into one would be a lot worse than no dedupe.
+-- Starts from an empty table every time, so a copy that failed halfway just
+-- gets done over, and only while 0013 hasn't swapped the table in yet
+-- only if: SELECT count() FROM system.tables WHERE database = currentDatabase() AND name = 'accesslog_dedupe'
+-- before: TRUNCATE TABLE accesslog_dedupe
+INSERT INTO accesslog_dedupe
+SELECT * REPLACE (if(RequestId = '', toString(generateUUIDv4()), RequestId) AS RequestId)
+FROM accesslog
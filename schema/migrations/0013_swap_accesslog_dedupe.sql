@@ -0,0 +1,5 @@
+-- the old table is kept as accesslog_mergetree, to drop by hand once happy.
+-- Once the swap has happened there's no accesslog_dedupe, so a rerun does
+-- nothing
+-- only if: SELECT count() FROM system.tables WHERE database = currentDatabase() AND name = 'accesslog_dedupe'
+RENAME TABLE accesslog TO accesslog_mergetree, accesslog_dedupe TO accesslog
@@ -0,0 +1,14 @@
+-- a record of every deletion of analytics data, whether asked for (a purge) or
+-- routine (retention), kept forever since it's the proof it happened. Nothing
+-- in it says anything about visitors, only which zone and how many rows
+CREATE TABLE IF NOT EXISTS audit_log
+(
+    At     DateTime64(3),
+    Action LowCardinality(String),
+    ZoneId UInt32,
+    Actor  String,
+    Result LowCardinality(String),
+    Detail String
+)
+ENGINE = MergeTree
+ORDER BY At
@@ -0,0 +1,20 @@
+-- accesslog summed up by the hour, once per groupby dimension (Dimension says
+-- which, GroupKey is its value), so charts over long ranges don't have to scan
+-- every row. Kept in UTC, so it answers for any timezone a whole number of
+-- hours off it. Kept up to date by 0019, after 0017 copies in everything so far
+CREATE TABLE IF NOT EXISTS accesslog_hourly
+(
+    PullZoneId     UInt32,
+    Dimension      LowCardinality(String),
+    Start          DateTime('UTC'),
+    GroupKey       String,
+    IsProbablyBot  Bool,
+    Requests       SimpleAggregateFunction(sum, UInt64),
+    Pageviews      SimpleAggregateFunction(sum, UInt64),
+    Visitors       AggregateFunction(uniqCombined, UInt64),
+    Bytes          SimpleAggregateFunction(sum, UInt64),
+    CachedRequests SimpleAggregateFunction(sum, UInt64),
+    BytesSaved     SimpleAggregateFunction(sum, Float64)
+)
+ENGINE = AggregatingMergeTree
+ORDER BY (PullZoneId, Dimension, Start, GroupKey, IsProbablyBot)
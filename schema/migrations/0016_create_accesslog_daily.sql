@@ -0,0 +1,18 @@
+-- the same as accesslog_hourly, by the (UTC) day, for ranges of months to years
+-- bucketed by day or coarser. Kept up to date by 0020, after 0018's copy
+CREATE TABLE IF NOT EXISTS accesslog_daily
+(
+    PullZoneId     UInt32,
+    Dimension      LowCardinality(String),
+    Start          DateTime('UTC'),
+    GroupKey       String,
+    IsProbablyBot  Bool,
+    Requests       SimpleAggregateFunction(sum, UInt64),
+    Pageviews      SimpleAggregateFunction(sum, UInt64),
+    Visitors       AggregateFunction(uniqCombined, UInt64),
+    Bytes          SimpleAggregateFunction(sum, UInt64),
+    CachedRequests SimpleAggregateFunction(sum, UInt64),
+    BytesSaved     SimpleAggregateFunction(sum, Float64)
+)
+ENGINE = AggregatingMergeTree
+ORDER BY (PullZoneId, Dimension, Start, GroupKey, IsProbablyBot)
@@ -0,0 +1,37 @@
+-- everything so far, with intake stopped so nothing goes missing before 0019.
+-- Only copies into an empty table, so a rerun can't double everything, but a
+-- copy that failed halfway needs the table truncated before trying again
+INSERT INTO accesslog_hourly
+SELECT
+    PullZoneId,
+    Dim.1 AS Dimension,
+    toStartOfHour(Timestamp, 'UTC') AS Start,
+    Dim.2 AS GroupKey,
+    IsProbablyBot,
+    count() AS Requests,
+    countIf(FileType = 'Page') AS Pageviews,
+    uniqCombinedStateIf(VisitorId, VisitorId != 0) AS Visitors,
+    sum(BytesSent) AS Bytes,
+    countIf(Cached) AS CachedRequests,
+    sumIf(BodyBytesSent * (GzipRatio - 1), GzipRatio > 1) AS BytesSaved
+FROM accesslog
+ARRAY JOIN [
+        ('Browser', toString(Browser)),
+        ('Os', toString(Os)),
+        ('Device', toString(Device)),
+        ('Country', toString(Country)),
+        ('Path', Path),
+        ('StatusCategory', toString(StatusCategory)),
+        ('ReferrerSource', toString(ReferrerSource)),
+        ('ReferrerChannel', toString(ReferrerChannel)),
+        ('UtmSource', UtmSource),
+        ('UtmMedium', toString(UtmMedium)),
+        ('UtmCampaign', UtmCampaign),
+        ('Region', toString(Region)),
+        ('City', toString(City)),
+        ('BotReason', toString(BotReason)),
+        ('ServerZone', toString(ServerZone)),
+        ('Protocol', toString(Protocol))
+    ] AS Dim
+WHERE (SELECT count() FROM accesslog_hourly) = 0
+GROUP BY PullZoneId, Dimension, Start, GroupKey, IsProbablyBot
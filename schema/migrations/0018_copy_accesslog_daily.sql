@@ -0,0 +1,35 @@
+-- same as 0017, for the daily rollup
+INSERT INTO accesslog_daily
+SELECT
+    PullZoneId,
+    Dim.1 AS Dimension,
+    toStartOfDay(Timestamp, 'UTC') AS Start,
+    Dim.2 AS GroupKey,
+    IsProbablyBot,
+    count() AS Requests,
+    countIf(FileType = 'Page') AS Pageviews,
+    uniqCombinedStateIf(VisitorId, VisitorId != 0) AS Visitors,
+    sum(BytesSent) AS Bytes,
+    countIf(Cached) AS CachedRequests,
+    sumIf(BodyBytesSent * (GzipRatio - 1), GzipRatio > 1) AS BytesSaved
+FROM accesslog
+ARRAY JOIN [
+        ('Browser', toString(Browser)),
+        ('Os', toString(Os)),
+        ('Device', toString(Device)),
+        ('Country', toString(Country)),
+        ('Path', Path),
+        ('StatusCategory', toString(StatusCategory)),
+        ('ReferrerSource', toString(ReferrerSource)),
+        ('ReferrerChannel', toString(ReferrerChannel)),
+        ('UtmSource', UtmSource),
+        ('UtmMedium', toString(UtmMedium)),
+        ('UtmCampaign', UtmCampaign),
+        ('Region', toString(Region)),
+        ('City', toString(City)),
+        ('BotReason', toString(BotReason)),
+        ('ServerZone', toString(ServerZone)),
+        ('Protocol', toString(Protocol))
+    ] AS Dim
+WHERE (SELECT count() FROM accesslog_daily) = 0
+GROUP BY PullZoneId, Dimension, Start, GroupKey, IsProbablyBot
@@ -0,0 +1,37 @@
+-- keeps accesslog_hourly up to date with every insert into accesslog. It sees
+-- inserts, not merges, so a duplicate that gets past intake's window counts
+-- twice here even once accesslog has collapsed it. The dimensions have to
+-- match VALIDGROUPBYS in cmd/query
+CREATE MATERIALIZED VIEW IF NOT EXISTS accesslog_hourly_mv TO accesslog_hourly AS
+SELECT
+    PullZoneId,
+    Dim.1 AS Dimension,
+    toStartOfHour(Timestamp, 'UTC') AS Start,
+    Dim.2 AS GroupKey,
+    IsProbablyBot,
+    count() AS Requests,
+    countIf(FileType = 'Page') AS Pageviews,
+    uniqCombinedStateIf(VisitorId, VisitorId != 0) AS Visitors,
+    sum(BytesSent) AS Bytes,
+    countIf(Cached) AS CachedRequests,
+    sumIf(BodyBytesSent * (GzipRatio - 1), GzipRatio > 1) AS BytesSaved
+FROM accesslog
+ARRAY JOIN [
+        ('Browser', toString(Browser)),
+        ('Os', toString(Os)),
+        ('Device', toString(Device)),
+        ('Country', toString(Country)),
+        ('Path', Path),
+        ('StatusCategory', toString(StatusCategory)),
+        ('ReferrerSource', toString(ReferrerSource)),
+        ('ReferrerChannel', toString(ReferrerChannel)),
+        ('UtmSource', UtmSource),
+        ('UtmMedium', toString(UtmMedium)),
+        ('UtmCampaign', UtmCampaign),
+        ('Region', toString(Region)),
+        ('City', toString(City)),
+        ('BotReason', toString(BotReason)),
+        ('ServerZone', toString(ServerZone)),
+        ('Protocol', toString(Protocol))
+    ] AS Dim
+GROUP BY PullZoneId, Dimension, Start, GroupKey, IsProbablyBot
@@ -0,0 +1,5 @@
+-- 4xx and 5xx counts, for error rates. Zero for everything from before 0025,
+-- other than what 0025 could work out from what's still in accesslog
+ALTER TABLE accesslog_hourly
+    ADD COLUMN IF NOT EXISTS ClientErrors SimpleAggregateFunction(sum, UInt64) AFTER CachedRequests,
+    ADD COLUMN IF NOT EXISTS ServerErrors SimpleAggregateFunction(sum, UInt64) AFTER ClientErrors
@@ -0,0 +1,4 @@
+-- same as 0021, for the daily rollup
+ALTER TABLE accesslog_daily
+    ADD COLUMN IF NOT EXISTS ClientErrors SimpleAggregateFunction(sum, UInt64) AFTER CachedRequests,
+    ADD COLUMN IF NOT EXISTS ServerErrors SimpleAggregateFunction(sum, UInt64) AFTER ClientErrors
@@ -0,0 +1,2 @@
+-- same as 0023, for the daily rollup, back in 0028
+DROP VIEW IF EXISTS accesslog_daily_mv
@@ -0,0 +1,33 @@
+-- error counts for whatever accesslog still has, as rows with nothing else in
+-- them, which clickhouse sums into the rows already there. Only runs while the
+-- rollup has no errors at all, so a rerun can't double them
+INSERT INTO accesslog_hourly (PullZoneId, Dimension, Start, GroupKey, IsProbablyBot, ClientErrors, ServerErrors)
+SELECT
+    PullZoneId,
+    Dim.1 AS Dimension,
+    toStartOfHour(Timestamp, 'UTC') AS Start,
+    Dim.2 AS GroupKey,
+    IsProbablyBot,
+    countIf(StatusCategory = '4xx') AS ClientErrors,
+    countIf(StatusCategory = '5xx') AS ServerErrors
+FROM accesslog
+ARRAY JOIN [
+        ('Browser', toString(Browser)),
+        ('Os', toString(Os)),
+        ('Device', toString(Device)),
+        ('Country', toString(Country)),
+        ('Path', Path),
+        ('StatusCategory', toString(StatusCategory)),
+        ('ReferrerSource', toString(ReferrerSource)),
+        ('ReferrerChannel', toString(ReferrerChannel)),
+        ('UtmSource', UtmSource),
+        ('UtmMedium', toString(UtmMedium)),
+        ('UtmCampaign', UtmCampaign),
+        ('Region', toString(Region)),
+        ('City', toString(City)),
+        ('BotReason', toString(BotReason)),
+        ('ServerZone', toString(ServerZone)),
+        ('Protocol', toString(Protocol))
+    ] AS Dim
+WHERE (SELECT sum(ClientErrors) + sum(ServerErrors) FROM accesslog_hourly) = 0
+GROUP BY PullZoneId, Dimension, Start, GroupKey, IsProbablyBot
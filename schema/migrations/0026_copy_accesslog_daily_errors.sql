@@ -0,0 +1,31 @@
+-- same as 0025, for the daily rollup
+INSERT INTO accesslog_daily (PullZoneId, Dimension, Start, GroupKey, IsProbablyBot, ClientErrors, ServerErrors)
+SELECT
+    PullZoneId,
+    Dim.1 AS Dimension,
+    toStartOfDay(Timestamp, 'UTC') AS Start,
+    Dim.2 AS GroupKey,
+    IsProbablyBot,
+    countIf(StatusCategory = '4xx') AS ClientErrors,
+    countIf(StatusCategory = '5xx') AS ServerErrors
+FROM accesslog
+ARRAY JOIN [
+        ('Browser', toString(Browser)),
+        ('Os', toString(Os)),
+        ('Device', toString(Device)),
+        ('Country', toString(Country)),
+        ('Path', Path),
+        ('StatusCategory', toString(StatusCategory)),
+        ('ReferrerSource', toString(ReferrerSource)),
+        ('ReferrerChannel', toString(ReferrerChannel)),
+        ('UtmSource', UtmSource),
+        ('UtmMedium', toString(UtmMedium)),
+        ('UtmCampaign', UtmCampaign),
+        ('Region', toString(Region)),
+        ('City', toString(City)),
+        ('BotReason', toString(BotReason)),
+        ('ServerZone', toString(ServerZone)),
+        ('Protocol', toString(Protocol))
+    ] AS Dim
+WHERE (SELECT sum(ClientErrors) + sum(ServerErrors) FROM accesslog_daily) = 0
+GROUP BY PullZoneId, Dimension, Start, GroupKey, IsProbablyBot
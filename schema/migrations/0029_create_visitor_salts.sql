@@ -0,0 +1,15 @@
+-- each day's visitor salt, so every intake (and every restart) hashes the same
+-- visitor the same way all day. A day's salt is dropped, whole partition at a
+-- time, once it's older than yesterday, after which nobody can tie its
+-- VisitorIds back to anyone
+CREATE TABLE IF NOT EXISTS visitor_salts
+(
+    Day       Date,
+    Salt      String,
+    CreatedAt DateTime64(9) DEFAULT now64(9)
+)
+ENGINE = MergeTree
+PARTITION BY Day
+ORDER BY (Day, CreatedAt)
+TTL Day + INTERVAL 2 DAY
+SETTINGS ttl_only_drop_parts = 1, merge_with_ttl_timeout = 3600
@@ -0,0 +1,40 @@
+package schema
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMigrations(t *testing.T) {
+
+	migrations, err := Migrations()
+	assert.NoError(t, err)
+	assert.NotEmpty(t, migrations)
+
+	// no gaps, no duplicates, oldest first
+	for n, migration := range migrations {
+		assert.Equal(t, n+1, migration.Version, migration.Name)
+		assert.NotEmpty(t, migration.Sql, migration.Name)
+	}
+}
+
+func TestMigrationDirectives(t *testing.T) {
+
+	migrations, err := Migrations()
+	assert.NoError(t, err)
+
+	copied, swapped := migrations[11], migrations[12]
+
+	assert.Equal(t, "0012_copy_accesslog_dedupe", copied.Name)
+	assert.Contains(t, copied.OnlyIf, "name = 'accesslog_dedupe'")
+	assert.Equal(t, "TRUNCATE TABLE accesslog_dedupe", copied.Before)
+
+	assert.Equal(t, "0013_swap_accesslog_dedupe", swapped.Name)
+	assert.Contains(t, swapped.OnlyIf, "name = 'accesslog_dedupe'")
+	assert.Equal(t, "", swapped.Before)
+
+	// only the leading comments count
+	assert.Equal(t, "", migrations[0].OnlyIf)
+	assert.Equal(t, "", migrations[0].Before)
+}
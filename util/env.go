@@ -3,6 +3,8 @@ package util
 import (
 	"fmt"
 	"os"
+	"strconv"
+	"time"
 )
 
 func GetEnvConfigs(names []string) (map[string]string, error) {
@@ -30,3 +32,47 @@ func GetEnvConfig(name string) (string, error) {
 
 	return value, nil
 }
+
+// like GetEnvConfig, but for configs that a service can do without, in which
+// case we just hand back the fallback
+func GetOptionalEnvConfig(name, fallback string) string {
+
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+
+	return value
+}
+
+// GetOptionalEnvConfig, but parsed as an int
+func GetOptionalEnvInt(name string, fallback int) (int, error) {
+
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback, nil
+	}
+
+	parsed, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("Environment variable %v is not a valid int: %w", name, err)
+	}
+
+	return parsed, nil
+}
+
+// GetOptionalEnvConfig, but parsed as a duration like "30s"
+func GetOptionalEnvDuration(name string, fallback time.Duration) (time.Duration, error) {
+
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback, nil
+	}
+
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("Environment variable %v is not a valid duration: %w", name, err)
+	}
+
+	return parsed, nil
+}
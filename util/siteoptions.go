@@ -0,0 +1,48 @@
+package util
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// SiteOptions are the per pull zone knobs for enrichment in intake
+type SiteOptions struct {
+	// query params that actually pick the page, like ?page=2 or ?q=shoes, so are
+	// kept as part of the normalized path instead of thrown in with the rest
+	KeepQueryParams []string `json:"KeepQueryParams"`
+}
+
+// LoadSiteOptions reads a JSON object of pull zone ID to options, or returns no
+// options at all if the path is empty
+func LoadSiteOptions(path string) (map[int]SiteOptions, error) {
+
+	sites := map[int]SiteOptions{}
+
+	if path == "" {
+		return sites, nil
+	}
+
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read site options %v: %w", path, err)
+	}
+
+	byId := map[string]SiteOptions{}
+
+	err = json.Unmarshal(raw, &byId)
+	if err != nil {
+		return nil, fmt.Errorf("Could not parse site options %v: %w", path, err)
+	}
+
+	for id, options := range byId {
+		zoneId, err := strconv.Atoi(id)
+		if err != nil {
+			return nil, fmt.Errorf("Site options key %s is not a pull zone ID", id)
+		}
+		sites[zoneId] = options
+	}
+
+	return sites, nil
+}